@@ -0,0 +1,400 @@
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"tempproj/internal/types"
+	"tempproj/pkg/error/dberror"
+	"tempproj/pkg/error/svcerror"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Source is a part of the system that changed a donate
+type Source string
+
+const (
+	Websocket Source = "websocket"
+	Payment   Source = "payment"
+	Admin     Source = "admin"
+	// Background jobs fixing donates that diverged from the payment provider
+	Reconciler Source = "reconciler"
+)
+
+const (
+	Create = "create"
+	Update = "update"
+
+	// Status of the donate before it was created
+	NoStatus = -1
+
+	recordAttempts = 5
+)
+
+var ErrTampered = svcerror.ErrInternal("audit log is tampered")
+
+// Entry is one donate mutation. Entries of a donate are chained by HMACs keyed
+// with a secret kept out of the database, so changed, inserted or removed
+// entry breaks the chain even if whoever changed it recomputed the hashes.
+// Head of the chain is kept apart from entries, so removed tail of the chain
+// is detected too.
+type Entry struct {
+	DonateID      string    `bson:"donate" json:"donate"`
+	Seq           int64     `bson:"seq" json:"seq"`
+	Action        string    `bson:"action" json:"action"`
+	Actor         string    `bson:"actor" json:"actor"`
+	Source        Source    `bson:"source" json:"source"`
+	Before        int       `bson:"before" json:"before"`
+	After         int       `bson:"after" json:"after"`
+	Changes       string    `bson:"changes" json:"changes"` // JSON of changed fields
+	CorrelationID string    `bson:"correlation" json:"correlation"`
+	CreatedAt     time.Time `bson:"created" json:"created"`
+	PrevHash      string    `bson:"prev_hash" json:"prev_hash"`
+	Hash          string    `bson:"hash" json:"hash"`
+}
+
+// head is the last entry of donate's chain
+type head struct {
+	DonateID string `bson:"_id"`
+	Seq      int64  `bson:"seq"`
+	Hash     string `bson:"hash"`
+}
+
+func (e *Entry) content() []byte {
+	data, _ := json.Marshal([]interface{}{
+		e.DonateID, e.Seq, e.Action, e.Actor, e.Source, e.Before, e.After,
+		e.Changes, e.CorrelationID, e.CreatedAt.UnixNano(), e.PrevHash,
+	})
+	return data
+}
+
+func (e *Entry) hash(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(e.content())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Hash of entries recorded before the log was keyed
+func (e *Entry) legacyHash() string {
+	sum := sha256.Sum256(e.content())
+	return hex.EncodeToString(sum[:])
+}
+
+// Check that entries of one donate form an unbroken chain ending at its head.
+// Unkeyed entries are accepted only before the first keyed one, so a chain
+// can't be continued or rewritten without the key once it was keyed. Returns
+// seq of the first broken entry, zero if the chain is valid.
+func verifyChain(key []byte, entries []Entry, last *head) int64 {
+	prevHash := ""
+	keyed := false
+	for i, entry := range entries {
+		entry.CreatedAt = entry.CreatedAt.UTC()
+		if entry.Seq != int64(i+1) || entry.PrevHash != prevHash {
+			return entry.Seq
+		}
+		switch {
+		case hmac.Equal([]byte(entry.Hash), []byte(entry.hash(key))):
+			keyed = true
+		case keyed || entry.Hash != entry.legacyHash():
+			return entry.Seq
+		}
+		prevHash = entry.Hash
+	}
+	if int64(len(entries)) != last.Seq || prevHash != last.Hash {
+		return last.Seq + 1
+	}
+	return 0
+}
+
+type Filter struct {
+	DonateID      string
+	Actor         string
+	Source        Source
+	CorrelationID string
+	Since         time.Time
+	Until         time.Time
+}
+
+// Clock is a source of current time, donates.Clock satisfies it
+type Clock interface {
+	Now() time.Time
+}
+
+// IDGenerator makes correlation IDs, donates.IDGenerator satisfies it
+type IDGenerator interface {
+	NewID() string
+}
+
+// Log is append-only log of donate mutations
+type Log interface {
+	// Append entry to the chain of its donate. If ctx is a mongo session
+	// context, the entry is written in its transaction.
+	Record(ctx context.Context, entry *Entry) error
+	GetByDonate(ctx context.Context, donateID string) ([]Entry, error)
+	Find(ctx context.Context, filter Filter, page types.PageOpt) ([]Entry, error)
+	// Check hash chain of the donate and its head, returns ErrTampered if
+	// it's broken
+	Verify(ctx context.Context, donateID string) error
+}
+
+type ctxKey int
+
+const (
+	actorKey ctxKey = iota
+	sourceKey
+	correlationKey
+)
+
+// Set who changes donates in ctx
+func WithActor(ctx context.Context, actor string, source Source) context.Context {
+	ctx = context.WithValue(ctx, actorKey, actor)
+	return context.WithValue(ctx, sourceKey, source)
+}
+
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey, id)
+}
+
+// Return correlation ID of ctx, empty string if ctx doesn't have it
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey).(string)
+	return id
+}
+
+func Changes(update map[string]interface{}) string {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+type mongoLog struct {
+	log     *logrus.Entry
+	entries *mongo.Collection
+	heads   *mongo.Collection
+	key     []byte
+	clock   Clock
+	ids     IDGenerator
+}
+
+// Fill actor, source and correlation ID from ctx if empty and append entry to
+// the chain. Entry without correlation ID in ctx gets new one.
+func (l *mongoLog) Record(ctx context.Context, entry *Entry) error {
+	if entry.Actor == "" {
+		entry.Actor, _ = ctx.Value(actorKey).(string)
+	}
+	if entry.Source == "" {
+		entry.Source, _ = ctx.Value(sourceKey).(Source)
+	}
+	if entry.CorrelationID == "" {
+		entry.CorrelationID = CorrelationID(ctx)
+	}
+	if entry.CorrelationID == "" {
+		entry.CorrelationID = l.ids.NewID()
+	}
+	// Mongo keeps milliseconds only, hash must survive round trip
+	entry.CreatedAt = l.clock.Now().UTC().Truncate(time.Millisecond)
+	if mongo.SessionFromContext(ctx) != nil {
+		// Caller's transaction is retried by its owner
+		err := l.append(ctx, entry)
+		if err != nil {
+			return dberror.ErrMongoHandle(err, "can't record audit entry: %s", err)
+		}
+		return nil
+	}
+	session, err := l.entries.Database().Client().StartSession()
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.StartSession err: %s", err)
+	}
+	defer session.EndSession(ctx)
+	for i := 0; i < recordAttempts; i++ {
+		_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+			return nil, l.append(sc, entry)
+		})
+		if !mongo.IsDuplicateKeyError(err) {
+			break
+		}
+		// Concurrent entry took our seq, chain to it
+	}
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "can't record audit entry: %s", err)
+	}
+	return nil
+}
+
+// Return head of donate's chain, zero head if the chain is empty
+func (l *mongoLog) head(ctx context.Context, donateID string) (*head, error) {
+	last := &head{DonateID: donateID}
+	err := l.heads.FindOne(ctx, bson.M{"_id": donateID}).Decode(last)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	return last, nil
+}
+
+// Insert entry after the head and move the head to it. Head is updated only
+// if it's still the read one, so concurrent appends can't fork the chain.
+func (l *mongoLog) append(ctx context.Context, entry *Entry) error {
+	last, err := l.head(ctx, entry.DonateID)
+	if err != nil {
+		return err
+	}
+	entry.Seq = last.Seq + 1
+	entry.PrevHash = last.Hash
+	entry.Hash = entry.hash(l.key)
+	_, err = l.entries.InsertOne(ctx, entry)
+	if err != nil {
+		return err
+	}
+	_, err = l.heads.UpdateOne(
+		ctx,
+		bson.M{"_id": entry.DonateID, "seq": last.Seq},
+		bson.M{"$set": bson.M{"seq": entry.Seq, "hash": entry.Hash}},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (l *mongoLog) GetByDonate(ctx context.Context, donateID string) ([]Entry, error) {
+	return l.Find(ctx, Filter{DonateID: donateID}, types.PageOpt{Limit: 0, Offset: 0})
+}
+
+func (l *mongoLog) Find(ctx context.Context, filter Filter, page types.PageOpt) ([]Entry, error) {
+	query := bson.M{}
+	if filter.DonateID != "" {
+		query["donate"] = filter.DonateID
+	}
+	if filter.Actor != "" {
+		query["actor"] = filter.Actor
+	}
+	if filter.Source != "" {
+		query["source"] = filter.Source
+	}
+	if filter.CorrelationID != "" {
+		query["correlation"] = filter.CorrelationID
+	}
+	created := bson.M{}
+	if !filter.Since.IsZero() {
+		created["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		created["$lt"] = filter.Until
+	}
+	if len(created) != 0 {
+		query["created"] = created
+	}
+	sort := bson.D{{Key: "created", Value: 1}}
+	if filter.DonateID != "" {
+		sort = bson.D{{Key: "seq", Value: 1}}
+	}
+	opts := options.Find().SetSort(sort)
+	if page.Limit > 0 {
+		opts.SetLimit(int64(page.Limit))
+	}
+	if page.Offset > 0 {
+		opts.SetSkip(int64(page.Offset))
+	}
+	cursor, err := l.entries.Find(ctx, query, opts)
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.Find err: %s", err)
+	}
+	defer cursor.Close(nil)
+	result := make([]Entry, 0)
+	err = cursor.All(ctx, &result)
+	if err != nil {
+		return nil, dberror.ErrInternal("can't get audit entries from cursor: %s", err)
+	}
+	return result, nil
+}
+
+func (l *mongoLog) Verify(ctx context.Context, donateID string) error {
+	entries, err := l.GetByDonate(ctx, donateID)
+	if err != nil {
+		return err
+	}
+	last, err := l.head(ctx, donateID)
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.FindOne err: %s", err)
+	}
+	broken := verifyChain(l.key, entries, last)
+	if broken != 0 {
+		l.log.Errorf("audit log of donate %s is broken at seq %d, head is at %d", donateID, broken, last.Seq)
+		return ErrTampered
+	}
+	return nil
+}
+
+// Set heads of chains recorded before heads were kept. It's done once, while
+// there are no heads, so removed heads aren't restored from truncated chains.
+func (l *mongoLog) backfillHeads(ctx context.Context) error {
+	count, err := l.heads.EstimatedDocumentCount(ctx)
+	if err != nil || count != 0 {
+		return err
+	}
+	pipeline := bson.A{
+		bson.M{"$sort": bson.M{"seq": 1}},
+		bson.M{"$group": bson.M{
+			"_id":  "$donate",
+			"seq":  bson.M{"$last": "$seq"},
+			"hash": bson.M{"$last": "$hash"},
+		}},
+		bson.M{"$merge": bson.M{
+			"into":           l.heads.Name(),
+			"on":             "_id",
+			"whenMatched":    "keepExisting",
+			"whenNotMatched": "insert",
+		}},
+	}
+	cursor, err := l.entries.Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	return cursor.Close(ctx)
+}
+
+// Create audit log chaining entries with HMACs of the key, stamping them with
+// time of the clock and correlation IDs of ids. The key must not be stored in
+// the same database.
+func New(log *logrus.Entry, client *mongo.Client, key []byte, clock Clock, ids IDGenerator) (Log, error) {
+	switch {
+	case log == nil:
+		return nil, svcerror.ErrInternal("logger is empty")
+	case client == nil:
+		return nil, svcerror.ErrInternal("db client is empty")
+	case len(key) == 0:
+		return nil, svcerror.ErrInternal("audit key is empty")
+	case clock == nil:
+		return nil, svcerror.ErrInternal("clock is empty")
+	case ids == nil:
+		return nil, svcerror.ErrInternal("id generator is empty")
+	}
+	entries := client.Database("tempproj").Collection("donate_audit")
+	_, err := entries.Indexes().CreateOne(context.TODO(), mongo.IndexModel{
+		Keys:    bson.D{{Key: "donate", Value: 1}, {Key: "seq", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.CreateIndex err: %s", err)
+	}
+	l := &mongoLog{
+		log:     log,
+		entries: entries,
+		heads:   client.Database("tempproj").Collection("donate_audit_heads"),
+		key:     key,
+		clock:   clock,
+		ids:     ids,
+	}
+	err = l.backfillHeads(context.TODO())
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "can't backfill audit heads: %s", err)
+	}
+	return l, nil
+}
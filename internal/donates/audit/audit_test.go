@@ -0,0 +1,97 @@
+package audit
+
+import (
+	"testing"
+	"time"
+)
+
+var testKey = []byte("test audit key")
+
+// Chain entries of one donate the way Record does, legacy entries get hashes
+// of unkeyed log
+func chain(key []byte, legacy int, entries ...Entry) ([]Entry, *head) {
+	last := &head{DonateID: "donate"}
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := range entries {
+		entry := &entries[i]
+		entry.DonateID = "donate"
+		entry.Seq = last.Seq + 1
+		entry.PrevHash = last.Hash
+		entry.CreatedAt = created.Add(time.Duration(i) * time.Second)
+		if i < legacy {
+			entry.Hash = entry.legacyHash()
+		} else {
+			entry.Hash = entry.hash(key)
+		}
+		last.Seq, last.Hash = entry.Seq, entry.Hash
+	}
+	return entries, last
+}
+
+func testEntries() []Entry {
+	return []Entry{
+		{Action: Create, Actor: "donor", Source: Websocket, Before: NoStatus, After: 0},
+		{Action: Update, Actor: "payment", Source: Payment, Before: 0, After: 1},
+		{Action: Update, Actor: "payment", Source: Payment, Before: 1, After: 2},
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	cases := []struct {
+		name   string
+		build  func() ([]Entry, *head)
+		broken int64
+	}{
+		{"valid", func() ([]Entry, *head) {
+			return chain(testKey, 0, testEntries()...)
+		}, 0},
+		{"empty", func() ([]Entry, *head) {
+			return chain(testKey, 0)
+		}, 0},
+		{"changed entry", func() ([]Entry, *head) {
+			entries, last := chain(testKey, 0, testEntries()...)
+			entries[1].After = 3
+			return entries, last
+		}, 2},
+		{"changed entry rehashed without key", func() ([]Entry, *head) {
+			entries := testEntries()
+			entries[2].After = 3
+			return chain([]byte("guessed key"), 0, entries...)
+		}, 1},
+		{"removed entry", func() ([]Entry, *head) {
+			entries, last := chain(testKey, 0, testEntries()...)
+			return append(entries[:1], entries[2:]...), last
+		}, 3},
+		{"removed tail", func() ([]Entry, *head) {
+			entries, last := chain(testKey, 0, testEntries()...)
+			return entries[:2], last
+		}, 4},
+		{"legacy entries before keyed ones", func() ([]Entry, *head) {
+			return chain(testKey, 2, testEntries()...)
+		}, 0},
+		{"legacy entry after keyed one", func() ([]Entry, *head) {
+			entries, _ := chain(testKey, 0, testEntries()...)
+			entries[2].Hash = entries[2].legacyHash()
+			return entries, &head{DonateID: "donate", Seq: 3, Hash: entries[2].Hash}
+		}, 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			entries, last := c.build()
+			if broken := verifyChain(testKey, entries, last); broken != c.broken {
+				t.Errorf("chain is broken at %d, want %d", broken, c.broken)
+			}
+		})
+	}
+}
+
+func TestVerifyChainSurvivesTimeZone(t *testing.T) {
+	entries, last := chain(testKey, 0, testEntries()...)
+	// Mongo driver decodes times in local zone
+	for i := range entries {
+		entries[i].CreatedAt = entries[i].CreatedAt.In(time.FixedZone("local", 3*3600))
+	}
+	if broken := verifyChain(testKey, entries, last); broken != 0 {
+		t.Errorf("chain is broken at %d after decoding", broken)
+	}
+}
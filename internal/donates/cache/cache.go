@@ -0,0 +1,303 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"strings"
+	"tempproj/pkg/error/svcerror"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rs/xid"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	keyPrefix = "donates:cache:"
+	// Generation of all keys, bumped by Flush. It's out of keyPrefix, so
+	// Flush doesn't drop it with cached values.
+	flushKey = "donates:cache-flush"
+
+	defaultTTL   = 5 * time.Minute
+	lockTTL      = 5 * time.Second
+	lockWait     = 50 * time.Millisecond
+	lockAttempts = 10
+	// Shared load runs at most this long whatever callers' deadlines are
+	loadTimeout = lockTTL
+	// Keys scanned at once by Flush
+	flushBatch = 1000
+)
+
+// Cache keeps read-heavy donation queries (counters, totals, donator lists) in redis.
+// On a miss the value is loaded once per key: concurrent callers of this process share
+// one load, callers of other processes wait for the redis lock holder to fill the key.
+// Writers invalidate keys, a load that raced with invalidation doesn't save its value.
+type Cache interface {
+	GetInt(ctx context.Context, key string, load func(ctx context.Context) (int64, error)) (int64, error)
+	GetList(ctx context.Context, key string, load func(ctx context.Context) ([]string, error)) ([]string, error)
+	Invalidate(ctx context.Context, keys ...string) error
+	// Drop every cached value, e.g. after stats are rebuilt and any counter
+	// may have changed
+	Flush(ctx context.Context) error
+}
+
+type redisCache struct {
+	log   *logrus.Entry
+	redis *redis.Client
+	ttl   time.Duration
+	group singleflight.Group
+}
+
+// Every invalidation bumps generation of the key, and Flush bumps generation
+// of all keys. Fill saves loaded value only if both generations are the same as
+// before the load, so value read from the storage before a write can't outlive
+// the write.
+var invalidate = redis.NewScript(`
+for i, key in ipairs(KEYS) do
+	redis.call("DEL", key)
+	redis.call("INCR", key .. ":gen")
+	redis.call("PEXPIRE", key .. ":gen", ARGV[1])
+end
+return 0
+`)
+
+var setIfGeneration = redis.NewScript(`
+if (redis.call("GET", KEYS[2]) or "") ~= ARGV[1] then
+	return 0
+end
+if (redis.call("GET", KEYS[3]) or "") ~= ARGV[2] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[3], "PX", ARGV[4])
+return 1
+`)
+
+// Release the lock only if it's still ours, it may have expired and been
+// taken by another process while we were loading
+var unlock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func NumberKey(user string) string          { return keyPrefix + "number:" + user }
+func SumKey(user string) string             { return keyPrefix + "sum:" + user }
+func UserDonatorsKey(user string) string    { return keyPrefix + "donators:user:" + user }
+func PostDonatorsKey(post string) string    { return keyPrefix + "donators:post:" + post }
+func ReceivedDonatesKey(user string) string { return keyPrefix + "received:" + user }
+
+func (c *redisCache) GetInt(ctx context.Context, key string, load func(ctx context.Context) (int64, error)) (int64, error) {
+	raw, err := c.get(ctx, key, func(ctx context.Context) (string, error) {
+		value, err := load(ctx)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(value, 10), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		c.log.WithField("key", key).WithError(err).Warn("broken cached value")
+		c.Invalidate(ctx, key)
+		return load(ctx)
+	}
+	return value, nil
+}
+
+func (c *redisCache) GetList(ctx context.Context, key string, load func(ctx context.Context) ([]string, error)) ([]string, error) {
+	raw, err := c.get(ctx, key, func(ctx context.Context) (string, error) {
+		value, err := load(ctx)
+		if err != nil {
+			return "", err
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0)
+	err = json.Unmarshal([]byte(raw), &result)
+	if err != nil {
+		c.log.WithField("key", key).WithError(err).Warn("broken cached value")
+		c.Invalidate(ctx, key)
+		return load(ctx)
+	}
+	return result, nil
+}
+
+func (c *redisCache) Invalidate(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	// Generation must outlive loads started before the invalidation
+	err := invalidate.Run(c.redis.WithContext(ctx), keys, (c.ttl * 2).Milliseconds()).Err()
+	if err != nil {
+		return svcerror.ErrInternal("can't invalidate cached values: %s", err)
+	}
+	return nil
+}
+
+func (c *redisCache) Flush(ctx context.Context) error {
+	client := c.redis.WithContext(ctx)
+	// Loads in progress don't save their values after this
+	err := client.Incr(flushKey).Err()
+	if err != nil {
+		return svcerror.ErrInternal("can't flush cached values: %s", err)
+	}
+	var cursor uint64
+	for {
+		found, next, err := client.Scan(cursor, keyPrefix+"*", flushBatch).Result()
+		if err != nil {
+			return svcerror.ErrInternal("can't scan cached values: %s", err)
+		}
+		keys := make([]string, 0, len(found))
+		for _, key := range found {
+			if !strings.HasSuffix(key, ":gen") && !strings.HasSuffix(key, ":lock") {
+				keys = append(keys, key)
+			}
+		}
+		err = c.Invalidate(ctx, keys...)
+		if err != nil {
+			return err
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// get returns cached value or fills the key with load(). Redis errors never fail the
+// request, the value is loaded from the storage instead.
+func (c *redisCache) get(ctx context.Context, key string, load func(ctx context.Context) (string, error)) (string, error) {
+	value, err := c.redis.WithContext(ctx).Get(key).Result()
+	switch {
+	case err == nil:
+		return value, nil
+	case err != redis.Nil:
+		c.log.WithField("key", key).WithError(err).Warn("can't read cached value")
+		return load(ctx)
+	}
+	// The load is shared, so it must not be canceled with the caller that
+	// happened to start it. Every caller still gives up on its own context.
+	loaded := c.group.DoChan(key, func() (interface{}, error) {
+		loadCtx, cancel := context.WithTimeout(detached{ctx}, loadTimeout)
+		defer cancel()
+		return c.fill(loadCtx, key, load)
+	})
+	select {
+	case result := <-loaded:
+		if result.Err != nil {
+			return "", result.Err
+		}
+		return result.Val.(string), nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (c *redisCache) fill(ctx context.Context, key string, load func(ctx context.Context) (string, error)) (string, error) {
+	client := c.redis.WithContext(ctx)
+	lockKey := key + ":lock"
+	token := xid.New().String()
+	for i := 0; i < lockAttempts; i++ {
+		locked, err := client.SetNX(lockKey, token, lockTTL).Result()
+		if err != nil {
+			c.log.WithField("key", key).WithError(err).Warn("can't lock cached value")
+			break
+		}
+		if locked {
+			defer unlock.Run(client, []string{lockKey}, token)
+			break
+		}
+		// Somebody else is loading the value, wait for it
+		time.Sleep(lockWait)
+		value, err := client.Get(key).Result()
+		if err == nil {
+			return value, nil
+		}
+	}
+	generations, err := client.MGet(key+":gen", flushKey).Result()
+	if err != nil {
+		c.log.WithField("key", key).WithError(err).Warn("can't read generation of cached value")
+		return load(ctx)
+	}
+	value, err := load(ctx)
+	if err != nil {
+		return "", err
+	}
+	keys := []string{key, key + ":gen", flushKey}
+	err = setIfGeneration.Run(client, keys, generation(generations[0]), generation(generations[1]), value, c.jitteredTTL().Milliseconds()).Err()
+	if err != nil {
+		c.log.WithField("key", key).WithError(err).Warn("can't save cached value")
+	}
+	return value, nil
+}
+
+// Generation read by MGET, missing one is empty
+func generation(value interface{}) string {
+	s, _ := value.(string)
+	return s
+}
+
+// detached keeps values of the context but not its deadline and cancellation
+type detached struct{ context.Context }
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// Spread expiration of keys filled at the same time
+func (c *redisCache) jitteredTTL() time.Duration {
+	return c.ttl + time.Duration(rand.Int63n(int64(c.ttl/10)+1))
+}
+
+func New(log *logrus.Entry, client *redis.Client, ttl time.Duration) (Cache, error) {
+	switch {
+	case log == nil:
+		return nil, svcerror.ErrInternal("logger is empty")
+	case client == nil:
+		return nil, svcerror.ErrInternal("redis is empty")
+	}
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	return &redisCache{
+		log:   log,
+		redis: client,
+		ttl:   ttl,
+	}, nil
+}
+
+// Cache that loads every value, for services running without redis
+func Nop() Cache {
+	return nopCache{}
+}
+
+type nopCache struct{}
+
+func (nopCache) GetInt(ctx context.Context, key string, load func(ctx context.Context) (int64, error)) (int64, error) {
+	return load(ctx)
+}
+
+func (nopCache) GetList(ctx context.Context, key string, load func(ctx context.Context) ([]string, error)) ([]string, error) {
+	return load(ctx)
+}
+
+func (nopCache) Invalidate(ctx context.Context, keys ...string) error {
+	return nil
+}
+
+func (nopCache) Flush(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,232 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestCache(t *testing.T) (*redisCache, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	c, err := New(logrus.NewEntry(logger), client, time.Minute)
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	return c.(*redisCache), server
+}
+
+// Load returning value and counting calls
+type counter struct {
+	calls int32
+	value int64
+}
+
+func (l *counter) load(ctx context.Context) (int64, error) {
+	atomic.AddInt32(&l.calls, 1)
+	return l.value, nil
+}
+
+func (l *counter) count() int32 {
+	return atomic.LoadInt32(&l.calls)
+}
+
+func getInt(t *testing.T, c Cache, key string, load func(ctx context.Context) (int64, error)) int64 {
+	t.Helper()
+	value, err := c.GetInt(context.Background(), key, load)
+	if err != nil {
+		t.Fatalf("GetInt: %s", err)
+	}
+	return value
+}
+
+func TestGetIntLoadsOnce(t *testing.T) {
+	c, _ := newTestCache(t)
+	l := &counter{value: 42}
+	for i := 0; i < 3; i++ {
+		if value := getInt(t, c, NumberKey("user"), l.load); value != 42 {
+			t.Fatalf("got %d, want 42", value)
+		}
+	}
+	if l.count() != 1 {
+		t.Errorf("value is loaded %d times, want once", l.count())
+	}
+}
+
+func TestGetList(t *testing.T) {
+	c, _ := newTestCache(t)
+	calls := 0
+	load := func(ctx context.Context) ([]string, error) {
+		calls++
+		return []string{"a", "b"}, nil
+	}
+	for i := 0; i < 2; i++ {
+		list, err := c.GetList(context.Background(), UserDonatorsKey("user"), load)
+		if err != nil {
+			t.Fatalf("GetList: %s", err)
+		}
+		if len(list) != 2 || list[0] != "a" || list[1] != "b" {
+			t.Fatalf("got %v", list)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("list is loaded %d times, want once", calls)
+	}
+}
+
+func TestLoadErrorIsNotCached(t *testing.T) {
+	c, server := newTestCache(t)
+	failure := errors.New("storage is down")
+	_, err := c.GetInt(context.Background(), SumKey("user"), func(ctx context.Context) (int64, error) {
+		return 0, failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("got %v, want load error", err)
+	}
+	if server.Exists(SumKey("user")) {
+		t.Error("failed load is cached")
+	}
+}
+
+func TestInvalidateReloads(t *testing.T) {
+	c, _ := newTestCache(t)
+	l := &counter{value: 1}
+	getInt(t, c, NumberKey("user"), l.load)
+	l.value = 2
+	err := c.Invalidate(context.Background(), NumberKey("user"))
+	if err != nil {
+		t.Fatalf("Invalidate: %s", err)
+	}
+	if value := getInt(t, c, NumberKey("user"), l.load); value != 2 {
+		t.Errorf("got %d after invalidation, want 2", value)
+	}
+}
+
+func TestLoadRacingInvalidationIsNotSaved(t *testing.T) {
+	c, server := newTestCache(t)
+	// Write lands while the value is being loaded
+	value := getInt(t, c, NumberKey("user"), func(ctx context.Context) (int64, error) {
+		err := c.Invalidate(ctx, NumberKey("user"))
+		if err != nil {
+			t.Fatalf("Invalidate: %s", err)
+		}
+		return 1, nil
+	})
+	if value != 1 {
+		t.Fatalf("got %d, want loaded value", value)
+	}
+	if server.Exists(NumberKey("user")) {
+		t.Error("value loaded before invalidation is saved")
+	}
+	l := &counter{value: 2}
+	if value := getInt(t, c, NumberKey("user"), l.load); value != 2 || l.count() != 1 {
+		t.Errorf("got %d with %d loads, want fresh value", value, l.count())
+	}
+}
+
+func TestFlushDropsAllValues(t *testing.T) {
+	c, server := newTestCache(t)
+	ctx := context.Background()
+	keys := []string{NumberKey("a"), SumKey("a"), NumberKey("b")}
+	for _, key := range keys {
+		getInt(t, c, key, (&counter{value: 1}).load)
+	}
+	err := c.Flush(ctx)
+	if err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	for _, key := range keys {
+		if server.Exists(key) {
+			t.Errorf("%s is kept after flush", key)
+		}
+	}
+	if !server.Exists(flushKey) {
+		t.Error("flush generation is dropped with cached values")
+	}
+}
+
+func TestLoadRacingFlushIsNotSaved(t *testing.T) {
+	c, server := newTestCache(t)
+	// Key was never invalidated, only flush generation guards it
+	getInt(t, c, NumberKey("user"), func(ctx context.Context) (int64, error) {
+		err := c.Flush(ctx)
+		if err != nil {
+			t.Fatalf("Flush: %s", err)
+		}
+		return 1, nil
+	})
+	if server.Exists(NumberKey("user")) {
+		t.Error("value loaded before flush is saved")
+	}
+}
+
+func TestConcurrentMissesShareLoad(t *testing.T) {
+	c, _ := newTestCache(t)
+	release := make(chan struct{})
+	var calls int32
+	load := func(ctx context.Context) (int64, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 7, nil
+	}
+	const callers = 10
+	var wg sync.WaitGroup
+	values := make([]int64, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			values[i], _ = c.GetInt(context.Background(), NumberKey("user"), load)
+		}(i)
+	}
+	// Let callers join the load before it finishes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("value is loaded %d times, want once", calls)
+	}
+	for i, value := range values {
+		if value != 7 {
+			t.Errorf("caller %d got %d, want 7", i, value)
+		}
+	}
+}
+
+func TestWaitsForLockHolder(t *testing.T) {
+	c, server := newTestCache(t)
+	// Another process holds the lock and fills the value
+	server.Set(NumberKey("user")+":lock", "other")
+	go func() {
+		time.Sleep(lockWait / 2)
+		server.Set(NumberKey("user"), "5")
+	}()
+	l := &counter{value: 1}
+	if value := getInt(t, c, NumberKey("user"), l.load); value != 5 {
+		t.Errorf("got %d, want value of lock holder", value)
+	}
+	if l.count() != 0 {
+		t.Errorf("value is loaded %d times while another process loads it", l.count())
+	}
+}
+
+func TestRedisFailureFallsBackToLoad(t *testing.T) {
+	c, server := newTestCache(t)
+	server.Close()
+	l := &counter{value: 3}
+	if value := getInt(t, c, NumberKey("user"), l.load); value != 3 {
+		t.Errorf("got %d, want loaded value", value)
+	}
+}
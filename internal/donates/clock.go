@@ -0,0 +1,32 @@
+package donates
+
+import (
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// Clock is a source of current time
+type Clock interface {
+	Now() time.Time
+}
+
+// IDGenerator makes unique IDs of donates and related records
+type IDGenerator interface {
+	NewID() string
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+type xidGenerator struct{}
+
+func (xidGenerator) NewID() string { return xid.New().String() }
+
+var (
+	// SystemClock returns wall clock time
+	SystemClock Clock = systemClock{}
+	// XIDs generates globally unique sortable xid IDs
+	XIDs IDGenerator = xidGenerator{}
+)
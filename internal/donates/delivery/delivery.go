@@ -3,7 +3,9 @@ package delivery
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"tempproj/internal/donates"
+	"tempproj/internal/donates/audit"
 	"tempproj/internal/followers"
 	"tempproj/internal/types"
 	"tempproj/internal/users"
@@ -20,6 +22,20 @@ type Delivery interface {
 	GetPostDonators(ctx context.Context, rawMessage []byte) (interface{}, error)
 	GetDonatedUsers(ctx context.Context, rawMessage []byte) (interface{}, error)
 	GetAmountOfDonations(ctx context.Context, rawMessage []byte) (interface{}, error)
+	GetDonatesNumber(ctx context.Context, rawMessage []byte) (interface{}, error)
+	GetPostTotals(ctx context.Context, rawMessage []byte) (interface{}, error)
+	GetPostsTotals(ctx context.Context, rawMessage []byte) (interface{}, error)
+	GetDonatesByIDs(ctx context.Context, rawMessage []byte) (interface{}, error)
+	LookupDonates(ctx context.Context, rawMessage []byte) (interface{}, error)
+	GetDonationPrivacy(ctx context.Context, rawMessage []byte) (interface{}, error)
+	SetDonationPrivacy(ctx context.Context, rawMessage []byte) (interface{}, error)
+	GetDonate(ctx context.Context, rawMessage []byte) (interface{}, error)
+	ListMyDonates(ctx context.Context, rawMessage []byte) (interface{}, error)
+	RequestPaymentURL(ctx context.Context, rawMessage []byte) (interface{}, error)
+	GetReceipt(ctx context.Context, rawMessage []byte) (interface{}, error)
+	StartExport(ctx context.Context, rawMessage []byte) (interface{}, error)
+	GetExportJob(ctx context.Context, rawMessage []byte) (interface{}, error)
+	DownloadExport(ctx context.Context, rawMessage []byte) (interface{}, error)
 }
 
 type websocket struct {
@@ -44,15 +60,20 @@ func parseMakeDonate(data []byte) (reqMakeDonate, error) {
 func (w *websocket) MakeDonate(ctx context.Context, rawMessage []byte) (interface{}, error) {
 	req, err := parseMakeDonate(rawMessage)
 	if err != nil {
-		w.log.Errorf("failed while parsing MakeDonate request: %s, error: %s", rawMessage, err)
+		logMalformed(w.log, "MakeDonate", rawMessage, err)
 		return nil, svcerror.ErrMalformed("can't parse data of client request")
 	}
-	newDonate := donates.NewDonate(sessioncontext.GetUserID(ctx), req.User, req.Post, req.Amount)
+	from := sessioncontext.GetUserID(ctx)
+	if from == "" {
+		return nil, donates.ErrUnauthenticated
+	}
+	ctx = audit.WithActor(ctx, from, audit.Websocket)
+	newDonate := &donates.Donate{From: from, To: req.User, Post: req.Post, Amount: req.Amount}
 	err = w.donates.MakeDonate(ctx, newDonate)
 	if err != nil {
 		return nil, err
 	}
-	return map[string]interface{}{"id": newDonate.ID}, nil
+	return map[string]interface{}{"id": newDonate.ID, "status": newDonate.Status}, nil
 }
 
 type reqGetDonators struct {
@@ -69,9 +90,13 @@ func parseGetDonators(data []byte) (reqGetDonators, error) {
 func (w *websocket) GetUserDonators(ctx context.Context, rawMessage []byte) (interface{}, error) {
 	req, err := parseGetDonators(rawMessage)
 	if err != nil {
-		w.log.Errorf("failed while parsing request: %s, err: %s", rawMessage, err)
+		logMalformed(w.log, "GetUserDonators", rawMessage, err)
 		return nil, svcerror.ErrMalformed("can't parse client request")
 	}
+	err = w.checkPrivacy(ctx, req.User, donatorsVisibility)
+	if err != nil {
+		return nil, err
+	}
 	donators, err := w.donates.GetUserDonators(ctx, req.User)
 	if err != nil {
 		return nil, err
@@ -82,9 +107,19 @@ func (w *websocket) GetUserDonators(ctx context.Context, rawMessage []byte) (int
 func (w *websocket) GetPostDonators(ctx context.Context, rawMessage []byte) (interface{}, error) {
 	req, err := parseGetDonators(rawMessage)
 	if err != nil {
-		w.log.Errorf("failed while parsing request: %s, err: %s", rawMessage, err)
+		logMalformed(w.log, "GetPostDonators", rawMessage, err)
 		return nil, svcerror.ErrMalformed("can't parse client request")
 	}
+	author, err := w.donates.GetPostAuthor(ctx, req.Post)
+	if err != nil {
+		return nil, err
+	}
+	if author != "" {
+		err = w.checkPrivacy(ctx, author, donatorsVisibility)
+		if err != nil {
+			return nil, err
+		}
+	}
 	donators, err := w.donates.GetPostDonators(ctx, req.Post)
 	if err != nil {
 		return nil, err
@@ -96,12 +131,16 @@ func (w *websocket) GetDonatedUsers(ctx context.Context, rawMessage []byte) (int
 	user := sessioncontext.GetUserID(ctx)
 	req, err := parseGetDonators(rawMessage)
 	if err != nil {
-		w.log.Errorf("failed while parsing request: %s, err: %s", rawMessage, err)
+		logMalformed(w.log, "GetDonatedUsers", rawMessage, err)
 		return nil, svcerror.ErrMalformed("can't parse client request")
 	}
 	if req.User != "" {
 		user = req.User
 	}
+	err = w.checkPrivacy(ctx, user, donatorsVisibility)
+	if err != nil {
+		return nil, err
+	}
 	donators, err := w.donates.GetUsersReceivedDonations(ctx, user)
 	if err != nil {
 		return nil, err
@@ -146,6 +185,23 @@ func (w *websocket) getUserProfiles(ctx context.Context, userIDs []string, userI
 
 func (w *websocket) GetAmountOfDonations(ctx context.Context, rawMessage []byte) (interface{}, error) {
 	user := sessioncontext.GetUserID(ctx)
+	if len(rawMessage) != 0 {
+		req, err := parseGetDonators(rawMessage)
+		if err != nil {
+			logMalformed(w.log, "GetAmountOfDonations", rawMessage, err)
+			return nil, svcerror.ErrMalformed("can't parse client request")
+		}
+		if req.User != "" {
+			user = req.User
+		}
+	}
+	if user == "" {
+		return nil, svcerror.ErrInvalidParams("user is empty")
+	}
+	err := w.checkPrivacy(ctx, user, totalsVisibility)
+	if err != nil {
+		return nil, err
+	}
 	amount, err := w.donates.GetAmountOfDonations(ctx, user)
 	if err != nil {
 		return nil, err
@@ -153,6 +209,260 @@ func (w *websocket) GetAmountOfDonations(ctx context.Context, rawMessage []byte)
 	return map[string]interface{}{"amount": amount}, nil
 }
 
+func (w *websocket) GetDonatesNumber(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	user := sessioncontext.GetUserID(ctx)
+	req, err := parseGetDonators(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "GetDonatesNumber", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	if req.User != "" {
+		user = req.User
+	}
+	if user == "" {
+		return nil, svcerror.ErrInvalidParams("user is empty")
+	}
+	err = w.checkPrivacy(ctx, user, totalsVisibility)
+	if err != nil {
+		return nil, err
+	}
+	number, err := w.donates.GetDonatesNumber(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"number": number}, nil
+}
+
+type reqGetDonatesByIDs struct {
+	IDs []string `json:"ids"`
+}
+
+func parseGetDonatesByIDs(data []byte) (reqGetDonatesByIDs, error) {
+	var result reqGetDonatesByIDs
+	err := json.Unmarshal(data, &result)
+	return result, err
+}
+
+// Resolve donate IDs from feed events, available only for authorized users
+func (w *websocket) GetDonatesByIDs(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	user := sessioncontext.GetUserID(ctx)
+	if user == "" {
+		return nil, donates.ErrUnauthenticated
+	}
+	req, err := parseGetDonatesByIDs(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "GetDonatesByIDs", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	switch {
+	case len(req.IDs) == 0:
+		return map[string]interface{}{"donates": []shortResponse{}}, nil
+	case len(req.IDs) > donates.MaxLookupIDs:
+		return nil, svcerror.ErrInvalidParams("too many ids, max %d", donates.MaxLookupIDs)
+	}
+	// Lookup shows confirmed donates only, privacy of recipients is applied
+	// the same way as for LookupDonates
+	results, err := w.donates.LookupDonates(ctx, user, req.IDs, donates.ProjectShort)
+	if err != nil {
+		return nil, err
+	}
+	err = w.hideInvisible(ctx, results, donatorsVisibility)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]shortResponse, 0, len(results))
+	for _, result := range results {
+		if result.Donate != nil {
+			response = append(response, shortResponse{ID: result.Donate.ID, Amount: result.Donate.Amount})
+		}
+	}
+	return map[string]interface{}{"donates": response}, nil
+}
+
+// shortResponse is client format of donates.Short, the struct itself is
+// also sent to events service and keeps its own format
+type shortResponse struct {
+	ID     string `json:"id"`
+	Amount uint64 `json:"amount"`
+}
+
+func totalsVisibility(p *donates.Privacy) donates.Visibility   { return p.Totals }
+func donatorsVisibility(p *donates.Privacy) donates.Visibility { return p.Donators }
+
+// Return error if session user isn't allowed to see target's donation data
+func (w *websocket) checkPrivacy(ctx context.Context, target string, visibility func(*donates.Privacy) donates.Visibility) error {
+	viewer := sessioncontext.GetUserID(ctx)
+	if viewer == target {
+		return nil
+	}
+	privacy, err := w.donates.GetPrivacy(ctx, target)
+	if err != nil {
+		return err
+	}
+	switch visibility(privacy) {
+	case donates.Public:
+		return nil
+	case donates.FollowersOnly:
+		if viewer == "" {
+			break
+		}
+		following, err := w.followers.CheckList(ctx, viewer, []string{target})
+		if err != nil {
+			return svcerror.ErrInternal("can't check followers: %s", err)
+		}
+		if utils.NewUniqMap(following).HasValue(target) {
+			return nil
+		}
+	}
+	return donates.ErrDonationsHidden
+}
+
+// Report whether session user may see recipient's data, only unexpected
+// failures are returned as errors
+func (w *websocket) recipientVisible(ctx context.Context, recipient string, visibility func(*donates.Privacy) donates.Visibility) (bool, error) {
+	err := w.checkPrivacy(ctx, recipient, visibility)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, donates.ErrDonationsHidden):
+		return false, nil
+	}
+	return false, err
+}
+
+func (w *websocket) GetDonationPrivacy(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	user := sessioncontext.GetUserID(ctx)
+	if user == "" {
+		return nil, donates.ErrUnauthenticated
+	}
+	privacy, err := w.donates.GetPrivacy(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"privacy": privacy}, nil
+}
+
+func parseSetPrivacy(data []byte) (donates.PrivacyUpdate, error) {
+	var result donates.PrivacyUpdate
+	err := json.Unmarshal(data, &result)
+	return result, err
+}
+
+func (w *websocket) SetDonationPrivacy(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	user := sessioncontext.GetUserID(ctx)
+	if user == "" {
+		return nil, donates.ErrUnauthenticated
+	}
+	req, err := parseSetPrivacy(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "SetDonationPrivacy", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	privacy, err := w.donates.SetPrivacy(ctx, user, req)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"privacy": privacy}, nil
+}
+
+type reqGetDonate struct {
+	ID string `json:"id"`
+}
+
+func parseGetDonate(data []byte) (reqGetDonate, error) {
+	var result reqGetDonate
+	err := json.Unmarshal(data, &result)
+	return result, err
+}
+
+// Return donate to its donor or recipient
+func (w *websocket) GetDonate(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	user := sessioncontext.GetUserID(ctx)
+	if user == "" {
+		return nil, donates.ErrUnauthenticated
+	}
+	req, err := parseGetDonate(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "GetDonate", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	donate, err := w.donates.GetDonate(ctx, user, req.ID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"donate": donateResponse(donate, user)}, nil
+}
+
+type reqListMyDonates struct {
+	Filter donates.ListFilter `json:"filter"`
+	Limit  int                `json:"limit"`
+	Offset int                `json:"offset"`
+}
+
+func parseListMyDonates(data []byte) (reqListMyDonates, error) {
+	var result reqListMyDonates
+	err := json.Unmarshal(data, &result)
+	return result, err
+}
+
+func (w *websocket) ListMyDonates(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	user := sessioncontext.GetUserID(ctx)
+	if user == "" {
+		return nil, donates.ErrUnauthenticated
+	}
+	req, err := parseListMyDonates(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "ListMyDonates", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	list, err := w.donates.ListMyDonates(ctx, user, req.Filter, types.PageOpt{Limit: req.Limit, Offset: req.Offset})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]map[string]interface{}, 0, len(list))
+	for i := range list {
+		result = append(result, donateResponse(&list[i], user))
+	}
+	return map[string]interface{}{"donates": result}, nil
+}
+
+// Request payment of pending donate again, returns URL received earlier. New
+// URL is sent with payment_update notification.
+func (w *websocket) RequestPaymentURL(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	user := sessioncontext.GetUserID(ctx)
+	if user == "" {
+		return nil, donates.ErrUnauthenticated
+	}
+	req, err := parseGetDonate(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "RequestPaymentURL", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	url, err := w.donates.RequestPaymentURL(ctx, user, req.ID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"id": req.ID, "url": url}, nil
+}
+
+// Status history and payment details are shown to the donor only
+func donateResponse(d *donates.Donate, user string) map[string]interface{} {
+	result := map[string]interface{}{
+		"id":      d.ID,
+		"from":    d.From,
+		"to":      d.To,
+		"post":    d.Post,
+		"amount":  d.Amount,
+		"status":  d.Status,
+		"created": d.CreatedAt,
+		"updated": d.UpdatedAt,
+	}
+	if d.From == user {
+		result["history"] = d.History
+	}
+	return result
+}
+
 func New(log *logrus.Entry, donates donates.UseCase, users users.UseCase, followers followers.UseCase) (Delivery, error) {
 	switch {
 	case log == nil:
@@ -161,6 +471,8 @@ func New(log *logrus.Entry, donates donates.UseCase, users users.UseCase, follow
 		return nil, svcerror.ErrInternal("donate service is empty")
 	case users == nil:
 		return nil, svcerror.ErrInternal("users service is empty")
+	case followers == nil:
+		return nil, svcerror.ErrInternal("followers service is empty")
 	}
 	return &websocket{
 		log:       log,
@@ -0,0 +1,93 @@
+package delivery
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"tempproj/internal/donates"
+	"tempproj/pkg/error/svcerror"
+	"tempproj/pkg/sessioncontext"
+)
+
+// Exports bigger than that have to be downloaded in parts
+const maxExportChunk = 4 << 20
+
+func (w *websocket) StartExport(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	user := sessioncontext.GetUserID(ctx)
+	if user == "" {
+		return nil, donates.ErrUnauthenticated
+	}
+	var req donates.ExportRequest
+	err := json.Unmarshal(rawMessage, &req)
+	if err != nil {
+		logMalformed(w.log, "StartExport", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	job, err := w.donates.StartExport(ctx, user, req)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"export": job}, nil
+}
+
+type reqExport struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+}
+
+func parseExport(data []byte) (reqExport, error) {
+	var result reqExport
+	err := json.Unmarshal(data, &result)
+	return result, err
+}
+
+func (w *websocket) GetExportJob(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	user := sessioncontext.GetUserID(ctx)
+	if user == "" {
+		return nil, donates.ErrUnauthenticated
+	}
+	req, err := parseExport(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "GetExportJob", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	job, err := w.donates.GetExportJob(ctx, user, req.ID)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"export": job}, nil
+}
+
+// Return part of export file starting from offset, "next" is offset of the
+// next part or -1 after the last one
+func (w *websocket) DownloadExport(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	user := sessioncontext.GetUserID(ctx)
+	if user == "" {
+		return nil, donates.ErrUnauthenticated
+	}
+	req, err := parseExport(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "DownloadExport", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	file, err := w.donates.DownloadExport(ctx, user, req.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	_, err = io.CopyN(ioutil.Discard, file, req.Offset)
+	if err != nil && err != io.EOF {
+		return nil, svcerror.ErrInternal("can't read export: %s", err)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxExportChunk+1))
+	if err != nil {
+		return nil, svcerror.ErrInternal("can't read export: %s", err)
+	}
+	next := int64(-1)
+	if len(data) > maxExportChunk {
+		data = data[:maxExportChunk]
+		next = req.Offset + maxExportChunk
+	}
+	return map[string]interface{}{"id": req.ID, "data": string(data), "next": next}, nil
+}
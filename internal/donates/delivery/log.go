@@ -0,0 +1,34 @@
+package delivery
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Logged keys of malformed request, the rest is only counted
+const maxLoggedKeys = 10
+
+// Log request the method can't parse. Values of the request aren't logged as
+// they can carry personal data and payment tokens, only its size and keys are.
+func logMalformed(log *logrus.Entry, method string, rawMessage []byte, err error) {
+	fields := logrus.Fields{
+		"method":       method,
+		"request_size": len(rawMessage),
+	}
+	object := map[string]json.RawMessage{}
+	if json.Unmarshal(rawMessage, &object) == nil {
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) > maxLoggedKeys {
+			keys = keys[:maxLoggedKeys]
+		}
+		fields["request_keys"] = keys
+		fields["request_key_count"] = len(object)
+	}
+	log.WithFields(fields).WithError(err).Warn("failed while parsing request")
+}
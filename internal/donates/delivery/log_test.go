@@ -0,0 +1,46 @@
+package delivery
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestLogMalformedHidesRequestValues(t *testing.T) {
+	cases := []struct {
+		name    string
+		request string
+		keys    []string
+	}{
+		{"object", `{"url":"https://pay/secret-token","amount":"x"}`, []string{"amount", "url"}},
+		{"not object", `secret-token`, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			logger, hook := test.NewNullLogger()
+			logMalformed(logrus.NewEntry(logger), "MakeDonate", []byte(c.request), errors.New("bad request"))
+			entry := hook.LastEntry()
+			if entry == nil {
+				t.Fatal("malformed request isn't logged")
+			}
+			line, err := entry.String()
+			if err != nil {
+				t.Fatalf("format entry: %s", err)
+			}
+			if strings.Contains(line, "secret-token") {
+				t.Errorf("request value is logged: %s", line)
+			}
+			if entry.Data["method"] != "MakeDonate" || entry.Data["request_size"] != len(c.request) {
+				t.Errorf("got fields %v, want method and request size", entry.Data)
+			}
+			keys, _ := entry.Data["request_keys"].([]string)
+			if !reflect.DeepEqual(keys, c.keys) {
+				t.Errorf("got keys %v, want %v", keys, c.keys)
+			}
+		})
+	}
+}
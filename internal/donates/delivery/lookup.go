@@ -0,0 +1,103 @@
+package delivery
+
+import (
+	"context"
+	"encoding/json"
+	"tempproj/internal/donates"
+	"tempproj/pkg/error/svcerror"
+	"tempproj/pkg/sessioncontext"
+)
+
+type reqLookupDonates struct {
+	IDs        []string           `json:"ids"`
+	Projection donates.Projection `json:"projection"` // short if empty
+}
+
+func parseLookupDonates(data []byte) (reqLookupDonates, error) {
+	var result reqLookupDonates
+	err := json.Unmarshal(data, &result)
+	return result, err
+}
+
+// Return donates in order of requested ids, missing ones are marked as not
+// found. Donates of recipients hiding their donators from the user are
+// reported as not found too, unless the user is the donor.
+func (w *websocket) LookupDonates(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	user := sessioncontext.GetUserID(ctx)
+	if user == "" {
+		return nil, donates.ErrUnauthenticated
+	}
+	req, err := parseLookupDonates(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "LookupDonates", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	if req.Projection == "" {
+		req.Projection = donates.ProjectShort
+	}
+	results, err := w.donates.LookupDonates(ctx, user, req.IDs, req.Projection)
+	if err != nil {
+		return nil, err
+	}
+	if req.Projection != donates.ProjectFull {
+		err = w.hideInvisible(ctx, results, donatorsVisibility)
+		if err != nil {
+			return nil, err
+		}
+	}
+	response := make([]map[string]interface{}, 0, len(results))
+	for _, result := range results {
+		response = append(response, lookupResponse(result, req.Projection, user))
+	}
+	return map[string]interface{}{"donates": response}, nil
+}
+
+// Clear donates the session user isn't allowed to see by privacy of their
+// recipients, privacy of each recipient is checked once
+func (w *websocket) hideInvisible(ctx context.Context, results []donates.LookupResult, visibility func(*donates.Privacy) donates.Visibility) error {
+	viewer := sessioncontext.GetUserID(ctx)
+	recipients := map[string]bool{}
+	for i := range results {
+		donate := results[i].Donate
+		if donate == nil || donate.From == viewer {
+			continue
+		}
+		visible, checked := recipients[donate.To]
+		if !checked {
+			var err error
+			visible, err = w.recipientVisible(ctx, donate.To, visibility)
+			if err != nil {
+				return err
+			}
+			recipients[donate.To] = visible
+		}
+		if !visible {
+			results[i].Donate = nil
+		}
+	}
+	return nil
+}
+
+func lookupResponse(result donates.LookupResult, projection donates.Projection, user string) map[string]interface{} {
+	d := result.Donate
+	if d == nil {
+		return map[string]interface{}{"id": result.ID, "found": false}
+	}
+	if projection == donates.ProjectFull {
+		response := donateResponse(d, user)
+		response["found"] = true
+		return response
+	}
+	response := map[string]interface{}{
+		"id":     d.ID,
+		"found":  true,
+		"amount": d.Amount,
+	}
+	if projection == donates.ProjectPublic {
+		response["to"] = d.To
+		response["post"] = d.Post
+		response["status"] = d.Status
+		response["created"] = d.CreatedAt
+	}
+	return response
+}
@@ -0,0 +1,179 @@
+package delivery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"tempproj/internal/donates"
+	"tempproj/internal/donates/audit"
+	"tempproj/internal/types"
+	"tempproj/pkg/error/svcerror"
+	"tempproj/pkg/sessioncontext"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ModerationDelivery is admin API for donates held by risk checks
+type ModerationDelivery interface {
+	ListDonatesForReview(ctx context.Context, rawMessage []byte) (interface{}, error)
+	ApproveDonate(ctx context.Context, rawMessage []byte) (interface{}, error)
+	RejectDonate(ctx context.Context, rawMessage []byte) (interface{}, error)
+	GetDonateAuditLog(ctx context.Context, rawMessage []byte) (interface{}, error)
+	RebuildDonationStats(ctx context.Context, rawMessage []byte) (interface{}, error)
+}
+
+// Admins is a part of users.UseCase that knows who can moderate donates
+type Admins interface {
+	IsAdmin(ctx context.Context, user string) (bool, error)
+}
+
+type moderationWebsocket struct {
+	log        *logrus.Entry
+	moderation donates.Moderation
+	admins     Admins
+}
+
+// Return session user if it's admin
+func (w *moderationWebsocket) checkAdmin(ctx context.Context) (string, error) {
+	user := sessioncontext.GetUserID(ctx)
+	if user == "" {
+		return "", donates.ErrUnauthenticated
+	}
+	isAdmin, err := w.admins.IsAdmin(ctx, user)
+	if err != nil {
+		return "", svcerror.ErrInternal("can't check user's permissions: %s", err)
+	}
+	if !isAdmin {
+		return "", donates.ErrNotModerator
+	}
+	return user, nil
+}
+
+type reqListForReview struct {
+	Filter donates.ReviewFilter `json:"filter"`
+	Limit  int                  `json:"limit"`
+	Offset int                  `json:"offset"`
+}
+
+func parseListForReview(data []byte) (reqListForReview, error) {
+	var result reqListForReview
+	err := json.Unmarshal(data, &result)
+	return result, err
+}
+
+func (w *moderationWebsocket) ListDonatesForReview(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	_, err := w.checkAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := parseListForReview(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "ListDonatesForReview", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	result, err := w.moderation.ListForReview(ctx, req.Filter, types.PageOpt{Limit: req.Limit, Offset: req.Offset})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"donates": result}, nil
+}
+
+type reqModerateDonate struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+func parseModerateDonate(data []byte) (reqModerateDonate, error) {
+	var result reqModerateDonate
+	err := json.Unmarshal(data, &result)
+	return result, err
+}
+
+func (w *moderationWebsocket) ApproveDonate(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	moderator, err := w.checkAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := parseModerateDonate(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "ApproveDonate", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	donate, err := w.moderation.ApproveDonate(ctx, req.ID, moderator)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"id": donate.ID, "status": donate.Status}, nil
+}
+
+func (w *moderationWebsocket) RejectDonate(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	moderator, err := w.checkAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := parseModerateDonate(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "RejectDonate", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	donate, err := w.moderation.RejectDonate(ctx, req.ID, moderator, req.Reason)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"id": donate.ID, "status": donate.Status}, nil
+}
+
+// Return audit log of the donate and result of hash chain check
+func (w *moderationWebsocket) GetDonateAuditLog(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	_, err := w.checkAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := parseModerateDonate(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "GetDonateAuditLog", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	entries, err := w.moderation.GetAuditLog(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
+	valid := true
+	err = w.moderation.VerifyAuditLog(ctx, req.ID)
+	if err != nil {
+		if !errors.Is(err, audit.ErrTampered) {
+			return nil, err
+		}
+		valid = false
+	}
+	return map[string]interface{}{"entries": entries, "valid": valid}, nil
+}
+
+// Recompute donation stats, at most one rebuild runs at a time
+func (w *moderationWebsocket) RebuildDonationStats(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	user, err := w.checkAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = w.moderation.RebuildStats(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"rebuilt": true}, nil
+}
+
+func NewModeration(log *logrus.Entry, moderation donates.Moderation, admins Admins) (ModerationDelivery, error) {
+	switch {
+	case log == nil:
+		return nil, svcerror.ErrInternal("logger is empty")
+	case moderation == nil:
+		return nil, svcerror.ErrInternal("moderation service is empty")
+	case admins == nil:
+		return nil, svcerror.ErrInternal("admins service is empty")
+	}
+	return &moderationWebsocket{
+		log:        log,
+		moderation: moderation,
+		admins:     admins,
+	}, nil
+}
@@ -0,0 +1,316 @@
+package delivery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"tempproj/internal/donates"
+	"tempproj/pkg/error/svcerror"
+	"tempproj/pkg/sessioncontext"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	rateLimitPrefix = "donates:ratelimit:"
+	defaultMethod   = "*"
+)
+
+// KeyFunc returns the client key buckets are kept for (user ID, IP, ...)
+type KeyFunc func(ctx context.Context) string
+
+// Limit is a token bucket: up to Burst requests at once, refilled with Rate requests per second
+type Limit struct {
+	Rate  float64
+	Burst int64
+	Key   KeyFunc
+}
+
+// Limits by Delivery method name, "*" is used for methods without own limit
+type Limits map[string]Limit
+
+var DefaultLimits = Limits{
+	defaultMethod:       {Rate: 5, Burst: 20},
+	"MakeDonate":        {Rate: 0.2, Burst: 5},
+	"RequestPaymentURL": {Rate: 0.2, Burst: 3},
+	"StartExport":       {Rate: 0.01, Burst: 2},
+	"GetPostDonators":   {Rate: 1, Burst: 5},
+	"GetUserDonators":   {Rate: 1, Burst: 5},
+	"GetDonatedUsers":   {Rate: 1, Burst: 5},
+	"LookupDonates":     {Rate: 2, Burst: 10},
+	"GetPostsTotals":    {Rate: 2, Burst: 10},
+}
+
+type clientIPKey struct{}
+
+// Attach address of the client to the request context, transport sets it so
+// anonymous clients get buckets of their own
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// Return address of the client, empty string if transport didn't set it
+func ClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// Limit clients by session user, anonymous clients by IP. Anonymous clients
+// without known IP share one bucket.
+func ByUser(ctx context.Context) string {
+	if user := sessioncontext.GetUserID(ctx); user != "" {
+		return "user:" + user
+	}
+	if ip := ClientIP(ctx); ip != "" {
+		return "ip:" + ip
+	}
+	return "anonymous"
+}
+
+// Returns {allowed, retry after ms}
+var takeToken = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate / 1000)
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) * 1000 / rate)
+end
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return {allowed, retry}
+`)
+
+// RateLimitError rejects a request over the limit of its method, client may
+// retry after RetryAfter. It unwraps to svcerror with status 429 and the retry
+// delay in its message, and to donates.ErrRateLimited.
+type RateLimitError struct {
+	Method     string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("too many %s requests, retry after %d ms", e.Method, e.RetryAfter.Milliseconds())
+}
+
+func (e *RateLimitError) Unwrap() []error {
+	return []error{
+		&svcerror.Error{Code: http.StatusTooManyRequests, Msg: e.Error()},
+		donates.ErrRateLimited,
+	}
+}
+
+// Client format of the error, retry delay is sent in its own field
+func (e *RateLimitError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"code":           donates.ErrRateLimited.Code,
+		"message":        e.Error(),
+		"retry_after_ms": e.RetryAfter.Milliseconds(),
+	})
+}
+
+type rateLimited struct {
+	log    *logrus.Entry
+	redis  *redis.Client
+	limits Limits
+	next   Delivery
+	now    func() time.Time
+}
+
+// Take token from the client's bucket of the method. Redis errors don't block clients.
+func (r *rateLimited) allow(ctx context.Context, method string) error {
+	limit, ok := r.limits[method]
+	if !ok {
+		limit, ok = r.limits[defaultMethod]
+	}
+	if !ok || limit.Rate <= 0 {
+		return nil
+	}
+	keyFunc := limit.Key
+	if keyFunc == nil {
+		keyFunc = ByUser
+	}
+	key := rateLimitPrefix + method + ":" + keyFunc(ctx)
+	now := r.now().UnixNano() / int64(time.Millisecond)
+	result, err := takeToken.Run(r.redis, []string{key}, limit.Rate, limit.Burst, now).Result()
+	if err != nil {
+		r.log.Errorf("can't check rate limit of %s: %s", key, err)
+		return nil
+	}
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 2 {
+		r.log.Errorf("unexpected rate limit result for %s: %v", key, result)
+		return nil
+	}
+	if allowed, _ := values[0].(int64); allowed == 1 {
+		return nil
+	}
+	retry, _ := values[1].(int64)
+	return &RateLimitError{Method: method, RetryAfter: time.Duration(retry) * time.Millisecond}
+}
+
+func (r *rateLimited) MakeDonate(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "MakeDonate"); err != nil {
+		return nil, err
+	}
+	return r.next.MakeDonate(ctx, rawMessage)
+}
+
+func (r *rateLimited) GetUserDonators(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "GetUserDonators"); err != nil {
+		return nil, err
+	}
+	return r.next.GetUserDonators(ctx, rawMessage)
+}
+
+func (r *rateLimited) GetPostDonators(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "GetPostDonators"); err != nil {
+		return nil, err
+	}
+	return r.next.GetPostDonators(ctx, rawMessage)
+}
+
+func (r *rateLimited) GetDonatedUsers(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "GetDonatedUsers"); err != nil {
+		return nil, err
+	}
+	return r.next.GetDonatedUsers(ctx, rawMessage)
+}
+
+func (r *rateLimited) GetAmountOfDonations(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "GetAmountOfDonations"); err != nil {
+		return nil, err
+	}
+	return r.next.GetAmountOfDonations(ctx, rawMessage)
+}
+
+func (r *rateLimited) GetDonatesNumber(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "GetDonatesNumber"); err != nil {
+		return nil, err
+	}
+	return r.next.GetDonatesNumber(ctx, rawMessage)
+}
+
+func (r *rateLimited) GetPostTotals(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "GetPostTotals"); err != nil {
+		return nil, err
+	}
+	return r.next.GetPostTotals(ctx, rawMessage)
+}
+
+func (r *rateLimited) GetPostsTotals(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "GetPostsTotals"); err != nil {
+		return nil, err
+	}
+	return r.next.GetPostsTotals(ctx, rawMessage)
+}
+
+func (r *rateLimited) GetDonatesByIDs(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "GetDonatesByIDs"); err != nil {
+		return nil, err
+	}
+	return r.next.GetDonatesByIDs(ctx, rawMessage)
+}
+
+func (r *rateLimited) LookupDonates(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "LookupDonates"); err != nil {
+		return nil, err
+	}
+	return r.next.LookupDonates(ctx, rawMessage)
+}
+
+func (r *rateLimited) GetDonationPrivacy(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "GetDonationPrivacy"); err != nil {
+		return nil, err
+	}
+	return r.next.GetDonationPrivacy(ctx, rawMessage)
+}
+
+func (r *rateLimited) SetDonationPrivacy(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "SetDonationPrivacy"); err != nil {
+		return nil, err
+	}
+	return r.next.SetDonationPrivacy(ctx, rawMessage)
+}
+
+func (r *rateLimited) GetDonate(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "GetDonate"); err != nil {
+		return nil, err
+	}
+	return r.next.GetDonate(ctx, rawMessage)
+}
+
+func (r *rateLimited) ListMyDonates(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "ListMyDonates"); err != nil {
+		return nil, err
+	}
+	return r.next.ListMyDonates(ctx, rawMessage)
+}
+
+func (r *rateLimited) RequestPaymentURL(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "RequestPaymentURL"); err != nil {
+		return nil, err
+	}
+	return r.next.RequestPaymentURL(ctx, rawMessage)
+}
+
+func (r *rateLimited) GetReceipt(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "GetReceipt"); err != nil {
+		return nil, err
+	}
+	return r.next.GetReceipt(ctx, rawMessage)
+}
+
+func (r *rateLimited) StartExport(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "StartExport"); err != nil {
+		return nil, err
+	}
+	return r.next.StartExport(ctx, rawMessage)
+}
+
+func (r *rateLimited) GetExportJob(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "GetExportJob"); err != nil {
+		return nil, err
+	}
+	return r.next.GetExportJob(ctx, rawMessage)
+}
+
+func (r *rateLimited) DownloadExport(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	if err := r.allow(ctx, "DownloadExport"); err != nil {
+		return nil, err
+	}
+	return r.next.DownloadExport(ctx, rawMessage)
+}
+
+// Wrap delivery with per-method rate limiter
+func WithRateLimit(log *logrus.Entry, next Delivery, client *redis.Client, limits Limits) (Delivery, error) {
+	switch {
+	case log == nil:
+		return nil, svcerror.ErrInternal("logger is empty")
+	case next == nil:
+		return nil, svcerror.ErrInternal("delivery is empty")
+	case client == nil:
+		return nil, svcerror.ErrInternal("redis is empty")
+	}
+	if limits == nil {
+		limits = DefaultLimits
+	}
+	return &rateLimited{
+		log:    log,
+		redis:  client,
+		limits: limits,
+		next:   next,
+		now:    time.Now,
+	}, nil
+}
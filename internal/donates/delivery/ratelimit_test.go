@@ -0,0 +1,160 @@
+package delivery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"tempproj/internal/donates"
+	"tempproj/pkg/error/svcerror"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+	"github.com/sirupsen/logrus"
+)
+
+// Limiter with time the test moves by the returned pointer
+func newTestLimiter(t *testing.T, limits Limits) (*rateLimited, *miniredis.Miniredis, *time.Time) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &rateLimited{
+		log:    logrus.NewEntry(logger),
+		redis:  client,
+		limits: limits,
+		now:    func() time.Time { return now },
+	}
+	return r, server, &now
+}
+
+func byClient(ctx context.Context) string { return "client" }
+
+// Take tokens until the bucket is empty, returns number of allowed requests
+func drain(t *testing.T, r *rateLimited, ctx context.Context, method string) int {
+	t.Helper()
+	for allowed := 0; allowed < 1000; allowed++ {
+		err := r.allow(ctx, method)
+		if err != nil {
+			var limitErr *RateLimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("got %v, want RateLimitError", err)
+			}
+			return allowed
+		}
+	}
+	t.Fatalf("%s isn't limited", method)
+	return 0
+}
+
+func TestTokenBucket(t *testing.T) {
+	r, _, now := newTestLimiter(t, Limits{"MakeDonate": {Rate: 1, Burst: 3, Key: byClient}})
+	ctx := context.Background()
+	if allowed := drain(t, r, ctx, "MakeDonate"); allowed != 3 {
+		t.Fatalf("burst allowed %d requests, want 3", allowed)
+	}
+	err := r.allow(ctx, "MakeDonate")
+	var limitErr *RateLimitError
+	if !errors.As(err, &limitErr) || limitErr.RetryAfter != time.Second {
+		t.Fatalf("got %v, want retry after 1s", err)
+	}
+	*now = now.Add(500 * time.Millisecond)
+	err = r.allow(ctx, "MakeDonate")
+	if !errors.As(err, &limitErr) || limitErr.RetryAfter != 500*time.Millisecond {
+		t.Fatalf("got %v, want retry after 500ms", err)
+	}
+	*now = now.Add(500 * time.Millisecond)
+	if err := r.allow(ctx, "MakeDonate"); err != nil {
+		t.Fatalf("refilled token isn't taken: %s", err)
+	}
+	// Bucket doesn't grow over burst however long client waits
+	*now = now.Add(time.Hour)
+	if allowed := drain(t, r, ctx, "MakeDonate"); allowed != 3 {
+		t.Errorf("refilled bucket allowed %d requests, want 3", allowed)
+	}
+}
+
+func TestLimitsPerMethod(t *testing.T) {
+	r, _, _ := newTestLimiter(t, Limits{
+		defaultMethod:     {Rate: 1, Burst: 4, Key: byClient},
+		"MakeDonate":      {Rate: 1, Burst: 2, Key: byClient},
+		"GetDonatesByIDs": {Rate: 0},
+	})
+	ctx := context.Background()
+	if allowed := drain(t, r, ctx, "MakeDonate"); allowed != 2 {
+		t.Errorf("MakeDonate allowed %d requests, want its own burst 2", allowed)
+	}
+	// Methods without own limit use the default one, but every method has its
+	// own bucket
+	if allowed := drain(t, r, ctx, "GetStats"); allowed != 4 {
+		t.Errorf("GetStats allowed %d requests, want default burst 4", allowed)
+	}
+	if allowed := drain(t, r, ctx, "GetPrivacy"); allowed != 4 {
+		t.Errorf("GetPrivacy allowed %d requests, want default burst 4", allowed)
+	}
+	for i := 0; i < 10; i++ {
+		if err := r.allow(ctx, "GetDonatesByIDs"); err != nil {
+			t.Fatalf("method with zero rate is limited: %s", err)
+		}
+	}
+}
+
+func TestByUserFallsBackToClientIP(t *testing.T) {
+	ctx := context.Background()
+	if key := ByUser(ctx); key != "anonymous" {
+		t.Errorf("got %q without IP, want shared anonymous bucket", key)
+	}
+	if key := ByUser(WithClientIP(ctx, "10.0.0.1")); key != "ip:10.0.0.1" {
+		t.Errorf("got %q, want bucket of the IP", key)
+	}
+}
+
+func TestAnonymousClientsAreLimitedByIP(t *testing.T) {
+	r, _, _ := newTestLimiter(t, Limits{defaultMethod: {Rate: 1, Burst: 2}})
+	first := WithClientIP(context.Background(), "10.0.0.1")
+	second := WithClientIP(context.Background(), "10.0.0.2")
+	if allowed := drain(t, r, first, "GetStats"); allowed != 2 {
+		t.Fatalf("first client allowed %d requests, want 2", allowed)
+	}
+	if allowed := drain(t, r, second, "GetStats"); allowed != 2 {
+		t.Errorf("second client allowed %d requests, want own bucket of 2", allowed)
+	}
+}
+
+func TestRedisFailureDoesNotLimit(t *testing.T) {
+	r, server, _ := newTestLimiter(t, Limits{defaultMethod: {Rate: 1, Burst: 1, Key: byClient}})
+	server.Close()
+	for i := 0; i < 3; i++ {
+		if err := r.allow(context.Background(), "GetStats"); err != nil {
+			t.Fatalf("request is limited without redis: %s", err)
+		}
+	}
+}
+
+func TestRateLimitErrorExposesRetryAfter(t *testing.T) {
+	err := error(&RateLimitError{Method: "MakeDonate", RetryAfter: 1500 * time.Millisecond})
+	var svcErr *svcerror.Error
+	if !errors.As(err, &svcErr) || svcErr.Code != http.StatusTooManyRequests || svcErr.Msg != err.Error() {
+		t.Errorf("got svcerror %+v, want 429 with retry delay", svcErr)
+	}
+	if !errors.Is(err, donates.ErrRateLimited) {
+		t.Error("error isn't donates.ErrRateLimited")
+	}
+	data, marshalErr := json.Marshal(err)
+	if marshalErr != nil {
+		t.Fatalf("json.Marshal: %s", marshalErr)
+	}
+	var body struct {
+		Code         string `json:"code"`
+		RetryAfterMs int64  `json:"retry_after_ms"`
+	}
+	if json.Unmarshal(data, &body) != nil || body.Code != donates.ErrRateLimited.Code || body.RetryAfterMs != 1500 {
+		t.Errorf("got %s, want code and retry_after_ms", data)
+	}
+}
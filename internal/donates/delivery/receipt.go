@@ -0,0 +1,94 @@
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"tempproj/internal/donates"
+	"tempproj/pkg/error/svcerror"
+	"tempproj/pkg/sessioncontext"
+)
+
+// Receipts are rendered as HTML only. Websocket responses are JSON, so a PDF
+// would be sent base64 encoded, and the service has no PDF library to render
+// it. Clients print the HTML document to PDF when a jurisdiction needs one.
+const (
+	receiptJSON = "json"
+	receiptHTML = "html"
+)
+
+var receiptTemplate = template.Must(template.New("receipt").Funcs(template.FuncMap{
+	"money": formatMoney,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Receipt #{{.Number}}</title></head>
+<body>
+<h1>Donation receipt #{{.Number}}</h1>
+<table>
+<tr><td>Date</td><td>{{.IssuedAt.UTC.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><td>Donation</td><td>{{.DonateID}}</td></tr>
+<tr><td>From</td><td>{{.From}}</td></tr>
+<tr><td>To</td><td>{{.To}}</td></tr>
+{{if .Post}}<tr><td>Post</td><td>{{.Post}}</td></tr>{{end}}
+<tr><td>Amount</td><td>{{money .Amount}}</td></tr>
+<tr><td>Fee</td><td>{{money .Fee}}</td></tr>
+<tr><td>Net</td><td>{{money .Net}}</td></tr>
+</table>
+</body>
+</html>
+`))
+
+// Amounts are kept in hundredths
+func formatMoney(amount uint64) string {
+	return fmt.Sprintf("%d.%02d", amount/100, amount%100)
+}
+
+func renderReceiptHTML(receipt *donates.Receipt) (string, error) {
+	var buf bytes.Buffer
+	err := receiptTemplate.Execute(&buf, receipt)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+type reqGetReceipt struct {
+	ID     string `json:"id"`
+	Format string `json:"format"`
+}
+
+func parseGetReceipt(data []byte) (reqGetReceipt, error) {
+	var result reqGetReceipt
+	err := json.Unmarshal(data, &result)
+	return result, err
+}
+
+// Return receipt of confirmed donate as JSON or rendered HTML document
+func (w *websocket) GetReceipt(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	user := sessioncontext.GetUserID(ctx)
+	if user == "" {
+		return nil, donates.ErrUnauthenticated
+	}
+	req, err := parseGetReceipt(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "GetReceipt", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	receipt, err := w.donates.GetReceipt(ctx, user, req.ID)
+	if err != nil {
+		return nil, err
+	}
+	switch req.Format {
+	case "", receiptJSON:
+		return map[string]interface{}{"receipt": receipt}, nil
+	case receiptHTML:
+		document, err := renderReceiptHTML(receipt)
+		if err != nil {
+			return nil, svcerror.ErrInternal("can't render receipt: %s", err)
+		}
+		return map[string]interface{}{"receipt": receipt, "html": document}, nil
+	}
+	return nil, svcerror.ErrInvalidParams("unknown receipt format: %s", req.Format)
+}
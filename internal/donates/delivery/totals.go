@@ -0,0 +1,98 @@
+package delivery
+
+import (
+	"context"
+	"encoding/json"
+	"tempproj/internal/donates"
+	"tempproj/pkg/error/svcerror"
+)
+
+type reqGetPostTotals struct {
+	Post string `json:"post"`
+}
+
+func parseGetPostTotals(data []byte) (reqGetPostTotals, error) {
+	var result reqGetPostTotals
+	err := json.Unmarshal(data, &result)
+	return result, err
+}
+
+// Return how much a post raised and from how many supporters
+func (w *websocket) GetPostTotals(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	req, err := parseGetPostTotals(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "GetPostTotals", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	if req.Post == "" {
+		return nil, svcerror.ErrInvalidParams("post is empty")
+	}
+	totals, err := w.donates.GetPostTotals(ctx, req.Post)
+	if err != nil {
+		return nil, err
+	}
+	err = w.checkPrivacy(ctx, totals.Author, totalsVisibility)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"totals": totals}, nil
+}
+
+type reqGetPostsTotals struct {
+	Posts []string `json:"posts"`
+}
+
+func parseGetPostsTotals(data []byte) (reqGetPostsTotals, error) {
+	var result reqGetPostsTotals
+	err := json.Unmarshal(data, &result)
+	return result, err
+}
+
+// Return totals of feed posts in requested order. Totals of authors who hide
+// them from the session user are marked as hidden instead of failing the page,
+// posts that don't exist get zero totals.
+func (w *websocket) GetPostsTotals(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	req, err := parseGetPostsTotals(rawMessage)
+	if err != nil {
+		logMalformed(w.log, "GetPostsTotals", rawMessage, err)
+		return nil, svcerror.ErrMalformed("can't parse client request")
+	}
+	switch {
+	case len(req.Posts) == 0:
+		return map[string]interface{}{"totals": []interface{}{}}, nil
+	case len(req.Posts) > donates.MaxPostsTotals:
+		return nil, svcerror.ErrInvalidParams("too many posts, max %d", donates.MaxPostsTotals)
+	}
+	totals, err := w.donates.GetPostsTotals(ctx, req.Posts)
+	if err != nil {
+		return nil, err
+	}
+	visible := map[string]bool{}
+	response := make([]map[string]interface{}, 0, len(totals))
+	for _, t := range totals {
+		shown := t.Author == ""
+		if !shown {
+			var checked bool
+			shown, checked = visible[t.Author]
+			if !checked {
+				shown, err = w.recipientVisible(ctx, t.Author, totalsVisibility)
+				if err != nil {
+					return nil, err
+				}
+				visible[t.Author] = shown
+			}
+		}
+		if !shown {
+			response = append(response, map[string]interface{}{"post": t.Post, "hidden": true})
+			continue
+		}
+		response = append(response, map[string]interface{}{
+			"post":   t.Post,
+			"hidden": false,
+			"sum":    t.Sum,
+			"count":  t.Count,
+			"donors": t.Donors,
+		})
+	}
+	return map[string]interface{}{"totals": response}, nil
+}
@@ -0,0 +1,160 @@
+package delivery
+
+import (
+	"context"
+	"tempproj/internal/donates/tracing"
+	"tempproj/pkg/error/svcerror"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traced starts span of every websocket request, use cases and storage spans
+// are its children
+type traced struct {
+	next Delivery
+}
+
+func startSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "delivery."+method, trace.WithSpanKind(trace.SpanKindServer))
+}
+
+func (t *traced) MakeDonate(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "MakeDonate")
+	result, err := t.next.MakeDonate(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) GetUserDonators(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "GetUserDonators")
+	result, err := t.next.GetUserDonators(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) GetPostDonators(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "GetPostDonators")
+	result, err := t.next.GetPostDonators(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) GetDonatedUsers(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "GetDonatedUsers")
+	result, err := t.next.GetDonatedUsers(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) GetAmountOfDonations(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "GetAmountOfDonations")
+	result, err := t.next.GetAmountOfDonations(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) GetDonatesNumber(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "GetDonatesNumber")
+	result, err := t.next.GetDonatesNumber(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) GetPostTotals(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "GetPostTotals")
+	result, err := t.next.GetPostTotals(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) GetPostsTotals(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "GetPostsTotals")
+	result, err := t.next.GetPostsTotals(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) GetDonatesByIDs(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "GetDonatesByIDs")
+	result, err := t.next.GetDonatesByIDs(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) LookupDonates(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "LookupDonates")
+	result, err := t.next.LookupDonates(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) GetDonationPrivacy(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "GetDonationPrivacy")
+	result, err := t.next.GetDonationPrivacy(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) SetDonationPrivacy(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "SetDonationPrivacy")
+	result, err := t.next.SetDonationPrivacy(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) GetDonate(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "GetDonate")
+	result, err := t.next.GetDonate(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) ListMyDonates(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "ListMyDonates")
+	result, err := t.next.ListMyDonates(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) RequestPaymentURL(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "RequestPaymentURL")
+	result, err := t.next.RequestPaymentURL(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) GetReceipt(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "GetReceipt")
+	result, err := t.next.GetReceipt(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) StartExport(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "StartExport")
+	result, err := t.next.StartExport(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) GetExportJob(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "GetExportJob")
+	result, err := t.next.GetExportJob(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (t *traced) DownloadExport(ctx context.Context, rawMessage []byte) (interface{}, error) {
+	ctx, span := startSpan(ctx, "DownloadExport")
+	result, err := t.next.DownloadExport(ctx, rawMessage)
+	tracing.End(span, err)
+	return result, err
+}
+
+// Wrap delivery with tracing spans
+func WithTracing(next Delivery) (Delivery, error) {
+	if next == nil {
+		return nil, svcerror.ErrInternal("delivery is empty")
+	}
+	return &traced{next: next}, nil
+}
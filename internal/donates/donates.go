@@ -2,9 +2,10 @@ package donates
 
 import (
 	"context"
+	"io"
+	"tempproj/internal/donates/audit"
+	"tempproj/internal/types"
 	"time"
-
-	"github.com/rs/xid"
 )
 
 type UseCase interface {
@@ -14,7 +15,39 @@ type UseCase interface {
 	GetPostDonators(ctx context.Context, post string) ([]string, error)
 	GetUsersReceivedDonations(ctx context.Context, user string) ([]string, error)
 	GetAmountOfDonations(ctx context.Context, user string) (int64, error)
+	GetPostTotals(ctx context.Context, post string) (*PostTotals, error)
+	GetPostsTotals(ctx context.Context, posts []string) ([]PostTotals, error)
 	GetDonatesByIDs(ctx context.Context, ids []string) ([]Short, error)
+	LookupDonates(ctx context.Context, user string, ids []string, projection Projection) ([]LookupResult, error)
+	GetStats(ctx context.Context, user string) (*Stats, error)
+	GetPrivacy(ctx context.Context, user string) (*Privacy, error)
+	// Change given privacy settings of the user, returns resulting settings
+	SetPrivacy(ctx context.Context, user string, update PrivacyUpdate) (*Privacy, error)
+	// Return author of the post, empty string if post doesn't exist
+	GetPostAuthor(ctx context.Context, post string) (string, error)
+	GetDonate(ctx context.Context, user, id string) (*Donate, error)
+	ListMyDonates(ctx context.Context, user string, filter ListFilter, page types.PageOpt) ([]Donate, error)
+	RequestPaymentURL(ctx context.Context, user, id string) (string, error)
+	GetReceipt(ctx context.Context, user, donateID string) (*Receipt, error)
+	StartExport(ctx context.Context, user string, req ExportRequest) (*ExportJob, error)
+	GetExportJob(ctx context.Context, user, id string) (*ExportJob, error)
+	DownloadExport(ctx context.Context, user, id string) (io.ReadCloser, error)
+	Health(ctx context.Context) *Health
+	// Stop background handlers and wait for them to finish
+	Close()
+}
+
+// Moderation is admin-facing API for donates held by risk checks
+type Moderation interface {
+	ListForReview(ctx context.Context, filter ReviewFilter, page types.PageOpt) ([]Donate, error)
+	ApproveDonate(ctx context.Context, donateID, moderator string) (*Donate, error)
+	RejectDonate(ctx context.Context, donateID, moderator, reason string) (*Donate, error)
+	GetDecisions(ctx context.Context, donateID string) ([]ModerationDecision, error)
+	GetAuditLog(ctx context.Context, donateID string) ([]audit.Entry, error)
+	FindAuditLog(ctx context.Context, filter audit.Filter, page types.PageOpt) ([]audit.Entry, error)
+	VerifyAuditLog(ctx context.Context, donateID string) error
+	// Recompute donation stats from confirmed donates
+	RebuildStats(ctx context.Context, moderator string) error
 }
 
 type Status int
@@ -24,17 +57,226 @@ const (
 	Pending                 // set after payment provider initialized new payout, waiting client's actions
 	Confirmed               // set after successful payment
 	Failed                  // failed payments, don't show to users
+	Review                  // held by risk checks until manual review
+	Denied                  // rejected by risk checks
 )
 
+var statusNames = []string{"new", "pending", "confirmed", "failed", "review", "denied"}
+
+// Statuses donate can move to from its status. Confirmed and denied donates
+// are final, so late payment updates don't change them.
+var transitions = map[Status][]Status{
+	New:     {New, Pending, Confirmed, Failed},
+	Pending: {Pending, Confirmed, Failed},
+	Failed:  {Pending, Confirmed, Failed},
+	Review:  {New, Denied},
+}
+
+// Check that donate in status from can move to status to
+func CanTransition(from, to Status) bool {
+	for _, status := range transitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Status) String() string {
+	if s < 0 || int(s) >= len(statusNames) {
+		return "unknown"
+	}
+	return statusNames[s]
+}
+
 type Donate struct {
-	ID        string    `bson:"id"`
-	From      string    `bson:"from"`
-	To        string    `bson:"to"`
-	Amount    uint64    `bson:"amount"`
-	Status    Status    `bson:"status"`
-	Post      string    `bson:"post"`
-	CreatedAt time.Time `bson:"created"`
-	UpdatedAt time.Time `bson:"updated"`
+	ID         string         `bson:"id"`
+	From       string         `bson:"from"`
+	To         string         `bson:"to"`
+	Amount     uint64         `bson:"amount"`
+	Status     Status         `bson:"status"`
+	Post       string         `bson:"post"`
+	RiskReason string         `bson:"risk_reason,omitempty"` // why risk checks held or rejected the donate
+	CreatedAt  time.Time      `bson:"created"`
+	UpdatedAt  time.Time      `bson:"updated"`
+	History    []StatusChange `bson:"history"` // last MaxHistory status transitions
+	PaymentURL string         `bson:"payment_url,omitempty"`
+	Version    int64          `bson:"version"` // incremented by every update
+}
+
+const MaxHistory = 20
+
+type StatusChange struct {
+	Status Status    `bson:"status" json:"status"`
+	At     time.Time `bson:"at" json:"at"`
+	Ref    string    `bson:"ref,omitempty" json:"ref,omitempty"` // payment provider reference
+}
+
+// Health of donate service, Problems explain why it isn't healthy
+type Health struct {
+	Healthy          bool          `json:"healthy"`
+	Storage          bool          `json:"storage"`            // mongo answers ping
+	Subscribed       bool          `json:"subscribed"`         // payment updates subscription is alive
+	Heartbeat        time.Time     `json:"heartbeat"`          // last sign of life of payment updates handler
+	OldestPaymentAge time.Duration `json:"oldest_payment_age"` // age of the oldest payment update waiting for handling
+	Problems         []string      `json:"problems,omitempty"`
+}
+
+// Receipt of confirmed donate. Numbers are sequential without gaps.
+type Receipt struct {
+	Number   int64     `bson:"number" json:"number"`
+	DonateID string    `bson:"donate" json:"donate"`
+	From     string    `bson:"from" json:"from"`
+	To       string    `bson:"to" json:"to"`
+	Post     string    `bson:"post,omitempty" json:"post,omitempty"`
+	Amount   uint64    `bson:"amount" json:"amount"`
+	Fee      uint64    `bson:"fee" json:"fee"`
+	Net      uint64    `bson:"net" json:"net"`
+	IssuedAt time.Time `bson:"issued" json:"issued"`
+}
+
+type Direction int
+
+const (
+	Sent     Direction = iota // donates made by user
+	Received                  // donates made to user
+)
+
+// ListFilter narrows list of user's donates, empty fields are ignored
+type ListFilter struct {
+	User      string    `json:"-"`
+	Direction Direction `json:"direction"`
+	Statuses  []Status  `json:"statuses"`
+	Since     time.Time `json:"since"`
+	Until     time.Time `json:"until"`
+}
+
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+)
+
+// Fields available for export
+var ExportFields = []string{"id", "from", "to", "post", "amount", "status", "created", "updated"}
+
+type ExportRequest struct {
+	Format string     `bson:"format" json:"format"`
+	Filter ListFilter `bson:"filter" json:"filter"`
+	Fields []string   `bson:"fields" json:"fields"` // all ExportFields if empty
+}
+
+type ExportStatus string
+
+const (
+	ExportQueued  ExportStatus = "queued"
+	ExportRunning ExportStatus = "running"
+	ExportDone    ExportStatus = "done"
+	ExportFailed  ExportStatus = "failed"
+)
+
+// ExportJob is asynchronous export of user's donates
+type ExportJob struct {
+	ID         string        `bson:"id" json:"id"`
+	User       string        `bson:"user" json:"-"`
+	Request    ExportRequest `bson:"request" json:"request"`
+	Status     ExportStatus  `bson:"status" json:"status"`
+	Total      int64         `bson:"total" json:"total"`
+	Processed  int64         `bson:"processed" json:"processed"`
+	Error      string        `bson:"error,omitempty" json:"error,omitempty"`
+	FileID     interface{}   `bson:"file,omitempty" json:"-"`
+	Heartbeat  time.Time     `bson:"heartbeat,omitempty" json:"-"` // last sign of life of running export
+	CreatedAt  time.Time     `bson:"created" json:"created"`
+	FinishedAt time.Time     `bson:"finished,omitempty" json:"finished,omitempty"`
+}
+
+// Stats is materialized per-user summary of confirmed donates
+type Stats struct {
+	User           string    `bson:"user"`
+	ReceivedCount  int64     `bson:"received_count"`
+	ReceivedSum    int64     `bson:"received_sum"`
+	GivenCount     int64     `bson:"given_count"`
+	GivenSum       int64     `bson:"given_sum"`
+	UniqueDonors   int64     `bson:"unique_donors"`
+	LastDonationAt time.Time `bson:"last_donation"`
+}
+
+// Max number of posts in one totals request, enough for a feed page
+const MaxPostsTotals = 100
+
+// PostTotals sums up confirmed donates made to a post
+type PostTotals struct {
+	Post   string `bson:"post" json:"post"`
+	Author string `bson:"author" json:"-"` // author of the post
+	Sum    int64  `bson:"sum" json:"sum"`
+	Count  int64  `bson:"count" json:"count"`
+	Donors int64  `bson:"donors" json:"donors"` // unique donors
+}
+
+// ReviewFilter narrows list of donates under review, empty fields are ignored
+type ReviewFilter struct {
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+}
+
+// ModerationDecision is an audit record of manual review
+type ModerationDecision struct {
+	DonateID   string    `bson:"donate" json:"donate"`
+	Moderator  string    `bson:"moderator" json:"moderator"`
+	Approved   bool      `bson:"approved" json:"approved"`
+	Reason     string    `bson:"reason" json:"reason"`
+	RiskReason string    `bson:"risk_reason" json:"risk_reason"`
+	CreatedAt  time.Time `bson:"created" json:"created"`
+}
+
+// Visibility defines who can see user's donation data
+type Visibility int
+
+const (
+	Public        Visibility = iota // everybody
+	FollowersOnly                   // owner and followers
+	Private                         // owner only
+)
+
+func (v Visibility) Valid() bool {
+	return v >= Public && v <= Private
+}
+
+// Privacy settings of user's donation totals and donator lists
+type Privacy struct {
+	User     string     `bson:"user" json:"-"`
+	Totals   Visibility `bson:"totals" json:"totals"`
+	Donators Visibility `bson:"donators" json:"donators"`
+}
+
+// PrivacyUpdate changes settings that are set, the rest are kept
+type PrivacyUpdate struct {
+	Totals   *Visibility `json:"totals"`
+	Donators *Visibility `json:"donators"`
+}
+
+// Projection is a set of donate fields returned by lookups
+type Projection string
+
+const (
+	ProjectShort  Projection = "short"  // id and amount
+	ProjectPublic Projection = "public" // fields anybody can see, without donor and payment details
+	ProjectFull   Projection = "full"   // whole donate, only for its donor and recipient
+)
+
+func (p Projection) Valid() bool {
+	return p == ProjectShort || p == ProjectPublic || p == ProjectFull
+}
+
+// Max number of IDs in one lookup
+const MaxLookupIDs = 500
+
+// LookupResult is a donate at position of its ID in lookup request. Donate is
+// nil if it isn't found or isn't visible to the user.
+type LookupResult struct {
+	ID     string
+	Donate *Donate
 }
 
 type Short struct {
@@ -49,10 +291,25 @@ func (d *Donate) Short() *Short {
 	}
 }
 
+// Time the donate was confirmed at, creation time if history doesn't have it
+func (d *Donate) ConfirmedAt() time.Time {
+	for i := len(d.History) - 1; i >= 0; i-- {
+		if d.History[i].Status == Confirmed {
+			return d.History[i].At
+		}
+	}
+	return d.CreatedAt
+}
+
 func NewDonate(from, to, post string, amount uint64) *Donate {
-	now := time.Now()
+	return NewDonateWith(SystemClock, XIDs, from, to, post, amount)
+}
+
+// Create donate with ID and timestamps from given generator and clock
+func NewDonateWith(clock Clock, ids IDGenerator, from, to, post string, amount uint64) *Donate {
+	now := clock.Now()
 	return &Donate{
-		ID:        xid.New().String(),
+		ID:        ids.NewID(),
 		From:      from,
 		To:        to,
 		Amount:    amount,
@@ -0,0 +1,94 @@
+package donatestest
+
+import (
+	"context"
+	"sync"
+	"tempproj/internal/donates"
+	"tempproj/internal/donates/audit"
+	"tempproj/internal/types"
+)
+
+// AuditLog is in-memory audit.Log, entries can't be tampered so Verify checks
+// sequence numbers only
+type AuditLog struct {
+	mu      sync.Mutex
+	entries []audit.Entry
+	clock   donates.Clock
+	ids     donates.IDGenerator
+}
+
+var _ audit.Log = (*AuditLog)(nil)
+
+func NewAuditLog() *AuditLog {
+	return NewAuditLogWith(donates.SystemClock, donates.XIDs)
+}
+
+// Create audit log stamping entries with time of the clock and correlation
+// IDs of ids
+func NewAuditLogWith(clock donates.Clock, ids donates.IDGenerator) *AuditLog {
+	return &AuditLog{clock: clock, ids: ids}
+}
+
+func (l *AuditLog) Record(ctx context.Context, entry *audit.Entry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entry.CorrelationID == "" {
+		entry.CorrelationID = audit.CorrelationID(ctx)
+	}
+	if entry.CorrelationID == "" {
+		entry.CorrelationID = l.ids.NewID()
+	}
+	entry.Seq = 1
+	for _, existing := range l.entries {
+		if existing.DonateID == entry.DonateID {
+			entry.Seq++
+		}
+	}
+	entry.CreatedAt = l.clock.Now()
+	l.entries = append(l.entries, *entry)
+	return nil
+}
+
+func (l *AuditLog) GetByDonate(ctx context.Context, donateID string) ([]audit.Entry, error) {
+	return l.Find(ctx, audit.Filter{DonateID: donateID}, types.PageOpt{})
+}
+
+func (l *AuditLog) Find(ctx context.Context, filter audit.Filter, page types.PageOpt) ([]audit.Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := make([]audit.Entry, 0)
+	for _, entry := range l.entries {
+		switch {
+		case filter.DonateID != "" && entry.DonateID != filter.DonateID,
+			filter.Actor != "" && entry.Actor != filter.Actor,
+			filter.Source != "" && entry.Source != filter.Source,
+			filter.CorrelationID != "" && entry.CorrelationID != filter.CorrelationID,
+			!inPeriod(entry.CreatedAt, filter.Since, filter.Until):
+			continue
+		}
+		result = append(result, entry)
+	}
+	if page.Offset > 0 {
+		if int(page.Offset) >= len(result) {
+			return []audit.Entry{}, nil
+		}
+		result = result[page.Offset:]
+	}
+	if page.Limit > 0 && int(page.Limit) < len(result) {
+		result = result[:page.Limit]
+	}
+	return result, nil
+}
+
+func (l *AuditLog) Verify(ctx context.Context, donateID string) error {
+	entries, err := l.GetByDonate(ctx, donateID)
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		if entry.Seq != int64(i+1) {
+			return audit.ErrTampered
+		}
+	}
+	return nil
+}
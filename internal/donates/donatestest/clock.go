@@ -0,0 +1,58 @@
+package donatestest
+
+import (
+	"fmt"
+	"sync"
+	"tempproj/internal/donates"
+	"time"
+)
+
+// Clock stands still until it's moved
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+var _ donates.Clock = (*Clock)(nil)
+
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// IDs generates sequential IDs: prefix-1, prefix-2, ...
+type IDs struct {
+	mu     sync.Mutex
+	prefix string
+	next   int
+}
+
+var _ donates.IDGenerator = (*IDs)(nil)
+
+func NewIDs(prefix string) *IDs {
+	return &IDs{prefix: prefix}
+}
+
+func (g *IDs) NewID() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.next++
+	return fmt.Sprintf("%s-%d", g.prefix, g.next)
+}
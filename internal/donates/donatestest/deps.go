@@ -0,0 +1,184 @@
+package donatestest
+
+import (
+	"context"
+	"sync"
+	"tempproj/pkg/event"
+	"time"
+)
+
+// Users answers eligibility checks of donates from its maps, it implements
+// usecase.Users and usecase.Admins
+type Users struct {
+	mu       sync.Mutex
+	admins   map[string]bool
+	created  map[string]time.Time
+	disabled map[string]bool
+	banned   map[string]bool
+	blocked  map[[2]string]bool
+}
+
+func NewUsers() *Users {
+	return &Users{
+		admins:   map[string]bool{},
+		created:  map[string]time.Time{},
+		disabled: map[string]bool{},
+		banned:   map[string]bool{},
+		blocked:  map[[2]string]bool{},
+	}
+}
+
+// Add users created at the time
+func (u *Users) Add(created time.Time, ids ...string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, id := range ids {
+		u.created[id] = created
+	}
+}
+
+// Allow users to moderate donates
+func (u *Users) AddAdmins(ids ...string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, id := range ids {
+		u.admins[id] = true
+	}
+}
+
+func (u *Users) DisableDonations(user string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.disabled[user] = true
+}
+
+func (u *Users) Ban(user string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.banned[user] = true
+}
+
+func (u *Users) Block(user, by string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.blocked[[2]string{user, by}] = true
+}
+
+func (u *Users) Exists(ctx context.Context, user string) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	_, ok := u.created[user]
+	return ok, nil
+}
+
+func (u *Users) DonationsEnabled(ctx context.Context, user string) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.disabled[user], nil
+}
+
+func (u *Users) IsBanned(ctx context.Context, user string) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.banned[user], nil
+}
+
+func (u *Users) IsBlocked(ctx context.Context, user, by string) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.blocked[[2]string{user, by}], nil
+}
+
+func (u *Users) IsAdmin(ctx context.Context, user string) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.admins[user], nil
+}
+
+func (u *Users) CreatedAt(ctx context.Context, user string) (time.Time, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.created[user], nil
+}
+
+// Posts knows authors of posts, it implements usecase.Posts
+type Posts struct {
+	mu      sync.Mutex
+	authors map[string]string
+}
+
+func NewPosts() *Posts {
+	return &Posts{authors: map[string]string{}}
+}
+
+func (p *Posts) Add(post, author string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.authors[post] = author
+}
+
+func (p *Posts) GetAuthor(ctx context.Context, post string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.authors[post], nil
+}
+
+// Donate sent to events service
+type Donated struct {
+	From   string
+	To     string
+	Donate interface{}
+}
+
+// Events keeps confirmed donates sent to events service
+type Events struct {
+	mu      sync.Mutex
+	donated []Donated
+}
+
+func NewEvents() *Events {
+	return &Events{}
+}
+
+func (e *Events) DonateUser(ctx context.Context, from, to string, donate interface{}) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.donated = append(e.donated, Donated{From: from, To: to, Donate: donate})
+	return nil
+}
+
+func (e *Events) Donated() []Donated {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Donated(nil), e.donated...)
+}
+
+// Notification sent to user
+type Notification struct {
+	Type    event.Type
+	Payload map[string]interface{}
+	User    string
+}
+
+// Notifications keeps sent notifications
+type Notifications struct {
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func NewNotifications() *Notifications {
+	return &Notifications{}
+}
+
+func (n *Notifications) Notify(ctx context.Context, t event.Type, payload map[string]interface{}, user string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, Notification{Type: t, Payload: payload, User: user})
+	return nil
+}
+
+func (n *Notifications) Sent() []Notification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Notification(nil), n.sent...)
+}
@@ -0,0 +1,77 @@
+package donatestest
+
+import (
+	"context"
+	"sync"
+	"tempproj/pkg/messagequeue"
+)
+
+// Messages a subscriber can fall behind by, later ones are dropped as redis
+// pub/sub drops them for slow subscribers
+const subBuffer = 1024
+
+// MQ delivers published messages to subscribers of the topic in memory and
+// keeps them for assertions
+type MQ struct {
+	mu        sync.Mutex
+	published map[string][][]byte
+	subs      map[string][]chan []byte
+}
+
+var _ messagequeue.MessageQueue = (*MQ)(nil)
+
+func NewMQ() *MQ {
+	return &MQ{
+		published: map[string][][]byte{},
+		subs:      map[string][]chan []byte{},
+	}
+}
+
+func (q *MQ) Pub(topic string, data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.published[topic] = append(q.published[topic], data)
+	for _, sub := range q.subs[topic] {
+		select {
+		case sub <- data:
+		default:
+		}
+	}
+	return nil
+}
+
+// Subscription is closed when ctx is done
+func (q *MQ) Sub(ctx context.Context, topic string) (<-chan []byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	sub := make(chan []byte, subBuffer)
+	q.subs[topic] = append(q.subs[topic], sub)
+	go func() {
+		<-ctx.Done()
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		subs := q.subs[topic]
+		for i := range subs {
+			if subs[i] == sub {
+				q.subs[topic] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+		close(sub)
+	}()
+	return sub, nil
+}
+
+// Messages published to the topic
+func (q *MQ) Published(topic string) [][]byte {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([][]byte(nil), q.published[topic]...)
+}
+
+// Number of live subscriptions of the topic
+func (q *MQ) Subscribers(topic string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.subs[topic])
+}
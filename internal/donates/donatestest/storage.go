@@ -0,0 +1,779 @@
+package donatestest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"tempproj/internal/donates"
+	"tempproj/internal/donates/lifecycle"
+	"tempproj/internal/donates/storage"
+	"tempproj/internal/types"
+	"tempproj/pkg/error/dberror"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type paymentRequest struct {
+	donate       string
+	sent         bool
+	claimedUntil time.Time
+}
+
+type outboxEntry struct {
+	event        lifecycle.Event
+	sent         bool
+	claimedUntil time.Time
+}
+
+// Storage is in-memory storage.Storage. Updates are applied to bson documents,
+// so field names of update maps are the same as for Mongo. Export files are
+// kept in memory.
+type Storage struct {
+	mu        sync.Mutex
+	donates   []*donates.Donate
+	applied   map[string]bool
+	pairs     map[[2]string]bool
+	stats     map[string]*donates.Stats
+	postPairs map[[2]string]bool
+	postStats map[string]*donates.PostTotals
+	privacy   map[string]donates.Privacy
+	decisions []donates.ModerationDecision
+	receipts  map[string]donates.Receipt
+	jobs      map[string]*donates.ExportJob
+	jobOrder  []string
+	files     map[string][]byte
+	outbox    []outboxEntry
+	payments  []paymentRequest
+	clock     donates.Clock
+	// Stats were rebuilt at least once
+	statsBuilt bool
+	// Error returned by Ping
+	PingErr error
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+func NewStorage() *Storage {
+	return NewStorageWithClock(donates.SystemClock)
+}
+
+// Create storage stamping updates with time of the clock
+func NewStorageWithClock(clock donates.Clock) *Storage {
+	return &Storage{
+		clock:     clock,
+		applied:   map[string]bool{},
+		pairs:     map[[2]string]bool{},
+		stats:     map[string]*donates.Stats{},
+		postPairs: map[[2]string]bool{},
+		postStats: map[string]*donates.PostTotals{},
+		privacy:   map[string]donates.Privacy{},
+		receipts:  map[string]donates.Receipt{},
+		jobs:      map[string]*donates.ExportJob{},
+		files:     map[string][]byte{},
+	}
+}
+
+type txKey struct{}
+
+// Lock the storage unless ctx is of transaction holding the lock already
+func (s *Storage) lock(ctx context.Context) (unlock func()) {
+	if ctx.Value(txKey{}) != nil {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+// Run fn holding the lock, storage methods called with ctx passed to fn don't
+// lock again. Outbox entries and decisions added by failed fn are dropped.
+func (s *Storage) transaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	defer s.lock(ctx)()
+	outbox, payments, decisions := len(s.outbox), len(s.payments), len(s.decisions)
+	err := fn(context.WithValue(ctx, txKey{}, true))
+	if err != nil {
+		s.outbox = s.outbox[:outbox]
+		s.payments = s.payments[:payments]
+		s.decisions = s.decisions[:decisions]
+	}
+	return err
+}
+
+func runHook(ctx context.Context, hook storage.Mutation, before, after *donates.Donate) error {
+	if hook == nil {
+		return nil
+	}
+	return hook(ctx, before, after)
+}
+
+func errNotFound(what string) error {
+	return dberror.ErrMongoHandle(mongo.ErrNoDocuments, "%s isn't found", what)
+}
+
+func copyDonate(donate *donates.Donate) *donates.Donate {
+	result := *donate
+	result.History = append([]donates.StatusChange(nil), donate.History...)
+	return &result
+}
+
+func (s *Storage) find(id string) *donates.Donate {
+	for _, donate := range s.donates {
+		if donate.ID == id {
+			return donate
+		}
+	}
+	return nil
+}
+
+func (s *Storage) filter(match func(*donates.Donate) bool) []donates.Donate {
+	result := make([]donates.Donate, 0)
+	for _, donate := range s.donates {
+		if match(donate) {
+			result = append(result, *copyDonate(donate))
+		}
+	}
+	return result
+}
+
+func page(list []donates.Donate, opt types.PageOpt) []donates.Donate {
+	if opt.Offset > 0 {
+		if int(opt.Offset) >= len(list) {
+			return []donates.Donate{}
+		}
+		list = list[opt.Offset:]
+	}
+	if opt.Limit > 0 && int(opt.Limit) < len(list) {
+		list = list[:opt.Limit]
+	}
+	return list
+}
+
+func inPeriod(at, since, until time.Time) bool {
+	return (since.IsZero() || !at.Before(since)) && (until.IsZero() || at.Before(until))
+}
+
+func (s *Storage) Create(ctx context.Context, donate *donates.Donate, hook storage.Mutation) error {
+	return s.transaction(ctx, func(ctx context.Context) error {
+		if s.find(donate.ID) != nil {
+			return dberror.ErrInternal("donate %s already exists", donate.ID)
+		}
+		if len(donate.History) == 0 {
+			donate.History = []donates.StatusChange{{Status: donate.Status, At: donate.CreatedAt}}
+		}
+		donate.Version = 1
+		err := runHook(ctx, hook, nil, copyDonate(donate))
+		if err != nil {
+			return err
+		}
+		s.donates = append(s.donates, copyDonate(donate))
+		return nil
+	})
+}
+
+func (s *Storage) GetByUser(ctx context.Context, user string) ([]donates.Donate, error) {
+	defer s.lock(ctx)()
+	return s.filter(func(d *donates.Donate) bool { return d.To == user }), nil
+}
+
+func (s *Storage) GetByID(ctx context.Context, id string) (*donates.Donate, error) {
+	defer s.lock(ctx)()
+	donate := s.find(id)
+	if donate == nil {
+		return nil, errNotFound("donate")
+	}
+	return copyDonate(donate), nil
+}
+
+// Projection isn't applied, whole donates are returned
+func (s *Storage) GetByIDs(ctx context.Context, ids []string, projection donates.Projection) ([]donates.Donate, error) {
+	defer s.lock(ctx)()
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	return s.filter(func(d *donates.Donate) bool { return wanted[d.ID] }), nil
+}
+
+func matchList(filter donates.ListFilter) func(*donates.Donate) bool {
+	return func(d *donates.Donate) bool {
+		user := d.From
+		if filter.Direction == donates.Received {
+			user = d.To
+		}
+		if user != filter.User || !inPeriod(d.CreatedAt, filter.Since, filter.Until) {
+			return false
+		}
+		if len(filter.Statuses) == 0 {
+			return true
+		}
+		for _, status := range filter.Statuses {
+			if d.Status == status {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (s *Storage) List(ctx context.Context, filter donates.ListFilter, opt types.PageOpt) ([]donates.Donate, error) {
+	defer s.lock(ctx)()
+	result := s.filter(matchList(filter))
+	sort.SliceStable(result, func(i, j int) bool { return result[i].CreatedAt.After(result[j].CreatedAt) })
+	return page(result, opt), nil
+}
+
+func (s *Storage) GetNumber(ctx context.Context, user string) (int64, error) {
+	defer s.lock(ctx)()
+	confirmed := s.filter(func(d *donates.Donate) bool { return d.To == user && d.Status == donates.Confirmed })
+	return int64(len(confirmed)), nil
+}
+
+// Filter and uniq are bson field names of confirmed donates
+func (s *Storage) GetDonators(ctx context.Context, uniq string, filter map[string]interface{}) ([]string, error) {
+	defer s.lock(ctx)()
+	seen := map[string]bool{}
+	result := make([]string, 0)
+	for _, donate := range s.donates {
+		if donate.Status != donates.Confirmed {
+			continue
+		}
+		doc, err := toDoc(donate)
+		if err != nil {
+			return nil, err
+		}
+		matched := true
+		for key, value := range filter {
+			if key != "status" && doc[key] != value {
+				matched = false
+			}
+		}
+		value, _ := doc[uniq].(string)
+		if matched && !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	return result, nil
+}
+
+func (s *Storage) GetDonatesSum(ctx context.Context, user string) (int64, error) {
+	defer s.lock(ctx)()
+	var sum int64
+	for _, donate := range s.donates {
+		if donate.To == user && donate.Status == donates.Confirmed {
+			sum += int64(donate.Amount)
+		}
+	}
+	return sum, nil
+}
+
+func toDoc(donate *donates.Donate) (bson.M, error) {
+	data, err := bson.Marshal(donate)
+	if err != nil {
+		return nil, dberror.ErrInternal("can't marshal donate: %s", err)
+	}
+	doc := bson.M{}
+	err = bson.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, dberror.ErrInternal("can't unmarshal donate: %s", err)
+	}
+	return doc, nil
+}
+
+// Apply $set of update to copy of the donate and record status change like
+// Mongo storage does, the donate is replaced with the copy if hook accepts it
+func (s *Storage) update(ctx context.Context, donate *donates.Donate, update map[string]interface{}, hook storage.Mutation) (*donates.Donate, error) {
+	doc, err := toDoc(donate)
+	if err != nil {
+		return nil, err
+	}
+	now := s.clock.Now()
+	doc["updated"] = now
+	for key, value := range update {
+		// Reference of payment is saved to history only
+		if key != "payment_ref" {
+			doc[key] = value
+		}
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, dberror.ErrInternal("can't marshal update: %s", err)
+	}
+	updated := donates.Donate{}
+	err = bson.Unmarshal(data, &updated)
+	if err != nil {
+		return nil, dberror.ErrInternal("can't apply update: %s", err)
+	}
+	if _, ok := update["status"]; ok {
+		ref, _ := update["payment_ref"].(string)
+		updated.History = append(updated.History, donates.StatusChange{Status: updated.Status, At: now, Ref: ref})
+		if len(updated.History) > donates.MaxHistory {
+			updated.History = updated.History[len(updated.History)-donates.MaxHistory:]
+		}
+	}
+	updated.Version = donate.Version + 1
+	err = runHook(ctx, hook, copyDonate(donate), copyDonate(&updated))
+	if err != nil {
+		return nil, err
+	}
+	*donate = updated
+	return copyDonate(donate), nil
+}
+
+func (s *Storage) Update(ctx context.Context, donateID string, version int64, update map[string]interface{}, hook storage.Mutation) (*donates.Donate, error) {
+	var result *donates.Donate
+	err := s.transaction(ctx, func(ctx context.Context) error {
+		donate := s.find(donateID)
+		if donate == nil {
+			return errNotFound("donate")
+		}
+		if donate.Version != version {
+			return donates.ErrVersionConflict
+		}
+		var err error
+		result, err = s.update(ctx, donate, update, hook)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *Storage) ApplyToStats(ctx context.Context, donate *donates.Donate) (bool, error) {
+	defer s.lock(ctx)()
+	if s.applied[donate.ID] {
+		return false, nil
+	}
+	s.applied[donate.ID] = true
+	s.addToStats(donate)
+	return true, nil
+}
+
+func (s *Storage) userStats(user string) *donates.Stats {
+	stats, ok := s.stats[user]
+	if !ok {
+		stats = &donates.Stats{User: user}
+		s.stats[user] = stats
+	}
+	return stats
+}
+
+func (s *Storage) addToStats(donate *donates.Donate) {
+	to := s.userStats(donate.To)
+	to.ReceivedCount++
+	to.ReceivedSum += int64(donate.Amount)
+	pair := [2]string{donate.From, donate.To}
+	if !s.pairs[pair] {
+		s.pairs[pair] = true
+		to.UniqueDonors++
+	}
+	from := s.userStats(donate.From)
+	from.GivenCount++
+	from.GivenSum += int64(donate.Amount)
+	confirmed := donate.ConfirmedAt()
+	for _, stats := range []*donates.Stats{to, from} {
+		if confirmed.After(stats.LastDonationAt) {
+			stats.LastDonationAt = confirmed
+		}
+	}
+	if donate.Post == "" {
+		return
+	}
+	post, ok := s.postStats[donate.Post]
+	if !ok {
+		post = &donates.PostTotals{Post: donate.Post}
+		s.postStats[donate.Post] = post
+	}
+	post.Author = donate.To
+	post.Sum += int64(donate.Amount)
+	post.Count++
+	postPair := [2]string{donate.Post, donate.From}
+	if !s.postPairs[postPair] {
+		s.postPairs[postPair] = true
+		post.Donors++
+	}
+}
+
+func (s *Storage) GetStats(ctx context.Context, user string) (*donates.Stats, error) {
+	defer s.lock(ctx)()
+	stats, ok := s.stats[user]
+	if !ok {
+		return &donates.Stats{User: user}, nil
+	}
+	result := *stats
+	return &result, nil
+}
+
+func (s *Storage) GetPostTotals(ctx context.Context, posts []string) ([]donates.PostTotals, error) {
+	defer s.lock(ctx)()
+	result := make([]donates.PostTotals, 0)
+	seen := make(map[string]bool, len(posts))
+	for _, post := range posts {
+		totals, ok := s.postStats[post]
+		if ok && !seen[post] {
+			seen[post] = true
+			result = append(result, *totals)
+		}
+	}
+	return result, nil
+}
+
+func (s *Storage) RebuildStats(ctx context.Context) error {
+	defer s.lock(ctx)()
+	s.applied = map[string]bool{}
+	s.pairs = map[[2]string]bool{}
+	s.stats = map[string]*donates.Stats{}
+	s.postPairs = map[[2]string]bool{}
+	s.postStats = map[string]*donates.PostTotals{}
+	for _, donate := range s.donates {
+		if donate.Status == donates.Confirmed {
+			s.applied[donate.ID] = true
+			s.addToStats(donate)
+		}
+	}
+	s.statsBuilt = true
+	return nil
+}
+
+func (s *Storage) StatsBuilt(ctx context.Context) (bool, error) {
+	defer s.lock(ctx)()
+	return s.statsBuilt, nil
+}
+
+func (s *Storage) ApplyPendingStats(ctx context.Context) (int64, error) {
+	defer s.lock(ctx)()
+	var count int64
+	for _, donate := range s.donates {
+		if donate.Status == donates.Confirmed && !s.applied[donate.ID] {
+			s.applied[donate.ID] = true
+			s.addToStats(donate)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *Storage) GetPrivacy(ctx context.Context, user string) (*donates.Privacy, error) {
+	defer s.lock(ctx)()
+	privacy, ok := s.privacy[user]
+	if !ok {
+		return &donates.Privacy{User: user, Totals: donates.Public, Donators: donates.Public}, nil
+	}
+	return &privacy, nil
+}
+
+func (s *Storage) SetPrivacy(ctx context.Context, user string, update donates.PrivacyUpdate) (*donates.Privacy, error) {
+	defer s.lock(ctx)()
+	privacy, ok := s.privacy[user]
+	if !ok {
+		privacy = donates.Privacy{User: user, Totals: donates.Public, Donators: donates.Public}
+	}
+	if update.Totals != nil {
+		privacy.Totals = *update.Totals
+	}
+	if update.Donators != nil {
+		privacy.Donators = *update.Donators
+	}
+	s.privacy[user] = privacy
+	return &privacy, nil
+}
+
+func (s *Storage) GetByStatus(ctx context.Context, status donates.Status, filter donates.ReviewFilter, opt types.PageOpt) ([]donates.Donate, error) {
+	defer s.lock(ctx)()
+	result := s.filter(func(d *donates.Donate) bool {
+		return d.Status == status &&
+			(filter.From == "" || d.From == filter.From) &&
+			(filter.To == "" || d.To == filter.To) &&
+			inPeriod(d.CreatedAt, filter.Since, filter.Until)
+	})
+	sort.SliceStable(result, func(i, j int) bool { return result[i].CreatedAt.Before(result[j].CreatedAt) })
+	return page(result, opt), nil
+}
+
+func (s *Storage) UpdateIfStatus(ctx context.Context, donateID string, status donates.Status, update map[string]interface{}, hook storage.Mutation) (*donates.Donate, error) {
+	var result *donates.Donate
+	err := s.transaction(ctx, func(ctx context.Context) error {
+		donate := s.find(donateID)
+		if donate == nil || donate.Status != status {
+			return nil
+		}
+		var err error
+		result, err = s.update(ctx, donate, update, hook)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *Storage) AddDecision(ctx context.Context, decision *donates.ModerationDecision) error {
+	defer s.lock(ctx)()
+	s.decisions = append(s.decisions, *decision)
+	return nil
+}
+
+func (s *Storage) GetDecisions(ctx context.Context, donateID string) ([]donates.ModerationDecision, error) {
+	defer s.lock(ctx)()
+	result := make([]donates.ModerationDecision, 0)
+	for _, decision := range s.decisions {
+		if decision.DonateID == donateID {
+			result = append(result, decision)
+		}
+	}
+	return result, nil
+}
+
+func (s *Storage) CreateReceipt(ctx context.Context, receipt *donates.Receipt) (*donates.Receipt, error) {
+	defer s.lock(ctx)()
+	if existing, ok := s.receipts[receipt.DonateID]; ok {
+		return &existing, nil
+	}
+	receipt.Number = int64(len(s.receipts) + 1)
+	s.receipts[receipt.DonateID] = *receipt
+	return receipt, nil
+}
+
+func (s *Storage) GetReceipt(ctx context.Context, donateID string) (*donates.Receipt, error) {
+	defer s.lock(ctx)()
+	receipt, ok := s.receipts[donateID]
+	if !ok {
+		return nil, errNotFound("receipt")
+	}
+	return &receipt, nil
+}
+
+func (s *Storage) Count(ctx context.Context, filter donates.ListFilter) (int64, error) {
+	defer s.lock(ctx)()
+	return int64(len(s.filter(matchList(filter)))), nil
+}
+
+func (s *Storage) Iterate(ctx context.Context, filter donates.ListFilter, fn func(*donates.Donate) error) error {
+	unlock := s.lock(ctx)
+	list := s.filter(matchList(filter))
+	unlock()
+	sort.SliceStable(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	for i := range list {
+		err := fn(&list[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) CreateExportJob(ctx context.Context, job *donates.ExportJob) error {
+	defer s.lock(ctx)()
+	result := *job
+	s.jobs[job.ID] = &result
+	s.jobOrder = append(s.jobOrder, job.ID)
+	return nil
+}
+
+// Only known fields of the job are updated
+func (s *Storage) UpdateExportJob(ctx context.Context, id string, update map[string]interface{}) error {
+	defer s.lock(ctx)()
+	job, ok := s.jobs[id]
+	if !ok {
+		return errNotFound("export job")
+	}
+	data, err := bson.Marshal(job)
+	if err != nil {
+		return dberror.ErrInternal("can't marshal export job: %s", err)
+	}
+	doc := bson.M{}
+	err = bson.Unmarshal(data, &doc)
+	if err != nil {
+		return dberror.ErrInternal("can't unmarshal export job: %s", err)
+	}
+	for key, value := range update {
+		doc[key] = value
+	}
+	data, err = bson.Marshal(doc)
+	if err != nil {
+		return dberror.ErrInternal("can't marshal update: %s", err)
+	}
+	updated := donates.ExportJob{}
+	err = bson.Unmarshal(data, &updated)
+	if err != nil {
+		return dberror.ErrInternal("can't apply update: %s", err)
+	}
+	s.jobs[id] = &updated
+	return nil
+}
+
+func (s *Storage) GetExportJob(ctx context.Context, id string) (*donates.ExportJob, error) {
+	defer s.lock(ctx)()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, errNotFound("export job")
+	}
+	result := *job
+	return &result, nil
+}
+
+// Take the oldest queued job, jobs of equal creation time in order of creation
+func (s *Storage) ClaimExportJob(ctx context.Context) (*donates.ExportJob, error) {
+	defer s.lock(ctx)()
+	var oldest *donates.ExportJob
+	for _, id := range s.jobOrder {
+		job := s.jobs[id]
+		if job.Status == donates.ExportQueued && (oldest == nil || job.CreatedAt.Before(oldest.CreatedAt)) {
+			oldest = job
+		}
+	}
+	if oldest == nil {
+		return nil, nil
+	}
+	oldest.Status = donates.ExportRunning
+	oldest.Heartbeat = s.clock.Now()
+	result := *oldest
+	return &result, nil
+}
+
+func (s *Storage) ReapExportJobs(ctx context.Context, before time.Time) (int64, error) {
+	defer s.lock(ctx)()
+	var count int64
+	for _, job := range s.jobs {
+		if job.Status == donates.ExportRunning && job.Heartbeat.Before(before) {
+			job.Status = donates.ExportFailed
+			job.Error = "export interrupted"
+			job.FinishedAt = s.clock.Now()
+			count++
+		}
+	}
+	return count, nil
+}
+
+// exportFile keeps written data in memory until it's closed
+type exportFile struct {
+	storage *Storage
+	id      string
+	buf     bytes.Buffer
+}
+
+func (f *exportFile) Write(p []byte) (int, error) {
+	return f.buf.Write(p)
+}
+
+func (f *exportFile) Close() error {
+	f.storage.mu.Lock()
+	defer f.storage.mu.Unlock()
+	f.storage.files[f.id] = f.buf.Bytes()
+	return nil
+}
+
+func (f *exportFile) Abort() error {
+	f.buf.Reset()
+	return nil
+}
+
+func (f *exportFile) ID() interface{} {
+	return f.id
+}
+
+func (s *Storage) OpenExportUpload(ctx context.Context, name string) (storage.ExportFile, error) {
+	return &exportFile{storage: s, id: name}, nil
+}
+
+func (s *Storage) OpenExportDownload(ctx context.Context, fileID interface{}) (io.ReadCloser, error) {
+	defer s.lock(ctx)()
+	id, _ := fileID.(string)
+	data, ok := s.files[id]
+	if !ok {
+		return nil, errNotFound("export file")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *Storage) AddEvent(ctx context.Context, evt *lifecycle.Event) error {
+	defer s.lock(ctx)()
+	s.outbox = append(s.outbox, outboxEntry{event: *evt})
+	return nil
+}
+
+// Events are claimed in order of saving, claim token isn't needed to find them
+func (s *Storage) ClaimEvents(ctx context.Context, claim string, limit int64, lease time.Duration) ([]lifecycle.Event, error) {
+	defer s.lock(ctx)()
+	now := s.clock.Now()
+	result := make([]lifecycle.Event, 0)
+	for i := range s.outbox {
+		if int64(len(result)) == limit {
+			break
+		}
+		entry := &s.outbox[i]
+		if !entry.sent && !entry.claimedUntil.After(now) {
+			entry.claimedUntil = now.Add(lease)
+			result = append(result, entry.event)
+		}
+	}
+	return result, nil
+}
+
+func (s *Storage) MarkEventSent(ctx context.Context, id string) error {
+	defer s.lock(ctx)()
+	for i := range s.outbox {
+		if s.outbox[i].event.ID == id {
+			s.outbox[i].sent = true
+		}
+	}
+	return nil
+}
+
+func (s *Storage) AddPaymentRequest(ctx context.Context, donateID string) error {
+	defer s.lock(ctx)()
+	for _, request := range s.payments {
+		if request.donate == donateID {
+			return dberror.ErrInternal("payment of donate %s is already requested", donateID)
+		}
+	}
+	s.payments = append(s.payments, paymentRequest{donate: donateID})
+	return nil
+}
+
+func (s *Storage) ClaimPaymentRequests(ctx context.Context, claim string, limit int64, lease time.Duration) ([]string, error) {
+	defer s.lock(ctx)()
+	now := s.clock.Now()
+	result := make([]string, 0)
+	for i := range s.payments {
+		if int64(len(result)) == limit {
+			break
+		}
+		request := &s.payments[i]
+		if !request.sent && !request.claimedUntil.After(now) {
+			request.claimedUntil = now.Add(lease)
+			result = append(result, request.donate)
+		}
+	}
+	return result, nil
+}
+
+func (s *Storage) MarkPaymentRequested(ctx context.Context, donateID string) error {
+	defer s.lock(ctx)()
+	for i := range s.payments {
+		if s.payments[i].donate == donateID {
+			s.payments[i].sent = true
+		}
+	}
+	return nil
+}
+
+// Events saved to outbox, both sent and unsent
+func (s *Storage) Events() []lifecycle.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]lifecycle.Event, 0, len(s.outbox))
+	for _, entry := range s.outbox {
+		result = append(result, entry.event)
+	}
+	return result
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.PingErr
+}
@@ -0,0 +1,102 @@
+package donates
+
+import (
+	"errors"
+	"net/http"
+	"tempproj/pkg/error/svcerror"
+)
+
+// ErrorKind is a class of rejection transports map to their own status
+type ErrorKind int
+
+const (
+	// Request can't be done as it is
+	KindInvalid ErrorKind = iota
+	// Session has no user
+	KindUnauthenticated
+	// User isn't allowed to do it
+	KindForbidden
+	// Referenced user, post or donate doesn't exist
+	KindNotFound
+	// Current state of the donate doesn't allow it
+	KindConflict
+	// User sends requests too often
+	KindRateLimited
+)
+
+// Error is a rejection of the request. Code is stable, clients tell
+// rejections apart by it.
+type Error struct {
+	Kind    ErrorKind
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Unwrap to svcerror with status of the kind, so transports that know only
+// svcerror still tell rejections apart and don't report them as internal
+func (e *Error) Unwrap() error {
+	return &svcerror.Error{Code: e.Kind.Status(), Msg: e.Message}
+}
+
+// HTTP status of the kind, svcerror codes are HTTP statuses
+func (k ErrorKind) Status() int {
+	switch k {
+	case KindUnauthenticated:
+		return http.StatusUnauthorized
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindConflict:
+		return http.StatusConflict
+	case KindRateLimited:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusBadRequest
+}
+
+// Reasons to reject a donate. Every rejection has its own error so clients
+// and callers can tell them apart.
+var (
+	ErrUnauthenticated = &Error{KindUnauthenticated, "donate_unauthenticated", "sender isn't authenticated"}
+	ErrSelfDonate      = &Error{KindForbidden, "donate_self", "can't donate to yourself"}
+	ErrDonorBanned     = &Error{KindForbidden, "donate_donor_banned", "sender account is banned"}
+	ErrRecipientBanned = &Error{KindForbidden, "donate_recipient_banned", "recipient account is banned"}
+	ErrDonorBlocked    = &Error{KindForbidden, "donate_blocked", "sender is blocked by recipient"}
+
+	ErrRecipientNotFound = &Error{KindNotFound, "donate_recipient_not_found", "recipient doesn't exist"}
+	ErrDonationsDisabled = &Error{KindForbidden, "donate_disabled", "recipient doesn't accept donations"}
+	ErrPostNotFound      = &Error{KindNotFound, "donate_post_not_found", "post doesn't exist"}
+	ErrPostAuthor        = &Error{KindInvalid, "donate_post_author", "post doesn't belong to recipient"}
+
+	ErrDonateDenied = &Error{KindForbidden, "donate_denied", "donate is rejected by risk checks"}
+	ErrNotInReview  = &Error{KindConflict, "donate_not_in_review", "donate isn't waiting for review"}
+
+	ErrNotDonateOwner = &Error{KindForbidden, "donate_not_owner", "donate doesn't belong to user"}
+	ErrNotPending     = &Error{KindConflict, "donate_not_pending", "donate isn't waiting for payment"}
+	ErrNotConfirmed   = &Error{KindConflict, "donate_not_confirmed", "donate isn't confirmed"}
+
+	ErrVersionConflict = &Error{KindConflict, "donate_conflict", "donate was changed concurrently"}
+	ErrBadTransition   = &Error{KindConflict, "donate_bad_transition", "donate can't move from its status to the new one"}
+	ErrDonationsHidden = &Error{KindForbidden, "donate_hidden", "user's donations are hidden"}
+	ErrRateLimited     = &Error{KindRateLimited, "donate_rate_limited", "too many requests"}
+	ErrNotModerator    = &Error{KindForbidden, "donate_not_moderator", "user is not allowed to moderate donates"}
+	ErrStatsRebuilding = &Error{KindConflict, "donate_stats_rebuilding", "donation stats are being rebuilt"}
+)
+
+// Return code of rejection error, "other" for the rest of errors and empty
+// string for nil
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var rejection *Error
+	if errors.As(err, &rejection) {
+		return rejection.Code
+	}
+	return "other"
+}
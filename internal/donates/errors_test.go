@@ -0,0 +1,32 @@
+package donates
+
+import (
+	"errors"
+	"net/http"
+	"tempproj/pkg/error/svcerror"
+	"testing"
+)
+
+func TestErrorUnwrapsToStatusOfKind(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+	}{
+		{ErrPostAuthor, http.StatusBadRequest},
+		{ErrUnauthenticated, http.StatusUnauthorized},
+		{ErrSelfDonate, http.StatusForbidden},
+		{ErrRecipientNotFound, http.StatusNotFound},
+		{ErrNotPending, http.StatusConflict},
+		{ErrRateLimited, http.StatusTooManyRequests},
+	}
+	for _, c := range cases {
+		var svcErr *svcerror.Error
+		if !errors.As(c.err, &svcErr) {
+			t.Errorf("%s doesn't unwrap to svcerror", c.err)
+			continue
+		}
+		if svcErr.Code != c.status {
+			t.Errorf("%s has code %d, want %d", c.err, svcErr.Code, c.status)
+		}
+	}
+}
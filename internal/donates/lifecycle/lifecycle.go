@@ -0,0 +1,125 @@
+// Package lifecycle defines versioned schema of donate lifecycle events
+// published to DONATE_EVENTS topic. Consumers must ignore unknown fields
+// and event types, and drop events with already seen ID (at-least-once delivery).
+package lifecycle
+
+import (
+	"encoding/json"
+	"tempproj/internal/donates"
+	"time"
+)
+
+const (
+	Topic = "DONATE_EVENTS"
+	// Increased on incompatible schema changes only
+	Version = 1
+)
+
+type Type string
+
+const (
+	Created   Type = "donate.created"
+	Held      Type = "donate.held"
+	Denied    Type = "donate.denied"
+	Approved  Type = "donate.approved"
+	Pending   Type = "donate.pending"
+	Confirmed Type = "donate.confirmed"
+	Failed    Type = "donate.failed"
+	Refunded  Type = "donate.refunded" // reserved, payments don't report refunds yet
+)
+
+// NoStatus is PrevStatus of created donate
+const NoStatus = -1
+
+// Transition of donate yields at most this many events, Seq of the first one
+// is version of the changed donate times seqStep
+const seqStep = 2
+
+type Event struct {
+	Version int    `bson:"version" json:"version"`
+	ID      string `bson:"id" json:"id"` // dedupe key
+	Type    Type   `bson:"type" json:"type"`
+
+	DonateID   string    `bson:"donate" json:"donate"`
+	From       string    `bson:"from" json:"from"`
+	To         string    `bson:"to" json:"to"`
+	Post       string    `bson:"post,omitempty" json:"post,omitempty"`
+	Amount     uint64    `bson:"amount" json:"amount"`
+	Status     int       `bson:"status" json:"status"`
+	PrevStatus int       `bson:"prev_status" json:"prev_status"`
+	OccurredAt time.Time `bson:"occurred" json:"occurred"`
+	// Orders events of the donate, events of one transition share OccurredAt.
+	// Grows with every event of the donate but has gaps.
+	Seq int64 `bson:"seq" json:"seq"`
+}
+
+// Return event type of transition to the status
+func TypeOf(prev int, status donates.Status) Type {
+	switch status {
+	case donates.New:
+		if prev == int(donates.Review) {
+			return Approved
+		}
+		return Created
+	case donates.Review:
+		return Held
+	case donates.Denied:
+		return Denied
+	case donates.Pending:
+		return Pending
+	case donates.Confirmed:
+		return Confirmed
+	case donates.Failed:
+		return Failed
+	}
+	return ""
+}
+
+// Build events of donate's transition from prev status, none if status didn't
+// change. Donate created in review or denied gets Created event followed by
+// Held or Denied one, so every donate has Created event. Events get IDs of ids
+// and occur at current time of clock, Seq keeps their order.
+func New(clock donates.Clock, ids donates.IDGenerator, donate *donates.Donate, prev int) []*Event {
+	if prev == int(donate.Status) {
+		return nil
+	}
+	types := []Type{TypeOf(prev, donate.Status)}
+	if prev == NoStatus && types[0] != Created {
+		types = append([]Type{Created}, types...)
+	}
+	now := clock.Now()
+	result := make([]*Event, 0, len(types))
+	for i, evtType := range types {
+		if evtType == "" {
+			continue
+		}
+		result = append(result, &Event{
+			Version:    Version,
+			ID:         ids.NewID(),
+			Type:       evtType,
+			DonateID:   donate.ID,
+			From:       donate.From,
+			To:         donate.To,
+			Post:       donate.Post,
+			Amount:     donate.Amount,
+			Status:     int(donate.Status),
+			PrevStatus: prev,
+			OccurredAt: now,
+			Seq:        donate.Version*seqStep + int64(i),
+		})
+	}
+	return result
+}
+
+func Pack(evt *Event) ([]byte, error) {
+	return json.Marshal(evt)
+}
+
+func Unpack(data []byte) (*Event, error) {
+	evt := &Event{}
+	err := json.Unmarshal(data, evt)
+	if err != nil {
+		return nil, err
+	}
+	return evt, nil
+}
@@ -0,0 +1,167 @@
+package lifecycle
+
+import (
+	"fmt"
+	"reflect"
+	"tempproj/internal/donates"
+	"testing"
+	"time"
+)
+
+// Consumers depend on JSON of events, changing it needs a new Version
+const schemaV1 = `{"version":1,"id":"evt-1","type":"donate.confirmed","donate":"donate-1",` +
+	`"from":"donor","to":"author","post":"post-1","amount":5000,"status":2,"prev_status":1,` +
+	`"occurred":"2026-01-02T03:04:05Z","seq":4}`
+
+func schemaEvent() *Event {
+	return &Event{
+		Version:    1,
+		ID:         "evt-1",
+		Type:       Confirmed,
+		DonateID:   "donate-1",
+		From:       "donor",
+		To:         "author",
+		Post:       "post-1",
+		Amount:     5000,
+		Status:     2,
+		PrevStatus: 1,
+		OccurredAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Seq:        4,
+	}
+}
+
+func TestPackMatchesSchema(t *testing.T) {
+	data, err := Pack(schemaEvent())
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	if string(data) != schemaV1 {
+		t.Errorf("event schema changed\ngot:  %s\nwant: %s", data, schemaV1)
+	}
+}
+
+func TestUnpackSchema(t *testing.T) {
+	evt, err := Unpack([]byte(schemaV1))
+	if err != nil {
+		t.Fatalf("Unpack: %s", err)
+	}
+	if !reflect.DeepEqual(evt, schemaEvent()) {
+		t.Errorf("got %+v, want %+v", evt, schemaEvent())
+	}
+}
+
+func TestUnpackIgnoresUnknownFields(t *testing.T) {
+	data := `{"version":1,"id":"evt-1","type":"donate.refunded","donate":"donate-1","reason":"chargeback"}`
+	evt, err := Unpack([]byte(data))
+	if err != nil {
+		t.Fatalf("Unpack: %s", err)
+	}
+	if evt.Type != Refunded || evt.DonateID != "donate-1" {
+		t.Errorf("got %+v", evt)
+	}
+}
+
+func TestTypeNames(t *testing.T) {
+	names := map[Type]string{
+		Created:   "donate.created",
+		Held:      "donate.held",
+		Denied:    "donate.denied",
+		Approved:  "donate.approved",
+		Pending:   "donate.pending",
+		Confirmed: "donate.confirmed",
+		Failed:    "donate.failed",
+		Refunded:  "donate.refunded",
+	}
+	for evtType, name := range names {
+		if string(evtType) != name {
+			t.Errorf("type %q is renamed, consumers expect %q", evtType, name)
+		}
+	}
+}
+
+func eventTypes(events []*Event) []Type {
+	result := make([]Type, 0, len(events))
+	for _, evt := range events {
+		result = append(result, evt.Type)
+	}
+	return result
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+// Sequential IDs evt-1, evt-2, ...
+type seqIDs int
+
+func (s *seqIDs) NewID() string {
+	*s++
+	return fmt.Sprintf("evt-%d", *s)
+}
+
+func TestNew(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name   string
+		prev   int
+		status donates.Status
+		// Version of the changed donate
+		version int64
+		want    []Type
+	}{
+		{"created", NoStatus, donates.New, 0, []Type{Created}},
+		{"created in review", NoStatus, donates.Review, 0, []Type{Created, Held}},
+		{"created denied", NoStatus, donates.Denied, 0, []Type{Created, Denied}},
+		{"approved", int(donates.Review), donates.New, 1, []Type{Approved}},
+		{"rejected", int(donates.Review), donates.Denied, 1, []Type{Denied}},
+		{"pending", int(donates.New), donates.Pending, 1, []Type{Pending}},
+		{"confirmed", int(donates.Pending), donates.Confirmed, 2, []Type{Confirmed}},
+		{"failed", int(donates.Pending), donates.Failed, 2, []Type{Failed}},
+		{"unchanged", int(donates.Pending), donates.Pending, 3, []Type{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			donate := &donates.Donate{ID: "donate-1", From: "donor", To: "author", Amount: 5000, Status: tt.status, Version: tt.version}
+			ids := seqIDs(0)
+			events := New(fixedClock(now), &ids, donate, tt.prev)
+			got := eventTypes(events)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i, evt := range events {
+				if evt.Version != Version || evt.DonateID != donate.ID ||
+					evt.Status != int(tt.status) || evt.PrevStatus != tt.prev {
+					t.Errorf("bad event %+v", evt)
+				}
+				if id := fmt.Sprintf("evt-%d", i+1); evt.ID != id {
+					t.Errorf("event ID is %s, want %s", evt.ID, id)
+				}
+				if !evt.OccurredAt.Equal(now) {
+					t.Errorf("event occurred at %s, want %s", evt.OccurredAt, now)
+				}
+				// Events of one transition occur together, Seq keeps their order
+				if seq := tt.version*seqStep + int64(i); evt.Seq != seq {
+					t.Errorf("event seq is %d, want %d", evt.Seq, seq)
+				}
+			}
+		})
+	}
+}
+
+// Events of later transitions follow all events of earlier ones
+func TestSeqGrowsWithTransitions(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	ids := seqIDs(0)
+	donate := &donates.Donate{ID: "donate-1", Status: donates.Review}
+	events := New(fixedClock(now), &ids, donate, NoStatus)
+	donate.Version, donate.Status = 1, donates.New
+	events = append(events, New(fixedClock(now), &ids, donate, int(donates.Review))...)
+	donate.Version, donate.Status = 2, donates.Pending
+	events = append(events, New(fixedClock(now), &ids, donate, int(donates.New))...)
+	for i := 1; i < len(events); i++ {
+		if events[i].Seq <= events[i-1].Seq {
+			t.Errorf("%s has seq %d after %s with seq %d", events[i].Type, events[i].Seq,
+				events[i-1].Type, events[i-1].Seq)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package donates
+
+import (
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log fields of the donate, payment URL is left out as it grants access to the
+// payment form
+func (d *Donate) LogFields() logrus.Fields {
+	return logrus.Fields{
+		"donate_id": d.ID,
+		"from":      d.From,
+		"to":        d.To,
+		"amount":    d.Amount,
+		"status":    d.Status.String(),
+	}
+}
+
+// Level to log the error at. Rejections are expected and aren't errors of
+// the service.
+func LogLevel(err error) logrus.Level {
+	if ErrorCode(err) == "other" {
+		return logrus.ErrorLevel
+	}
+	return logrus.InfoLevel
+}
+
+// Keep only scheme and host of the URL, path and query carry payment tokens
+func RedactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "[redacted]"
+	}
+	return u.Scheme + "://" + u.Host + "/[redacted]"
+}
@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "donates"
+
+// Metrics of donates subsystem, registered in own registry
+type Metrics struct {
+	registry *prometheus.Registry
+
+	transitions     *prometheus.CounterVec
+	amounts         *prometheus.HistogramVec
+	makeDonate      prometheus.Histogram
+	makeDonateError *prometheus.CounterVec
+	queueWait       prometheus.Histogram
+	handlerDuration *prometheus.HistogramVec
+	storage         *prometheus.HistogramVec
+}
+
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) Transition(from, to string) {
+	m.transitions.WithLabelValues(from, to).Inc()
+}
+
+// Amount of donate that got the status
+func (m *Metrics) Amount(status string, amount uint64) {
+	m.amounts.WithLabelValues(status).Observe(float64(amount))
+}
+
+// Duration of MakeDonate, code is empty for successful calls
+func (m *Metrics) MakeDonate(start time.Time, code string) {
+	m.makeDonate.Observe(time.Since(start).Seconds())
+	if code != "" {
+		m.makeDonateError.WithLabelValues(code).Inc()
+	}
+}
+
+// Time payment update waited in worker queue since it was received
+func (m *Metrics) QueueWait(wait time.Duration) {
+	m.queueWait.Observe(wait.Seconds())
+}
+
+func (m *Metrics) Handled(start time.Time, result string) {
+	m.handlerDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// Observe duration of storage method
+func (m *Metrics) Storage(method string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.storage.WithLabelValues(method, result).Observe(time.Since(start).Seconds())
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "status_transitions_total",
+			Help:      "Donate status transitions.",
+		}, []string{"from", "to"}),
+		amounts: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "amount",
+			Help:      "Amounts of donates by status they got, in hundredths.",
+			Buckets:   prometheus.ExponentialBuckets(50*100, 2, 12),
+		}, []string{"status"}),
+		makeDonate: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "make_donate_duration_seconds",
+			Help:      "MakeDonate latency.",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		makeDonateError: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "make_donate_errors_total",
+			Help:      "Rejected and failed MakeDonate calls by error code.",
+		}, []string{"code"}),
+		queueWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "payment_update_queue_wait_seconds",
+			Help:      "Time from payment update being received from message queue to start of its handling.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 16),
+		}),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "payment_update_duration_seconds",
+			Help:      "Processing time of payment update.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"result"}),
+		storage: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "storage_duration_seconds",
+			Help:      "Mongo operation latency by storage method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "result"}),
+	}
+	m.registry.MustRegister(
+		m.transitions,
+		m.amounts,
+		m.makeDonate,
+		m.makeDonateError,
+		m.queueWait,
+		m.handlerDuration,
+		m.storage,
+	)
+	return m
+}
@@ -0,0 +1,82 @@
+package risk
+
+import (
+	"context"
+	"tempproj/internal/donates"
+
+	"github.com/sirupsen/logrus"
+)
+
+type Decision int
+
+const (
+	Allow  Decision = iota // donate looks fine
+	Review                 // donate is suspicious, hold it until manual review
+	Deny                   // donate is rejected
+)
+
+type Verdict struct {
+	Decision Decision
+	Rule     string
+	Reason   string
+}
+
+// Rule scores a new donate before payment is created
+type Rule interface {
+	Name() string
+	Check(ctx context.Context, donate *donates.Donate) (Verdict, error)
+}
+
+// FailureRecorder is implemented by rules that track failed payments
+type FailureRecorder interface {
+	RecordFailure(ctx context.Context, donate *donates.Donate) error
+}
+
+type Pipeline struct {
+	log     *logrus.Entry
+	onError Decision
+	rules   []Rule
+}
+
+// Run all rules and return the strictest verdict. Every rule is run even
+// after a deny, so rules that count donates see all of them. Failed rule gives
+// the pipeline's onError decision: Allow fails open, Review or Deny fail closed.
+func (p *Pipeline) Evaluate(ctx context.Context, donate *donates.Donate) Verdict {
+	result := Verdict{Decision: Allow}
+	for _, rule := range p.rules {
+		verdict, err := rule.Check(ctx, donate)
+		if err != nil {
+			p.log.WithFields(logrus.Fields{"rule": rule.Name(), "donate_id": donate.ID}).WithError(err).Error("risk rule failed")
+			verdict = Verdict{Decision: p.onError, Reason: "risk check failed"}
+		}
+		if verdict.Decision <= result.Decision {
+			continue
+		}
+		verdict.Rule = rule.Name()
+		result = verdict
+	}
+	return result
+}
+
+// Pass failed payment to rules that keep track of them
+func (p *Pipeline) RecordFailure(ctx context.Context, donate *donates.Donate) {
+	for _, rule := range p.rules {
+		recorder, ok := rule.(FailureRecorder)
+		if !ok {
+			continue
+		}
+		err := recorder.RecordFailure(ctx, donate)
+		if err != nil {
+			p.log.WithFields(logrus.Fields{"rule": rule.Name(), "donate_id": donate.ID}).WithError(err).Error("risk rule can't record failed payment")
+		}
+	}
+}
+
+// Create pipeline of the rules, onError is the decision of a rule that fails
+func NewPipeline(log *logrus.Entry, onError Decision, rules ...Rule) *Pipeline {
+	return &Pipeline{
+		log:     log,
+		onError: onError,
+		rules:   rules,
+	}
+}
@@ -0,0 +1,198 @@
+package risk
+
+import (
+	"context"
+	"fmt"
+	"tempproj/internal/donates"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const keyPrefix = "donates:risk:"
+
+// Increase counter, new counter expires after window
+var incrWindow = redis.NewScript(`
+local value = redis.call("INCR", KEYS[1])
+if value == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return value
+`)
+
+func incr(client *redis.Client, key string, window time.Duration) (int64, error) {
+	return incrWindow.Run(client, []string{key}, window.Milliseconds()).Int64()
+}
+
+// Accounts is a part of users.UseCase needed to check account age
+type Accounts interface {
+	CreatedAt(ctx context.Context, user string) (time.Time, error)
+}
+
+// Window limits number of events per period, zero limit is disabled
+type Window struct {
+	Period time.Duration
+	Review int64
+	Deny   int64
+}
+
+func (w Window) verdict(count int64, reason string) Verdict {
+	switch {
+	case w.Deny > 0 && count > w.Deny:
+		return Verdict{Decision: Deny, Reason: reason}
+	case w.Review > 0 && count > w.Review:
+		return Verdict{Decision: Review, Reason: reason}
+	}
+	return Verdict{Decision: Allow}
+}
+
+// Limits number of donates made by donor in every window
+type velocityRule struct {
+	redis   *redis.Client
+	windows []Window
+}
+
+func NewVelocityRule(client *redis.Client, windows ...Window) Rule {
+	return &velocityRule{redis: client, windows: windows}
+}
+
+func (r *velocityRule) Name() string { return "velocity" }
+
+func (r *velocityRule) Check(ctx context.Context, donate *donates.Donate) (Verdict, error) {
+	result := Verdict{Decision: Allow}
+	for _, w := range r.windows {
+		key := fmt.Sprintf("%svelocity:%s:%d", keyPrefix, donate.From, int64(w.Period.Seconds()))
+		count, err := incr(r.redis, key, w.Period)
+		if err != nil {
+			return result, err
+		}
+		verdict := w.verdict(count, fmt.Sprintf("%d donates in %s", count, w.Period))
+		if verdict.Decision > result.Decision {
+			result = verdict
+		}
+	}
+	return result, nil
+}
+
+// Limits donates of accounts younger than MinAge
+type newAccountRule struct {
+	redis     *redis.Client
+	accounts  Accounts
+	clock     donates.Clock
+	minAge    time.Duration
+	perDay    int64
+	maxAmount uint64
+}
+
+func NewNewAccountRule(client *redis.Client, accounts Accounts, clock donates.Clock, minAge time.Duration, perDay int64, maxAmount uint64) Rule {
+	return &newAccountRule{
+		redis:     client,
+		accounts:  accounts,
+		clock:     clock,
+		minAge:    minAge,
+		perDay:    perDay,
+		maxAmount: maxAmount,
+	}
+}
+
+func (r *newAccountRule) Name() string { return "new_account" }
+
+func (r *newAccountRule) Check(ctx context.Context, donate *donates.Donate) (Verdict, error) {
+	created, err := r.accounts.CreatedAt(ctx, donate.From)
+	if err != nil {
+		return Verdict{Decision: Allow}, err
+	}
+	if r.clock.Now().Sub(created) >= r.minAge {
+		return Verdict{Decision: Allow}, nil
+	}
+	count, err := incr(r.redis, keyPrefix+"new_account:"+donate.From, 24*time.Hour)
+	if err != nil {
+		return Verdict{Decision: Allow}, err
+	}
+	switch {
+	case count > r.perDay:
+		return Verdict{Decision: Deny, Reason: fmt.Sprintf("new account made %d donates today", count)}, nil
+	case donate.Amount > r.maxAmount:
+		return Verdict{Decision: Review, Reason: fmt.Sprintf("new account donates %d", donate.Amount)}, nil
+	}
+	return Verdict{Decision: Allow}, nil
+}
+
+// Holds donors with many failed payments
+type failedPaymentsRule struct {
+	redis  *redis.Client
+	window Window
+}
+
+func NewFailedPaymentsRule(client *redis.Client, window Window) Rule {
+	return &failedPaymentsRule{redis: client, window: window}
+}
+
+func (r *failedPaymentsRule) Name() string { return "failed_payments" }
+
+func (r *failedPaymentsRule) key(user string) string {
+	return keyPrefix + "failed:" + user
+}
+
+func (r *failedPaymentsRule) Check(ctx context.Context, donate *donates.Donate) (Verdict, error) {
+	count, err := r.redis.Get(r.key(donate.From)).Int64()
+	if err == redis.Nil {
+		return Verdict{Decision: Allow}, nil
+	}
+	if err != nil {
+		return Verdict{Decision: Allow}, err
+	}
+	// Current donate is going to be the next attempt
+	return r.window.verdict(count+1, fmt.Sprintf("%d failed payments in %s", count, r.window.Period)), nil
+}
+
+func (r *failedPaymentsRule) RecordFailure(ctx context.Context, donate *donates.Donate) error {
+	_, err := incr(r.redis, r.key(donate.From), r.window.Period)
+	return err
+}
+
+// Catches unusual amounts: series of minimal donates (card testing) and huge donates
+type amountAnomalyRule struct {
+	redis     *redis.Client
+	minAmount uint64
+	minimal   Window
+	maxAmount uint64
+}
+
+func NewAmountAnomalyRule(client *redis.Client, minAmount uint64, minimal Window, maxAmount uint64) Rule {
+	return &amountAnomalyRule{
+		redis:     client,
+		minAmount: minAmount,
+		minimal:   minimal,
+		maxAmount: maxAmount,
+	}
+}
+
+func (r *amountAnomalyRule) Name() string { return "amount_anomaly" }
+
+func (r *amountAnomalyRule) Check(ctx context.Context, donate *donates.Donate) (Verdict, error) {
+	if r.maxAmount > 0 && donate.Amount > r.maxAmount {
+		return Verdict{Decision: Review, Reason: fmt.Sprintf("amount %d is over %d", donate.Amount, r.maxAmount)}, nil
+	}
+	if donate.Amount > r.minAmount {
+		return Verdict{Decision: Allow}, nil
+	}
+	count, err := incr(r.redis, keyPrefix+"minimal:"+donate.From, r.minimal.Period)
+	if err != nil {
+		return Verdict{Decision: Allow}, err
+	}
+	return r.minimal.verdict(count, fmt.Sprintf("%d minimal donates in %s", count, r.minimal.Period)), nil
+}
+
+// Rules used by donates service
+func DefaultRules(client *redis.Client, accounts Accounts, clock donates.Clock, minAmount uint64) []Rule {
+	return []Rule{
+		NewVelocityRule(client,
+			Window{Period: time.Minute, Review: 3, Deny: 10},
+			Window{Period: time.Hour, Review: 20, Deny: 60},
+		),
+		NewNewAccountRule(client, accounts, clock, 24*time.Hour, 5, 100*minAmount),
+		NewFailedPaymentsRule(client, Window{Period: time.Hour, Review: 3, Deny: 10}),
+		NewAmountAnomalyRule(client, minAmount, Window{Period: time.Hour, Review: 3, Deny: 5}, 1000*minAmount),
+	}
+}
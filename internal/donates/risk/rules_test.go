@@ -0,0 +1,175 @@
+package risk
+
+import (
+	"context"
+	"tempproj/internal/donates"
+	"tempproj/internal/donates/donatestest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+func newTestRedis(t *testing.T) (*redis.Client, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client, server
+}
+
+func newClock() *donatestest.Clock {
+	return donatestest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// Run donates through the rule and return verdict of the last one
+func checkAll(t *testing.T, rule Rule, list ...*donates.Donate) Verdict {
+	t.Helper()
+	var verdict Verdict
+	for _, donate := range list {
+		var err error
+		verdict, err = rule.Check(context.Background(), donate)
+		if err != nil {
+			t.Fatalf("%s: %s", rule.Name(), err)
+		}
+	}
+	return verdict
+}
+
+func repeat(n int, donate *donates.Donate) []*donates.Donate {
+	list := make([]*donates.Donate, n)
+	for i := range list {
+		list[i] = donate
+	}
+	return list
+}
+
+func TestVelocityRule(t *testing.T) {
+	donate := &donates.Donate{From: "donor", To: "author", Amount: 100}
+	cases := []struct {
+		name  string
+		count int
+		// Time between the first and the last donate
+		spread time.Duration
+		want   Decision
+	}{
+		{"under review limit", 3, 0, Allow},
+		{"over review limit", 4, 0, Review},
+		{"over deny limit", 11, 0, Deny},
+		{"window expired", 4, time.Minute, Allow},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, server := newTestRedis(t)
+			rule := NewVelocityRule(client, Window{Period: time.Minute, Review: 3, Deny: 10})
+			checkAll(t, rule, repeat(c.count-1, donate)...)
+			server.FastForward(c.spread)
+			if verdict := checkAll(t, rule, donate); verdict.Decision != c.want {
+				t.Errorf("got %v (%s), want %v", verdict.Decision, verdict.Reason, c.want)
+			}
+		})
+	}
+}
+
+func TestNewAccountRule(t *testing.T) {
+	clock := newClock()
+	cases := []struct {
+		name   string
+		age    time.Duration
+		count  int
+		amount uint64
+		want   Decision
+	}{
+		{"old account", 48 * time.Hour, 10, 10000, Allow},
+		{"new account", time.Hour, 1, 100, Allow},
+		{"new account over amount", time.Hour, 1, 1001, Review},
+		{"new account over daily limit", time.Hour, 6, 100, Deny},
+		{"account just aged", 24 * time.Hour, 10, 10000, Allow},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _ := newTestRedis(t)
+			users := donatestest.NewUsers()
+			users.Add(clock.Now().Add(-c.age), "donor")
+			rule := NewNewAccountRule(client, users, clock, 24*time.Hour, 5, 1000)
+			donate := &donates.Donate{From: "donor", To: "author", Amount: c.amount}
+			if verdict := checkAll(t, rule, repeat(c.count, donate)...); verdict.Decision != c.want {
+				t.Errorf("got %v (%s), want %v", verdict.Decision, verdict.Reason, c.want)
+			}
+		})
+	}
+}
+
+func TestNewAccountRuleUsesClock(t *testing.T) {
+	clock := newClock()
+	client, _ := newTestRedis(t)
+	users := donatestest.NewUsers()
+	users.Add(clock.Now(), "donor")
+	rule := NewNewAccountRule(client, users, clock, 24*time.Hour, 5, 1000)
+	donate := &donates.Donate{From: "donor", To: "author", Amount: 1001}
+	if verdict := checkAll(t, rule, donate); verdict.Decision != Review {
+		t.Fatalf("got %v for new account, want review", verdict.Decision)
+	}
+	clock.Advance(24 * time.Hour)
+	if verdict := checkAll(t, rule, donate); verdict.Decision != Allow {
+		t.Errorf("got %v after a day, want allow", verdict.Decision)
+	}
+}
+
+func TestFailedPaymentsRule(t *testing.T) {
+	donate := &donates.Donate{From: "donor", To: "author", Amount: 100}
+	cases := []struct {
+		name     string
+		failures int
+		spread   time.Duration
+		want     Decision
+	}{
+		{"no failures", 0, 0, Allow},
+		{"under review limit", 2, 0, Allow},
+		{"over review limit", 3, 0, Review},
+		{"over deny limit", 10, 0, Deny},
+		{"window expired", 10, time.Hour, Allow},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, server := newTestRedis(t)
+			rule := NewFailedPaymentsRule(client, Window{Period: time.Hour, Review: 3, Deny: 10})
+			for i := 0; i < c.failures; i++ {
+				err := rule.(FailureRecorder).RecordFailure(context.Background(), donate)
+				if err != nil {
+					t.Fatalf("RecordFailure: %s", err)
+				}
+			}
+			server.FastForward(c.spread)
+			if verdict := checkAll(t, rule, donate); verdict.Decision != c.want {
+				t.Errorf("got %v (%s), want %v", verdict.Decision, verdict.Reason, c.want)
+			}
+		})
+	}
+}
+
+func TestAmountAnomalyRule(t *testing.T) {
+	cases := []struct {
+		name   string
+		amount uint64
+		count  int
+		want   Decision
+	}{
+		{"usual amount", 500, 10, Allow},
+		{"few minimal donates", 100, 3, Allow},
+		{"series of minimal donates", 100, 4, Review},
+		{"long series of minimal donates", 100, 6, Deny},
+		{"huge amount", 100001, 1, Review},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, _ := newTestRedis(t)
+			rule := NewAmountAnomalyRule(client, 100, Window{Period: time.Hour, Review: 3, Deny: 5}, 100000)
+			donate := &donates.Donate{From: "donor", To: "author", Amount: c.amount}
+			if verdict := checkAll(t, rule, repeat(c.count, donate)...); verdict.Decision != c.want {
+				t.Errorf("got %v (%s), want %v", verdict.Decision, verdict.Reason, c.want)
+			}
+		})
+	}
+}
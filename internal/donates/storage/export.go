@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"tempproj/internal/donates"
+	"tempproj/pkg/error/dberror"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func listQuery(filter donates.ListFilter) bson.M {
+	query := bson.M{"from": filter.User}
+	if filter.Direction == donates.Received {
+		query = bson.M{"to": filter.User}
+	}
+	if len(filter.Statuses) != 0 {
+		query["status"] = bson.M{"$in": filter.Statuses}
+	}
+	created := bson.M{}
+	if !filter.Since.IsZero() {
+		created["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		created["$lt"] = filter.Until
+	}
+	if len(created) != 0 {
+		query["created"] = created
+	}
+	return query
+}
+
+func (s *storageImpl) Count(ctx context.Context, filter donates.ListFilter) (int64, error) {
+	result, err := s.donates.CountDocuments(ctx, listQuery(filter))
+	if err != nil {
+		return 0, dberror.ErrMongoHandle(err, "mongo.Count err: %s", err)
+	}
+	return result, nil
+}
+
+// Call fn for every donate matched by filter in creation order, donates are
+// read from cursor one by one
+func (s *storageImpl) Iterate(ctx context.Context, filter donates.ListFilter, fn func(*donates.Donate) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: 1}})
+	cursor, err := s.donates.Find(ctx, listQuery(filter), opts)
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.Find err: %s", err)
+	}
+	defer cursor.Close(nil)
+	for cursor.Next(ctx) {
+		donate := &donates.Donate{}
+		err = cursor.Decode(donate)
+		if err != nil {
+			return dberror.ErrInternal("can't decode donate: %s", err)
+		}
+		err = fn(donate)
+		if err != nil {
+			return err
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return dberror.ErrMongoHandle(err, "cursor err: %s", err)
+	}
+	return nil
+}
+
+func (s *storageImpl) CreateExportJob(ctx context.Context, job *donates.ExportJob) error {
+	_, err := s.exports.InsertOne(ctx, job)
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.InsertOne err: %s", err)
+	}
+	return nil
+}
+
+func (s *storageImpl) UpdateExportJob(ctx context.Context, id string, update map[string]interface{}) error {
+	_, err := s.exports.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": update})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.UpdateOne err: %s", err)
+	}
+	return nil
+}
+
+func (s *storageImpl) GetExportJob(ctx context.Context, id string) (*donates.ExportJob, error) {
+	job := &donates.ExportJob{}
+	err := s.exports.FindOne(ctx, bson.M{"id": id}).Decode(job)
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.FindOne err: %s", err)
+	}
+	return job, nil
+}
+
+// Take the oldest queued job and mark it running, returns nil if queue is empty
+func (s *storageImpl) ClaimExportJob(ctx context.Context) (*donates.ExportJob, error) {
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "created", Value: 1}}).
+		SetReturnDocument(options.After)
+	job := &donates.ExportJob{}
+	err := s.exports.FindOneAndUpdate(
+		ctx,
+		bson.M{"status": donates.ExportQueued},
+		bson.M{"$set": bson.M{"status": donates.ExportRunning, "heartbeat": s.clock.Now()}},
+		opts,
+	).Decode(job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.FindOneAndUpdate err: %s", err)
+	}
+	return job, nil
+}
+
+// Fail running jobs without heartbeat since the time, their workers are dead
+func (s *storageImpl) ReapExportJobs(ctx context.Context, before time.Time) (int64, error) {
+	now := s.clock.Now()
+	result, err := s.exports.UpdateMany(
+		ctx,
+		bson.M{
+			"status": donates.ExportRunning,
+			"$or": bson.A{
+				bson.M{"heartbeat": bson.M{"$lt": before}},
+				bson.M{"heartbeat": bson.M{"$exists": false}},
+			},
+		},
+		bson.M{"$set": bson.M{"status": donates.ExportFailed, "error": "export interrupted", "finished": now}},
+	)
+	if err != nil {
+		return 0, dberror.ErrMongoHandle(err, "mongo.UpdateMany err: %s", err)
+	}
+	return result.ModifiedCount, nil
+}
+
+// ExportFile is export result being written. Data is kept on Close and
+// dropped on Abort, ID of the file is known after Close.
+type ExportFile interface {
+	io.WriteCloser
+	Abort() error
+	ID() interface{}
+}
+
+type gridfsExport struct {
+	stream *gridfs.UploadStream
+}
+
+func (f *gridfsExport) Write(p []byte) (int, error) {
+	return f.stream.Write(p)
+}
+
+func (f *gridfsExport) Close() error {
+	return f.stream.Close()
+}
+
+func (f *gridfsExport) Abort() error {
+	return f.stream.Abort()
+}
+
+func (f *gridfsExport) ID() interface{} {
+	return f.stream.FileID
+}
+
+// Open GridFS file for export result
+func (s *storageImpl) OpenExportUpload(ctx context.Context, name string) (ExportFile, error) {
+	bucket, err := s.exportFiles()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := bucket.OpenUploadStream(name)
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "gridfs.OpenUploadStream err: %s", err)
+	}
+	return &gridfsExport{stream: stream}, nil
+}
+
+func (s *storageImpl) OpenExportDownload(ctx context.Context, fileID interface{}) (io.ReadCloser, error) {
+	bucket, err := s.exportFiles()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := bucket.OpenDownloadStream(fileID)
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "gridfs.OpenDownloadStream err: %s", err)
+	}
+	return stream, nil
+}
+
+func (s *storageImpl) exportFiles() (*gridfs.Bucket, error) {
+	bucket, err := gridfs.NewBucket(s.exports.Database(), options.GridFSBucket().SetName("donate_exports"))
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "gridfs.NewBucket err: %s", err)
+	}
+	return bucket, nil
+}
+
+func (s *storageImpl) ensureExportIndexes(ctx context.Context) error {
+	_, err := s.exports.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "created", Value: 1}},
+	})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.CreateIndex err: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package storage
+
+import (
+	"tempproj/internal/donates"
+
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Create storage on the database, so every test gets its own one
+func NewOnDatabase(log *logrus.Entry, db *mongo.Database, clock donates.Clock) (Storage, error) {
+	return newStorage(log, db, clock)
+}
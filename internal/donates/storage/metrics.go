@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"tempproj/internal/donates"
+	"tempproj/internal/donates/lifecycle"
+	"tempproj/internal/donates/metrics"
+	"tempproj/internal/donates/tracing"
+	"tempproj/internal/types"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumented reports latency of every storage method and traces it
+type instrumented struct {
+	next    Storage
+	metrics *metrics.Metrics
+}
+
+// Wrap storage with metrics and tracing spans
+func Instrument(next Storage, m *metrics.Metrics) Storage {
+	return &instrumented{
+		next:    next,
+		metrics: m,
+	}
+}
+
+func (s *instrumented) startSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "storage."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", "mongodb")),
+	)
+}
+
+func (s *instrumented) observe(method string, start time.Time, span trace.Span, err error) {
+	s.metrics.Storage(method, start, err)
+	tracing.End(span, err)
+}
+
+func (s *instrumented) Create(ctx context.Context, donate *donates.Donate, hook Mutation) error {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "Create")
+	err := s.next.Create(ctx, donate, hook)
+	s.observe("Create", start, span, err)
+	return err
+}
+
+func (s *instrumented) GetByUser(ctx context.Context, user string) ([]donates.Donate, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetByUser")
+	result, err := s.next.GetByUser(ctx, user)
+	s.observe("GetByUser", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) GetByID(ctx context.Context, id string) (*donates.Donate, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetByID")
+	result, err := s.next.GetByID(ctx, id)
+	s.observe("GetByID", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) GetByIDs(ctx context.Context, ids []string, projection donates.Projection) ([]donates.Donate, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetByIDs")
+	result, err := s.next.GetByIDs(ctx, ids, projection)
+	s.observe("GetByIDs", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) List(ctx context.Context, filter donates.ListFilter, page types.PageOpt) ([]donates.Donate, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "List")
+	result, err := s.next.List(ctx, filter, page)
+	s.observe("List", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) GetNumber(ctx context.Context, user string) (int64, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetNumber")
+	result, err := s.next.GetNumber(ctx, user)
+	s.observe("GetNumber", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) GetDonators(ctx context.Context, uniq string, filter map[string]interface{}) ([]string, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetDonators")
+	result, err := s.next.GetDonators(ctx, uniq, filter)
+	s.observe("GetDonators", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) GetDonatesSum(ctx context.Context, user string) (int64, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetDonatesSum")
+	result, err := s.next.GetDonatesSum(ctx, user)
+	s.observe("GetDonatesSum", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) Update(ctx context.Context, donateID string, version int64, update map[string]interface{}, hook Mutation) (*donates.Donate, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "Update")
+	result, err := s.next.Update(ctx, donateID, version, update, hook)
+	s.observe("Update", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) ApplyToStats(ctx context.Context, donate *donates.Donate) (bool, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "ApplyToStats")
+	result, err := s.next.ApplyToStats(ctx, donate)
+	s.observe("ApplyToStats", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) GetStats(ctx context.Context, user string) (*donates.Stats, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetStats")
+	result, err := s.next.GetStats(ctx, user)
+	s.observe("GetStats", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) RebuildStats(ctx context.Context) error {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "RebuildStats")
+	err := s.next.RebuildStats(ctx)
+	s.observe("RebuildStats", start, span, err)
+	return err
+}
+
+func (s *instrumented) StatsBuilt(ctx context.Context) (bool, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "StatsBuilt")
+	result, err := s.next.StatsBuilt(ctx)
+	s.observe("StatsBuilt", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) ApplyPendingStats(ctx context.Context) (int64, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "ApplyPendingStats")
+	result, err := s.next.ApplyPendingStats(ctx)
+	s.observe("ApplyPendingStats", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) GetPrivacy(ctx context.Context, user string) (*donates.Privacy, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetPrivacy")
+	result, err := s.next.GetPrivacy(ctx, user)
+	s.observe("GetPrivacy", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) SetPrivacy(ctx context.Context, user string, update donates.PrivacyUpdate) (*donates.Privacy, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "SetPrivacy")
+	result, err := s.next.SetPrivacy(ctx, user, update)
+	s.observe("SetPrivacy", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) GetByStatus(ctx context.Context, status donates.Status, filter donates.ReviewFilter, page types.PageOpt) ([]donates.Donate, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetByStatus")
+	result, err := s.next.GetByStatus(ctx, status, filter, page)
+	s.observe("GetByStatus", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) UpdateIfStatus(ctx context.Context, donateID string, status donates.Status, update map[string]interface{}, hook Mutation) (*donates.Donate, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "UpdateIfStatus")
+	result, err := s.next.UpdateIfStatus(ctx, donateID, status, update, hook)
+	s.observe("UpdateIfStatus", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) AddDecision(ctx context.Context, decision *donates.ModerationDecision) error {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "AddDecision")
+	err := s.next.AddDecision(ctx, decision)
+	s.observe("AddDecision", start, span, err)
+	return err
+}
+
+func (s *instrumented) GetDecisions(ctx context.Context, donateID string) ([]donates.ModerationDecision, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetDecisions")
+	result, err := s.next.GetDecisions(ctx, donateID)
+	s.observe("GetDecisions", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) CreateReceipt(ctx context.Context, receipt *donates.Receipt) (*donates.Receipt, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "CreateReceipt")
+	result, err := s.next.CreateReceipt(ctx, receipt)
+	s.observe("CreateReceipt", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) GetReceipt(ctx context.Context, donateID string) (*donates.Receipt, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetReceipt")
+	result, err := s.next.GetReceipt(ctx, donateID)
+	s.observe("GetReceipt", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) Count(ctx context.Context, filter donates.ListFilter) (int64, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "Count")
+	result, err := s.next.Count(ctx, filter)
+	s.observe("Count", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) Iterate(ctx context.Context, filter donates.ListFilter, fn func(*donates.Donate) error) error {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "Iterate")
+	err := s.next.Iterate(ctx, filter, fn)
+	s.observe("Iterate", start, span, err)
+	return err
+}
+
+func (s *instrumented) CreateExportJob(ctx context.Context, job *donates.ExportJob) error {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "CreateExportJob")
+	err := s.next.CreateExportJob(ctx, job)
+	s.observe("CreateExportJob", start, span, err)
+	return err
+}
+
+func (s *instrumented) UpdateExportJob(ctx context.Context, id string, update map[string]interface{}) error {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "UpdateExportJob")
+	err := s.next.UpdateExportJob(ctx, id, update)
+	s.observe("UpdateExportJob", start, span, err)
+	return err
+}
+
+func (s *instrumented) GetExportJob(ctx context.Context, id string) (*donates.ExportJob, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetExportJob")
+	result, err := s.next.GetExportJob(ctx, id)
+	s.observe("GetExportJob", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) ClaimExportJob(ctx context.Context) (*donates.ExportJob, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "ClaimExportJob")
+	result, err := s.next.ClaimExportJob(ctx)
+	s.observe("ClaimExportJob", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) ReapExportJobs(ctx context.Context, before time.Time) (int64, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "ReapExportJobs")
+	result, err := s.next.ReapExportJobs(ctx, before)
+	s.observe("ReapExportJobs", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) OpenExportUpload(ctx context.Context, name string) (ExportFile, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "OpenExportUpload")
+	result, err := s.next.OpenExportUpload(ctx, name)
+	s.observe("OpenExportUpload", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) OpenExportDownload(ctx context.Context, fileID interface{}) (io.ReadCloser, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "OpenExportDownload")
+	result, err := s.next.OpenExportDownload(ctx, fileID)
+	s.observe("OpenExportDownload", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) AddEvent(ctx context.Context, evt *lifecycle.Event) error {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "AddEvent")
+	err := s.next.AddEvent(ctx, evt)
+	s.observe("AddEvent", start, span, err)
+	return err
+}
+
+func (s *instrumented) ClaimEvents(ctx context.Context, claim string, limit int64, lease time.Duration) ([]lifecycle.Event, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "ClaimEvents")
+	result, err := s.next.ClaimEvents(ctx, claim, limit, lease)
+	s.observe("ClaimEvents", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) MarkEventSent(ctx context.Context, id string) error {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "MarkEventSent")
+	err := s.next.MarkEventSent(ctx, id)
+	s.observe("MarkEventSent", start, span, err)
+	return err
+}
+
+func (s *instrumented) AddPaymentRequest(ctx context.Context, donateID string) error {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "AddPaymentRequest")
+	err := s.next.AddPaymentRequest(ctx, donateID)
+	s.observe("AddPaymentRequest", start, span, err)
+	return err
+}
+
+func (s *instrumented) ClaimPaymentRequests(ctx context.Context, claim string, limit int64, lease time.Duration) ([]string, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "ClaimPaymentRequests")
+	result, err := s.next.ClaimPaymentRequests(ctx, claim, limit, lease)
+	s.observe("ClaimPaymentRequests", start, span, err)
+	return result, err
+}
+
+func (s *instrumented) MarkPaymentRequested(ctx context.Context, donateID string) error {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "MarkPaymentRequested")
+	err := s.next.MarkPaymentRequested(ctx, donateID)
+	s.observe("MarkPaymentRequested", start, span, err)
+	return err
+}
+
+func (s *instrumented) Ping(ctx context.Context) error {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "Ping")
+	err := s.next.Ping(ctx)
+	s.observe("Ping", start, span, err)
+	return err
+}
+
+func (s *instrumented) GetPostTotals(ctx context.Context, posts []string) ([]donates.PostTotals, error) {
+	start := time.Now()
+	ctx, span := s.startSpan(ctx, "GetPostTotals")
+	result, err := s.next.GetPostTotals(ctx, posts)
+	s.observe("GetPostTotals", start, span, err)
+	return result, err
+}
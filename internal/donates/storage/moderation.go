@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"tempproj/internal/donates"
+	"tempproj/internal/types"
+	"tempproj/pkg/error/dberror"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (s *storageImpl) GetByStatus(ctx context.Context, status donates.Status, filter donates.ReviewFilter, page types.PageOpt) ([]donates.Donate, error) {
+	query := bson.M{"status": status}
+	if filter.From != "" {
+		query["from"] = filter.From
+	}
+	if filter.To != "" {
+		query["to"] = filter.To
+	}
+	created := bson.M{}
+	if !filter.Since.IsZero() {
+		created["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		created["$lt"] = filter.Until
+	}
+	if len(created) != 0 {
+		query["created"] = created
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: 1}})
+	if page.Limit > 0 {
+		opts.SetLimit(int64(page.Limit))
+	}
+	if page.Offset > 0 {
+		opts.SetSkip(int64(page.Offset))
+	}
+	cursor, err := s.donates.Find(ctx, query, opts)
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.Find err: %s", err)
+	}
+	defer cursor.Close(nil)
+	result := make([]donates.Donate, 0)
+	err = cursor.All(ctx, &result)
+	if err != nil {
+		return nil, dberror.ErrInternal("can't get donates from cursor: %s", err)
+	}
+	return result, nil
+}
+
+// Update donate only if it has the given status, returns nil if there is no such donate
+func (s *storageImpl) UpdateIfStatus(ctx context.Context, donateID string, status donates.Status, update map[string]interface{}, hook Mutation) (*donates.Donate, error) {
+	var donate *donates.Donate
+	err := s.transaction(ctx, func(sc mongo.SessionContext) error {
+		var err error
+		donate, err = s.update(sc, bson.M{"id": donateID, "status": status}, update, hook)
+		if err == mongo.ErrNoDocuments {
+			donate = nil
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return donate, nil
+}
+
+func (s *storageImpl) AddDecision(ctx context.Context, decision *donates.ModerationDecision) error {
+	_, err := s.moderation.InsertOne(ctx, decision)
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.InsertOne err: %s", err)
+	}
+	return nil
+}
+
+func (s *storageImpl) GetDecisions(ctx context.Context, donateID string) ([]donates.ModerationDecision, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: 1}})
+	cursor, err := s.moderation.Find(ctx, bson.M{"donate": donateID}, opts)
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.Find err: %s", err)
+	}
+	defer cursor.Close(nil)
+	result := make([]donates.ModerationDecision, 0)
+	err = cursor.All(ctx, &result)
+	if err != nil {
+		return nil, dberror.ErrInternal("can't get decisions from cursor: %s", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"context"
+	"tempproj/internal/donates/lifecycle"
+	"tempproj/pkg/error/dberror"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Lifecycle event waiting to be published to message queue
+type outboxEntry struct {
+	lifecycle.Event `bson:",inline"`
+	Sent            bool      `bson:"sent"`
+	SentAt          time.Time `bson:"sent_at,omitempty"`
+}
+
+func (s *storageImpl) AddEvent(ctx context.Context, evt *lifecycle.Event) error {
+	_, err := s.outbox.InsertOne(ctx, &outboxEntry{Event: *evt})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.InsertOne err: %s", err)
+	}
+	return nil
+}
+
+// Filter of unsent events that aren't claimed or whose claim expired
+func claimable(now time.Time) bson.M {
+	return bson.M{
+		"sent": false,
+		"$or": bson.A{
+			bson.M{"claimed_until": bson.M{"$lt": now}},
+			bson.M{"claimed_until": bson.M{"$exists": false}},
+		},
+	}
+}
+
+// Claim up to limit claimable entries of the collection, first in the order,
+// for the lease. Entries are found by the key field and claimed with one
+// update, so a claim can get fewer entries than were found if concurrent relay
+// claims some of them first.
+func (s *storageImpl) claim(ctx context.Context, entries *mongo.Collection, key string, order bson.D, claim string, limit int64, lease time.Duration) error {
+	now := s.clock.Now()
+	opts := options.Find().
+		SetSort(order).
+		SetLimit(limit).
+		SetProjection(bson.M{key: 1})
+	cursor, err := entries.Find(ctx, claimable(now), opts)
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.Find err: %s", err)
+	}
+	found := make([]bson.M, 0)
+	err = cursor.All(ctx, &found)
+	if err != nil {
+		return dberror.ErrInternal("can't get outbox entries from cursor: %s", err)
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	keys := make(bson.A, 0, len(found))
+	for _, entry := range found {
+		keys = append(keys, entry[key])
+	}
+	query := claimable(now)
+	query[key] = bson.M{"$in": keys}
+	_, err = entries.UpdateMany(ctx, query, bson.M{"$set": bson.M{
+		"claim":         claim,
+		"claimed_until": now.Add(lease),
+	}})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.UpdateMany err: %s", err)
+	}
+	return nil
+}
+
+// Events of one transition occur at the same time, seq keeps their order
+var eventsOrder = bson.D{{Key: "occurred", Value: 1}, {Key: "seq", Value: 1}}
+
+// Claim oldest unsent events and return them
+func (s *storageImpl) ClaimEvents(ctx context.Context, claim string, limit int64, lease time.Duration) ([]lifecycle.Event, error) {
+	err := s.claim(ctx, s.outbox, "id", eventsOrder, claim, limit, lease)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().SetSort(eventsOrder)
+	cursor, err := s.outbox.Find(ctx, bson.M{"claim": claim, "sent": false}, opts)
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.Find err: %s", err)
+	}
+	defer cursor.Close(nil)
+	entries := make([]outboxEntry, 0)
+	err = cursor.All(ctx, &entries)
+	if err != nil {
+		return nil, dberror.ErrInternal("can't get events from cursor: %s", err)
+	}
+	result := make([]lifecycle.Event, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, entry.Event)
+	}
+	return result, nil
+}
+
+func (s *storageImpl) MarkEventSent(ctx context.Context, id string) error {
+	_, err := s.outbox.UpdateOne(ctx, bson.M{"id": id}, bson.M{"$set": bson.M{"sent": true, "sent_at": s.clock.Now()}})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.UpdateOne err: %s", err)
+	}
+	return nil
+}
+
+// Request to create payment of the donate waiting to be published to message
+// queue. Donate has one request, it's added with the change that lets the
+// donate be paid.
+type paymentRequest struct {
+	DonateID  string    `bson:"donate"`
+	CreatedAt time.Time `bson:"created"`
+	Sent      bool      `bson:"sent"`
+	SentAt    time.Time `bson:"sent_at,omitempty"`
+}
+
+func (s *storageImpl) AddPaymentRequest(ctx context.Context, donateID string) error {
+	_, err := s.payments.InsertOne(ctx, &paymentRequest{DonateID: donateID, CreatedAt: s.clock.Now()})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.InsertOne err: %s", err)
+	}
+	return nil
+}
+
+// Claim oldest unsent payment requests and return IDs of their donates
+func (s *storageImpl) ClaimPaymentRequests(ctx context.Context, claim string, limit int64, lease time.Duration) ([]string, error) {
+	err := s.claim(ctx, s.payments, "donate", bson.D{{Key: "created", Value: 1}}, claim, limit, lease)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: 1}})
+	cursor, err := s.payments.Find(ctx, bson.M{"claim": claim, "sent": false}, opts)
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.Find err: %s", err)
+	}
+	defer cursor.Close(nil)
+	requests := make([]paymentRequest, 0)
+	err = cursor.All(ctx, &requests)
+	if err != nil {
+		return nil, dberror.ErrInternal("can't get payment requests from cursor: %s", err)
+	}
+	result := make([]string, 0, len(requests))
+	for _, request := range requests {
+		result = append(result, request.DonateID)
+	}
+	return result, nil
+}
+
+func (s *storageImpl) MarkPaymentRequested(ctx context.Context, donateID string) error {
+	_, err := s.payments.UpdateOne(ctx, bson.M{"donate": donateID}, bson.M{"$set": bson.M{"sent": true, "sent_at": s.clock.Now()}})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.UpdateOne err: %s", err)
+	}
+	return nil
+}
+
+func (s *storageImpl) ensureOutboxIndexes(ctx context.Context) error {
+	_, err := s.outbox.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "id", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "sent", Value: 1}, {Key: "occurred", Value: 1}, {Key: "seq", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "claim", Value: 1}},
+		},
+		{
+			// Published events are kept for a week
+			Keys:    bson.D{{Key: "sent_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(7 * 24 * 3600),
+		},
+	})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.CreateIndex err: %s", err)
+	}
+	_, err = s.payments.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "donate", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "sent", Value: 1}, {Key: "created", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "claim", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "sent_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(7 * 24 * 3600),
+		},
+	})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.CreateIndex err: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"context"
+	"tempproj/internal/donates"
+	"tempproj/pkg/error/dberror"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const receiptCounter = "receipts"
+
+// Assign next receipt number and save the receipt. Counter and receipt are
+// written in one transaction, so failed insert doesn't leave a gap. If the
+// donate already has receipt, the saved one is returned.
+func (s *storageImpl) CreateReceipt(ctx context.Context, receipt *donates.Receipt) (*donates.Receipt, error) {
+	existing, err := s.GetReceipt(ctx, receipt.DonateID)
+	if err == nil {
+		return existing, nil
+	}
+	session, err := s.receipts.Database().Client().StartSession()
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.StartSession err: %s", err)
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetUpsert(true)
+		counter := struct {
+			Seq int64 `bson:"seq"`
+		}{}
+		err := s.counters.FindOneAndUpdate(sc, bson.M{"_id": receiptCounter}, bson.M{"$inc": bson.M{"seq": 1}}, opts).Decode(&counter)
+		if err != nil {
+			return nil, err
+		}
+		receipt.Number = counter.Seq
+		return s.receipts.InsertOne(sc, receipt)
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		// Concurrent handler issued the receipt first
+		return s.GetReceipt(ctx, receipt.DonateID)
+	}
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "can't create receipt: %s", err)
+	}
+	return receipt, nil
+}
+
+func (s *storageImpl) GetReceipt(ctx context.Context, donateID string) (*donates.Receipt, error) {
+	receipt := &donates.Receipt{}
+	err := s.receipts.FindOne(ctx, bson.M{"donate": donateID}).Decode(receipt)
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.FindOne err: %s", err)
+	}
+	return receipt, nil
+}
+
+func (s *storageImpl) ensureReceiptIndexes(ctx context.Context) error {
+	_, err := s.receipts.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "donate", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "number", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.CreateIndex err: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package storage_test
+
+import (
+	"context"
+	"tempproj/internal/donates"
+	"testing"
+)
+
+func TestFailedReceiptInsertLeavesNoGap(t *testing.T) {
+	s, db, clock := newTestStorage(t)
+	ctx := context.Background()
+	// Receipt saved bypassing the counter takes the next number, so insert
+	// fails after the counter is incremented
+	_, err := db.Collection("donate_receipts").InsertOne(ctx, &donates.Receipt{Number: 1, DonateID: "blocker"})
+	if err != nil {
+		t.Fatalf("InsertOne: %s", err)
+	}
+	_, err = s.CreateReceipt(ctx, &donates.Receipt{DonateID: "first", Amount: 100, IssuedAt: clock.Now()})
+	if err == nil {
+		t.Fatal("receipt with taken number is saved")
+	}
+	_, err = db.Collection("donate_receipts").DeleteOne(ctx, map[string]interface{}{"donate": "blocker"})
+	if err != nil {
+		t.Fatalf("DeleteOne: %s", err)
+	}
+	for i, id := range []string{"first", "second"} {
+		receipt, err := s.CreateReceipt(ctx, &donates.Receipt{DonateID: id, Amount: 100, IssuedAt: clock.Now()})
+		if err != nil {
+			t.Fatalf("CreateReceipt: %s", err)
+		}
+		if receipt.Number != int64(i+1) {
+			t.Errorf("receipt of %s has number %d, want %d", id, receipt.Number, i+1)
+		}
+	}
+}
+
+func TestReceiptIsIssuedOnce(t *testing.T) {
+	s, _, clock := newTestStorage(t)
+	ctx := context.Background()
+	first, err := s.CreateReceipt(ctx, &donates.Receipt{DonateID: "donate", Amount: 100, IssuedAt: clock.Now()})
+	if err != nil {
+		t.Fatalf("CreateReceipt: %s", err)
+	}
+	again, err := s.CreateReceipt(ctx, &donates.Receipt{DonateID: "donate", Amount: 100, IssuedAt: clock.Now()})
+	if err != nil {
+		t.Fatalf("CreateReceipt: %s", err)
+	}
+	if again.Number != first.Number {
+		t.Errorf("repeated receipt has number %d, want %d", again.Number, first.Number)
+	}
+}
@@ -0,0 +1,465 @@
+package storage
+
+import (
+	"context"
+	"tempproj/internal/donates"
+	"tempproj/pkg/error/dberror"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	statsRebuildLease = "stats_rebuild"
+	statsBuiltMarker  = "stats_built"
+	// Rebuild that runs longer than this is considered dead
+	statsRebuildTTL = 30 * time.Minute
+	// Stats are built in this collection and replace the live one when
+	// they are complete, so readers never see half-built documents
+	statsBuildCollection = "donation_stats_build"
+)
+
+// Add confirmed donate to stats of both sides and of its post. Every donate is
+// counted once, returns false if the donate was already applied. All writes
+// are done in one transaction. While stats are rebuilt the donate is left
+// unapplied, rebuild applies such donates when it's done.
+func (s *storageImpl) ApplyToStats(ctx context.Context, donate *donates.Donate) (bool, error) {
+	session, err := s.donates.Database().Client().StartSession()
+	if err != nil {
+		return false, dberror.ErrMongoHandle(err, "mongo.StartSession err: %s", err)
+	}
+	defer session.EndSession(ctx)
+	applied, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return s.applyToStats(sc, donate)
+	})
+	if err != nil {
+		return false, dberror.ErrMongoHandle(err, "can't apply donate to stats: %s", err)
+	}
+	return applied.(bool), nil
+}
+
+func (s *storageImpl) applyToStats(ctx context.Context, donate *donates.Donate) (bool, error) {
+	rebuilding, err := s.statsRebuilding(ctx)
+	if err != nil || rebuilding {
+		return false, err
+	}
+	err = s.donates.FindOneAndUpdate(
+		ctx,
+		bson.M{"id": donate.ID, "stats_applied": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"stats_applied": true}},
+	).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var uniqDonors int64
+	pair, err := s.pairs.UpdateOne(
+		ctx,
+		bson.M{"from": donate.From, "to": donate.To},
+		bson.M{"$setOnInsert": bson.M{"from": donate.From, "to": donate.To}},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return false, err
+	}
+	if pair.UpsertedCount == 1 {
+		uniqDonors = 1
+	}
+	confirmed := donate.ConfirmedAt()
+	upsert := options.Update().SetUpsert(true)
+	_, err = s.stats.UpdateOne(ctx, bson.M{"user": donate.To}, bson.M{
+		"$inc": bson.M{
+			"received_count": 1,
+			"received_sum":   int64(donate.Amount),
+			"unique_donors":  uniqDonors,
+		},
+		"$max": bson.M{"last_donation": confirmed},
+	}, upsert)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.stats.UpdateOne(ctx, bson.M{"user": donate.From}, bson.M{
+		"$inc": bson.M{
+			"given_count": 1,
+			"given_sum":   int64(donate.Amount),
+		},
+		"$max": bson.M{"last_donation": confirmed},
+	}, upsert)
+	if err != nil {
+		return false, err
+	}
+	if donate.Post == "" {
+		return true, nil
+	}
+	var uniqPostDonors int64
+	postPair, err := s.postPairs.UpdateOne(
+		ctx,
+		bson.M{"post": donate.Post, "from": donate.From},
+		bson.M{"$setOnInsert": bson.M{"post": donate.Post, "from": donate.From}},
+		upsert,
+	)
+	if err != nil {
+		return false, err
+	}
+	if postPair.UpsertedCount == 1 {
+		uniqPostDonors = 1
+	}
+	_, err = s.postStats.UpdateOne(ctx, bson.M{"post": donate.Post}, bson.M{
+		"$inc": bson.M{
+			"sum":    int64(donate.Amount),
+			"count":  1,
+			"donors": uniqPostDonors,
+		},
+		"$set": bson.M{"author": donate.To},
+	}, upsert)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Report whether a rebuild holds the lease
+func (s *storageImpl) statsRebuilding(ctx context.Context) (bool, error) {
+	count, err := s.counters.CountDocuments(ctx, bson.M{
+		"_id":   statsRebuildLease,
+		"until": bson.M{"$gt": s.clock.Now()},
+	})
+	if err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+func (s *storageImpl) GetStats(ctx context.Context, user string) (*donates.Stats, error) {
+	stats := &donates.Stats{}
+	err := s.stats.FindOne(ctx, bson.M{"user": user}).Decode(stats)
+	if err == mongo.ErrNoDocuments {
+		return &donates.Stats{User: user}, nil
+	}
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.FindOne err: %s", err)
+	}
+	return stats, nil
+}
+
+// Recompute stats collection from confirmed donates. Only one rebuild runs at
+// a time, ErrStatsRebuilding is returned while another one holds the lease.
+// Handler doesn't apply donates during the rebuild, they are applied after it,
+// so rebuild is safe to run on a live service.
+func (s *storageImpl) RebuildStats(ctx context.Context) error {
+	// Collections replaced by $out keep the indexes of the build, they must exist
+	err := s.ensureStatsIndexes(ctx)
+	if err != nil {
+		return err
+	}
+	err = s.lockStatsRebuild(ctx)
+	if err != nil {
+		return err
+	}
+	// Rebuild must not outlive the lease, handler applies donates after it
+	rebuildCtx, cancel := context.WithTimeout(ctx, statsRebuildTTL)
+	err = s.rebuildStats(rebuildCtx)
+	cancel()
+	unlockErr := s.unlockStatsRebuild(ctx)
+	if err != nil {
+		return err
+	}
+	if unlockErr != nil {
+		return unlockErr
+	}
+	_, err = s.ApplyPendingStats(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = s.counters.UpdateOne(ctx, bson.M{"_id": statsBuiltMarker},
+		bson.M{"$set": bson.M{"at": s.clock.Now()}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.UpdateOne err: %s", err)
+	}
+	return nil
+}
+
+// Report whether stats were rebuilt at least once, they are empty for
+// donates confirmed before stats were introduced until then
+func (s *storageImpl) StatsBuilt(ctx context.Context) (bool, error) {
+	count, err := s.counters.CountDocuments(ctx, bson.M{"_id": statsBuiltMarker})
+	if err != nil {
+		return false, dberror.ErrMongoHandle(err, "mongo.Count err: %s", err)
+	}
+	return count != 0, nil
+}
+
+// Apply confirmed donates that aren't in stats yet, returns number of applied
+// donates
+func (s *storageImpl) ApplyPendingStats(ctx context.Context) (int64, error) {
+	cursor, err := s.donates.Find(ctx, bson.M{"status": 2, "stats_applied": bson.M{"$ne": true}})
+	if err != nil {
+		return 0, dberror.ErrMongoHandle(err, "mongo.Find err: %s", err)
+	}
+	defer cursor.Close(nil)
+	var count int64
+	for cursor.Next(ctx) {
+		donate := &donates.Donate{}
+		err = cursor.Decode(donate)
+		if err != nil {
+			return count, dberror.ErrInternal("can't decode donate: %s", err)
+		}
+		applied, err := s.ApplyToStats(ctx, donate)
+		if err != nil {
+			return count, err
+		}
+		if applied {
+			count++
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return count, dberror.ErrMongoHandle(err, "cursor err: %s", err)
+	}
+	return count, nil
+}
+
+func (s *storageImpl) lockStatsRebuild(ctx context.Context) error {
+	now := s.clock.Now()
+	_, err := s.counters.UpdateOne(ctx,
+		bson.M{"_id": statsRebuildLease, "until": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"until": now.Add(statsRebuildTTL)}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		// Lease exists and isn't expired
+		return donates.ErrStatsRebuilding
+	}
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.UpdateOne err: %s", err)
+	}
+	return nil
+}
+
+func (s *storageImpl) unlockStatsRebuild(ctx context.Context) error {
+	_, err := s.counters.UpdateOne(ctx, bson.M{"_id": statsRebuildLease},
+		bson.M{"$set": bson.M{"until": s.clock.Now()}})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.UpdateOne err: %s", err)
+	}
+	return nil
+}
+
+// Recompute stats of donates marked as applied. Handler doesn't mark donates
+// while the lease is held, so every confirmed donate is counted either here
+// or by ApplyPendingStats after the rebuild, never by both.
+func (s *storageImpl) rebuildStats(ctx context.Context) error {
+	_, err := s.donates.UpdateMany(ctx, bson.M{"status": 2}, bson.M{"$set": bson.M{"stats_applied": true}})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.UpdateMany err: %s", err)
+	}
+	build := s.stats.Database().Collection(statsBuildCollection)
+	// Leftover of an interrupted rebuild
+	err = build.Drop(ctx)
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.Drop err: %s", err)
+	}
+	confirmed := bson.M{"$match": bson.M{"status": 2, "stats_applied": true}}
+	withPost := bson.M{"$match": bson.M{"post": bson.M{"$nin": bson.A{nil, ""}}}}
+	// Time of the last confirmed status in history, creation time for donates
+	// whose history doesn't have it
+	confirmedAt := bson.M{"$addFields": bson.M{"confirmed_at": bson.M{"$ifNull": bson.A{
+		bson.M{"$max": bson.M{"$map": bson.M{
+			"input": bson.M{"$filter": bson.M{
+				"input": "$history",
+				"cond":  bson.M{"$eq": bson.A{"$$this.status", 2}},
+			}},
+			"in": "$$this.at",
+		}}},
+		"$created",
+	}}}}
+	err = s.aggregate(ctx, bson.A{
+		confirmed,
+		confirmedAt,
+		bson.M{"$group": bson.M{
+			"_id":            "$to",
+			"received_count": bson.M{"$sum": 1},
+			"received_sum":   bson.M{"$sum": "$amount"},
+			"donors":         bson.M{"$addToSet": "$from"},
+			"last_donation":  bson.M{"$max": "$confirmed_at"},
+		}},
+		bson.M{"$project": bson.M{
+			"_id":            0,
+			"user":           "$_id",
+			"received_count": 1,
+			"received_sum":   1,
+			"unique_donors":  bson.M{"$size": "$donors"},
+			"last_donation":  1,
+		}},
+		bson.M{"$out": build.Name()},
+	})
+	if err != nil {
+		return err
+	}
+	// $merge requires unique index on the "on" field, the index moves to the
+	// live collection with the rename
+	_, err = build.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.CreateIndex err: %s", err)
+	}
+	err = s.aggregate(ctx, bson.A{
+		confirmed,
+		confirmedAt,
+		bson.M{"$group": bson.M{
+			"_id":           "$from",
+			"given_count":   bson.M{"$sum": 1},
+			"given_sum":     bson.M{"$sum": "$amount"},
+			"last_donation": bson.M{"$max": "$confirmed_at"},
+		}},
+		bson.M{"$project": bson.M{
+			"_id":           0,
+			"user":          "$_id",
+			"given_count":   1,
+			"given_sum":     1,
+			"last_donation": 1,
+		}},
+		bson.M{"$merge": bson.M{
+			"into": build.Name(),
+			"on":   "user",
+			"whenMatched": bson.A{bson.M{"$set": bson.M{
+				"given_count":   "$$new.given_count",
+				"given_sum":     "$$new.given_sum",
+				"last_donation": bson.M{"$max": bson.A{"$last_donation", "$$new.last_donation"}},
+			}}},
+			"whenNotMatched": "insert",
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	db := s.stats.Database()
+	err = db.Client().Database("admin").RunCommand(ctx, bson.D{
+		{Key: "renameCollection", Value: db.Name() + "." + build.Name()},
+		{Key: "to", Value: db.Name() + "." + s.stats.Name()},
+		{Key: "dropTarget", Value: true},
+	}).Err()
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.RenameCollection err: %s", err)
+	}
+	// Every other collection is built by one $out, which replaces it at once
+	pipelines := []bson.A{
+		{
+			confirmed,
+			bson.M{"$group": bson.M{"_id": bson.M{"from": "$from", "to": "$to"}}},
+			bson.M{"$project": bson.M{"_id": 0, "from": "$_id.from", "to": "$_id.to"}},
+			bson.M{"$out": s.pairs.Name()},
+		},
+		{
+			confirmed,
+			withPost,
+			bson.M{"$group": bson.M{"_id": bson.M{"post": "$post", "from": "$from"}}},
+			bson.M{"$project": bson.M{"_id": 0, "post": "$_id.post", "from": "$_id.from"}},
+			bson.M{"$out": s.postPairs.Name()},
+		},
+		{
+			// Donates are grouped by donor first, so unique donors are counted
+			// without keeping them in one document
+			confirmed,
+			withPost,
+			bson.M{"$group": bson.M{
+				"_id":    bson.M{"post": "$post", "from": "$from"},
+				"author": bson.M{"$first": "$to"},
+				"sum":    bson.M{"$sum": "$amount"},
+				"count":  bson.M{"$sum": 1},
+			}},
+			bson.M{"$group": bson.M{
+				"_id":    "$_id.post",
+				"author": bson.M{"$first": "$author"},
+				"sum":    bson.M{"$sum": "$sum"},
+				"count":  bson.M{"$sum": "$count"},
+				"donors": bson.M{"$sum": 1},
+			}},
+			bson.M{"$project": bson.M{
+				"_id":    0,
+				"post":   "$_id",
+				"author": 1,
+				"sum":    1,
+				"count":  1,
+				"donors": 1,
+			}},
+			bson.M{"$out": s.postStats.Name()},
+		},
+	}
+	for _, pipeline := range pipelines {
+		err = s.aggregate(ctx, pipeline)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run pipeline over donates that writes its output
+func (s *storageImpl) aggregate(ctx context.Context, pipeline bson.A) error {
+	cursor, err := s.donates.Aggregate(ctx, pipeline)
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.Aggregate err: %s", err)
+	}
+	cursor.Close(ctx)
+	return nil
+}
+
+// Return totals of posts that have confirmed donates, in any order
+func (s *storageImpl) GetPostTotals(ctx context.Context, posts []string) ([]donates.PostTotals, error) {
+	cursor, err := s.postStats.Find(ctx, bson.M{"post": bson.M{"$in": posts}})
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.Find err: %s", err)
+	}
+	defer cursor.Close(nil)
+	result := make([]donates.PostTotals, 0, len(posts))
+	err = cursor.All(ctx, &result)
+	if err != nil {
+		return nil, dberror.ErrInternal("cursor.All err: %s", err)
+	}
+	return result, nil
+}
+
+func (s *storageImpl) ensureStatsIndexes(ctx context.Context) error {
+	_, err := s.stats.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.CreateIndex err: %s", err)
+	}
+	_, err = s.pairs.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "from", Value: 1}, {Key: "to", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.CreateIndex err: %s", err)
+	}
+	// Confirmed donates not applied to stats yet
+	_, err = s.donates.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "stats_applied", Value: 1}},
+	})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.CreateIndex err: %s", err)
+	}
+	_, err = s.postStats.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "post", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.CreateIndex err: %s", err)
+	}
+	_, err = s.postPairs.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "post", Value: 1}, {Key: "from", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.CreateIndex err: %s", err)
+	}
+	return nil
+}
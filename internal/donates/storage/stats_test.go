@@ -0,0 +1,201 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"tempproj/internal/donates"
+	"tempproj/internal/donates/donatestest"
+	"tempproj/internal/donates/storage"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Storage tests need a replica set for transactions, they are skipped unless
+// DONATES_TEST_MONGO_URI points to one
+func newTestStorage(t *testing.T) (storage.Storage, *mongo.Database, *donatestest.Clock) {
+	t.Helper()
+	uri := os.Getenv("DONATES_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("DONATES_TEST_MONGO_URI is not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("mongo.Connect: %s", err)
+	}
+	db := client.Database("donates_test_" + xid.New().String())
+	t.Cleanup(func() {
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	clock := donatestest.NewClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	s, err := storage.NewOnDatabase(logrus.NewEntry(logger), db, clock)
+	if err != nil {
+		t.Fatalf("storage.NewOnDatabase: %s", err)
+	}
+	return s, db, clock
+}
+
+// Insert confirmed donate directly, bypassing the status workflow
+func insertConfirmed(t *testing.T, db *mongo.Database, clock *donatestest.Clock, from, to, post string, amount uint64) *donates.Donate {
+	t.Helper()
+	now := clock.Now()
+	donate := &donates.Donate{
+		ID:        xid.New().String(),
+		From:      from,
+		To:        to,
+		Amount:    amount,
+		Status:    donates.Confirmed,
+		Post:      post,
+		CreatedAt: now,
+		UpdatedAt: now,
+		History:   []donates.StatusChange{{Status: donates.Confirmed, At: now}},
+	}
+	_, err := db.Collection("donates").InsertOne(context.Background(), donate)
+	if err != nil {
+		t.Fatalf("InsertOne: %s", err)
+	}
+	return donate
+}
+
+func getStats(t *testing.T, s storage.Storage, user string) *donates.Stats {
+	t.Helper()
+	stats, err := s.GetStats(context.Background(), user)
+	if err != nil {
+		t.Fatalf("GetStats: %s", err)
+	}
+	return stats
+}
+
+func TestApplyToStatsCountsOnce(t *testing.T) {
+	s, db, clock := newTestStorage(t)
+	ctx := context.Background()
+	first := insertConfirmed(t, db, clock, "alice", "bob", "post", 100)
+	second := insertConfirmed(t, db, clock, "alice", "bob", "post", 50)
+	for _, donate := range []*donates.Donate{first, second} {
+		applied, err := s.ApplyToStats(ctx, donate)
+		if err != nil || !applied {
+			t.Fatalf("ApplyToStats: %v, %v", applied, err)
+		}
+	}
+	applied, err := s.ApplyToStats(ctx, first)
+	if err != nil {
+		t.Fatalf("ApplyToStats: %s", err)
+	}
+	if applied {
+		t.Error("donate is applied twice")
+	}
+	received := getStats(t, s, "bob")
+	if received.ReceivedCount != 2 || received.ReceivedSum != 150 || received.UniqueDonors != 1 {
+		t.Errorf("got received stats %+v, want 2 donates of 150 from one donor", received)
+	}
+	given := getStats(t, s, "alice")
+	if given.GivenCount != 2 || given.GivenSum != 150 {
+		t.Errorf("got given stats %+v, want 2 donates of 150", given)
+	}
+	totals, err := s.GetPostTotals(ctx, []string{"post"})
+	if err != nil {
+		t.Fatalf("GetPostTotals: %s", err)
+	}
+	if len(totals) != 1 || totals[0].Sum != 150 || totals[0].Count != 2 || totals[0].Donors != 1 {
+		t.Errorf("got post totals %+v, want 2 donates of 150 from one donor", totals)
+	}
+}
+
+func TestRebuildStatsMatchesApplied(t *testing.T) {
+	s, db, clock := newTestStorage(t)
+	ctx := context.Background()
+	for _, donate := range []*donates.Donate{
+		insertConfirmed(t, db, clock, "alice", "bob", "", 100),
+		insertConfirmed(t, db, clock, "carol", "bob", "", 20),
+		insertConfirmed(t, db, clock, "bob", "alice", "", 5),
+	} {
+		_, err := s.ApplyToStats(ctx, donate)
+		if err != nil {
+			t.Fatalf("ApplyToStats: %s", err)
+		}
+	}
+	before := getStats(t, s, "bob")
+	err := s.RebuildStats(ctx)
+	if err != nil {
+		t.Fatalf("RebuildStats: %s", err)
+	}
+	after := getStats(t, s, "bob")
+	// Both sides of bob are merged into one document
+	if after.ReceivedCount != before.ReceivedCount || after.ReceivedSum != before.ReceivedSum ||
+		after.UniqueDonors != before.UniqueDonors || after.GivenCount != before.GivenCount ||
+		after.GivenSum != before.GivenSum {
+		t.Errorf("got %+v after rebuild, want %+v", after, before)
+	}
+	built, err := s.StatsBuilt(ctx)
+	if err != nil || !built {
+		t.Errorf("StatsBuilt: %v, %v", built, err)
+	}
+}
+
+func TestApplyDuringRebuildIsDeferred(t *testing.T) {
+	s, db, clock := newTestStorage(t)
+	ctx := context.Background()
+	// Take the lease as a rebuild running in another process would
+	_, err := db.Collection("donate_counters").InsertOne(ctx, map[string]interface{}{
+		"_id":   "stats_rebuild",
+		"until": clock.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("InsertOne: %s", err)
+	}
+	donate := insertConfirmed(t, db, clock, "alice", "bob", "", 100)
+	applied, err := s.ApplyToStats(ctx, donate)
+	if err != nil {
+		t.Fatalf("ApplyToStats: %s", err)
+	}
+	if applied {
+		t.Error("donate is applied while stats are rebuilt")
+	}
+	err = s.RebuildStats(ctx)
+	if !errors.Is(err, donates.ErrStatsRebuilding) {
+		t.Errorf("got %v, want ErrStatsRebuilding while lease is held", err)
+	}
+	clock.Advance(time.Minute)
+	count, err := s.ApplyPendingStats(ctx)
+	if err != nil {
+		t.Fatalf("ApplyPendingStats: %s", err)
+	}
+	if count != 1 {
+		t.Errorf("applied %d donates after the lease expired, want 1", count)
+	}
+	if stats := getStats(t, s, "bob"); stats.ReceivedCount != 1 {
+		t.Errorf("got %d received donates, want 1", stats.ReceivedCount)
+	}
+}
+
+func TestExpiredRebuildLeaseIsTaken(t *testing.T) {
+	s, db, clock := newTestStorage(t)
+	ctx := context.Background()
+	// Lease of a rebuild that died without releasing it
+	_, err := db.Collection("donate_counters").InsertOne(ctx, map[string]interface{}{
+		"_id":   "stats_rebuild",
+		"until": clock.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("InsertOne: %s", err)
+	}
+	insertConfirmed(t, db, clock, "alice", "bob", "", 100)
+	clock.Advance(time.Minute + time.Second)
+	err = s.RebuildStats(ctx)
+	if err != nil {
+		t.Fatalf("RebuildStats: %s", err)
+	}
+	if stats := getStats(t, s, "bob"); stats.ReceivedCount != 1 || stats.ReceivedSum != 100 {
+		t.Errorf("got %+v, want one donate of 100", stats)
+	}
+}
@@ -2,42 +2,160 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"io"
 	"tempproj/internal/donates"
+	"tempproj/internal/donates/lifecycle"
+	"tempproj/internal/types"
 	"tempproj/pkg/error/dberror"
 	"tempproj/pkg/error/svcerror"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+// Update field that is saved to the status history only
+const paymentRef = "payment_ref"
+
+// Mutation is called in the transaction that changes the donate with its state
+// before and after the change, returned error rolls the change back. Before
+// is nil for created donate. Storage writes done with ctx of the call are part
+// of the transaction.
+type Mutation func(ctx context.Context, before, after *donates.Donate) error
+
 type Storage interface {
-	Create(ctx context.Context, donate *donates.Donate) error
+	Create(ctx context.Context, donate *donates.Donate, hook Mutation) error
+	// Donates made to the user
 	GetByUser(ctx context.Context, user string) ([]donates.Donate, error)
-	GetByIDs(ctx context.Context, ids []string) ([]donates.Donate, error)
+	GetByID(ctx context.Context, id string) (*donates.Donate, error)
+	GetByIDs(ctx context.Context, ids []string, projection donates.Projection) ([]donates.Donate, error)
+	List(ctx context.Context, filter donates.ListFilter, page types.PageOpt) ([]donates.Donate, error)
 	GetNumber(ctx context.Context, user string) (int64, error)
 	GetDonators(ctx context.Context, uniq string, filter map[string]interface{}) ([]string, error)
 	GetDonatesSum(ctx context.Context, user string) (int64, error)
-	Update(ctx context.Context, donateID string, update map[string]interface{}) (*donates.Donate, error)
+	// Update donate if its version is still the expected one, ErrVersionConflict otherwise
+	Update(ctx context.Context, donateID string, version int64, update map[string]interface{}, hook Mutation) (*donates.Donate, error)
+	ApplyToStats(ctx context.Context, donate *donates.Donate) (bool, error)
+	GetStats(ctx context.Context, user string) (*donates.Stats, error)
+	GetPostTotals(ctx context.Context, posts []string) ([]donates.PostTotals, error)
+	// Recompute stats from confirmed donates, ErrStatsRebuilding if another
+	// rebuild is running
+	RebuildStats(ctx context.Context) error
+	StatsBuilt(ctx context.Context) (bool, error)
+	ApplyPendingStats(ctx context.Context) (int64, error)
+	GetPrivacy(ctx context.Context, user string) (*donates.Privacy, error)
+	// Merge the update into user's settings, returns resulting settings
+	SetPrivacy(ctx context.Context, user string, update donates.PrivacyUpdate) (*donates.Privacy, error)
+	GetByStatus(ctx context.Context, status donates.Status, filter donates.ReviewFilter, page types.PageOpt) ([]donates.Donate, error)
+	UpdateIfStatus(ctx context.Context, donateID string, status donates.Status, update map[string]interface{}, hook Mutation) (*donates.Donate, error)
+	AddDecision(ctx context.Context, decision *donates.ModerationDecision) error
+	GetDecisions(ctx context.Context, donateID string) ([]donates.ModerationDecision, error)
+	CreateReceipt(ctx context.Context, receipt *donates.Receipt) (*donates.Receipt, error)
+	GetReceipt(ctx context.Context, donateID string) (*donates.Receipt, error)
+	Count(ctx context.Context, filter donates.ListFilter) (int64, error)
+	Iterate(ctx context.Context, filter donates.ListFilter, fn func(*donates.Donate) error) error
+	CreateExportJob(ctx context.Context, job *donates.ExportJob) error
+	UpdateExportJob(ctx context.Context, id string, update map[string]interface{}) error
+	GetExportJob(ctx context.Context, id string) (*donates.ExportJob, error)
+	// Take the oldest queued export job, nil if there is no such job
+	ClaimExportJob(ctx context.Context) (*donates.ExportJob, error)
+	// Fail running export jobs without heartbeat since the time
+	ReapExportJobs(ctx context.Context, before time.Time) (int64, error)
+	OpenExportUpload(ctx context.Context, name string) (ExportFile, error)
+	OpenExportDownload(ctx context.Context, fileID interface{}) (io.ReadCloser, error)
+	AddEvent(ctx context.Context, evt *lifecycle.Event) error
+	// Claim oldest unsent events for the lease, they aren't claimed again
+	// until it expires
+	ClaimEvents(ctx context.Context, claim string, limit int64, lease time.Duration) ([]lifecycle.Event, error)
+	MarkEventSent(ctx context.Context, id string) error
+	// Save request to create payment of the donate to the outbox
+	AddPaymentRequest(ctx context.Context, donateID string) error
+	// Claim oldest unsent payment requests for the lease, returns IDs of
+	// their donates
+	ClaimPaymentRequests(ctx context.Context, claim string, limit int64, lease time.Duration) ([]string, error)
+	MarkPaymentRequested(ctx context.Context, donateID string) error
+	Ping(ctx context.Context) error
 }
 
 type storageImpl struct {
-	log     *logrus.Entry
-	donates *mongo.Collection
+	log        *logrus.Entry
+	donates    *mongo.Collection
+	stats      *mongo.Collection
+	pairs      *mongo.Collection
+	postStats  *mongo.Collection
+	postPairs  *mongo.Collection
+	privacy    *mongo.Collection
+	moderation *mongo.Collection
+	receipts   *mongo.Collection
+	counters   *mongo.Collection
+	exports    *mongo.Collection
+	outbox     *mongo.Collection
+	payments   *mongo.Collection
+	clock      donates.Clock
 }
 
-func (s *storageImpl) Create(ctx context.Context, donate *donates.Donate) error {
-	result, err := s.donates.InsertOne(ctx, donate)
+// Run fn in transaction. Rejections and errors of hooks are returned as they
+// are, the rest of errors are mongo errors.
+func (s *storageImpl) transaction(ctx context.Context, fn func(sc mongo.SessionContext) error) error {
+	session, err := s.donates.Database().Client().StartSession()
 	if err != nil {
-		return dberror.ErrMongoHandle(err, "mongo.InsertOne err: %s", err)
+		return dberror.ErrMongoHandle(err, "mongo.StartSession err: %s", err)
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	var hookErr hookError
+	var rejection *donates.Error
+	switch {
+	case errors.As(err, &hookErr):
+		return hookErr.err
+	case errors.As(err, &rejection):
+		return err
+	case err != nil:
+		return dberror.ErrMongoHandle(err, "mongo transaction err: %s", err)
+	}
+	return nil
+}
+
+// hookError is an error of Mutation, it's returned to the caller as it is
+type hookError struct {
+	err error
+}
+
+func (e hookError) Error() string {
+	return e.err.Error()
+}
+
+func runHook(ctx context.Context, hook Mutation, before, after *donates.Donate) error {
+	if hook == nil {
+		return nil
 	}
-	if result.InsertedID == nil {
-		return dberror.ErrInternal("inserted id is empty")
+	err := hook(ctx, before, after)
+	if err != nil {
+		return hookError{err}
 	}
 	return nil
 }
 
+func (s *storageImpl) Create(ctx context.Context, donate *donates.Donate, hook Mutation) error {
+	donate.Version = 1
+	if len(donate.History) == 0 {
+		donate.History = []donates.StatusChange{{Status: donate.Status, At: donate.CreatedAt}}
+	}
+	return s.transaction(ctx, func(sc mongo.SessionContext) error {
+		_, err := s.donates.InsertOne(sc, donate)
+		if err != nil {
+			return err
+		}
+		return runHook(sc, hook, nil, donate)
+	})
+}
+
 func (s *storageImpl) GetByUser(ctx context.Context, user string) ([]donates.Donate, error) {
 	cursor, err := s.donates.Find(ctx, bson.M{"to": user})
 	if err != nil {
@@ -52,8 +170,51 @@ func (s *storageImpl) GetByUser(ctx context.Context, user string) ([]donates.Don
 	return result, nil
 }
 
-func (s *storageImpl) GetByIDs(ctx context.Context, ids []string) ([]donates.Donate, error) {
-	cursor, err := s.donates.Find(ctx, bson.M{"id": bson.M{"$in": ids}})
+func (s *storageImpl) GetByID(ctx context.Context, id string) (*donates.Donate, error) {
+	donate := &donates.Donate{}
+	err := s.donates.FindOne(ctx, bson.M{"id": id}).Decode(donate)
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.FindOne err: %s", err)
+	}
+	return donate, nil
+}
+
+// Fields of projections, full projection returns whole documents. Parties and
+// status are always returned to check visibility, clients get projected fields.
+var projectionFields = map[donates.Projection]bson.M{
+	donates.ProjectShort:  {"id": 1, "from": 1, "to": 1, "amount": 1, "status": 1},
+	donates.ProjectPublic: {"id": 1, "from": 1, "to": 1, "post": 1, "amount": 1, "status": 1, "created": 1},
+}
+
+// Return found donates in any order with fields of the projection
+func (s *storageImpl) GetByIDs(ctx context.Context, ids []string, projection donates.Projection) ([]donates.Donate, error) {
+	opts := options.Find()
+	if fields, ok := projectionFields[projection]; ok {
+		opts.SetProjection(fields)
+	}
+	cursor, err := s.donates.Find(ctx, bson.M{"id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.Find err: %s", err)
+	}
+	defer cursor.Close(nil)
+	result := make([]donates.Donate, 0)
+	err = cursor.All(ctx, &result)
+	if err != nil {
+		return nil, dberror.ErrInternal("can't get donates from cursor: %s", err)
+	}
+	return result, nil
+}
+
+// Return user's donates, newest first
+func (s *storageImpl) List(ctx context.Context, filter donates.ListFilter, page types.PageOpt) ([]donates.Donate, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: -1}})
+	if page.Limit > 0 {
+		opts.SetLimit(int64(page.Limit))
+	}
+	if page.Offset > 0 {
+		opts.SetSkip(int64(page.Offset))
+	}
+	cursor, err := s.donates.Find(ctx, listQuery(filter), opts)
 	if err != nil {
 		return nil, dberror.ErrMongoHandle(err, "mongo.Find err: %s", err)
 	}
@@ -109,26 +270,201 @@ func (s *storageImpl) GetDonatesSum(ctx context.Context, user string) (int64, er
 	return amount, nil
 }
 
-func (s *storageImpl) Update(ctx context.Context, donateID string, update map[string]interface{}) (*donates.Donate, error) {
-	when := options.After
-	opts := &options.FindOneAndUpdateOptions{ReturnDocument: &when}
-	donate := &donates.Donate{}
-	err := s.donates.FindOneAndUpdate(ctx, bson.M{"id": donateID}, bson.M{"$set": update}, opts).Decode(donate)
+func (s *storageImpl) Update(ctx context.Context, donateID string, version int64, update map[string]interface{}, hook Mutation) (*donates.Donate, error) {
+	query := bson.M{"id": donateID, "version": version}
+	if version == 0 {
+		// Donates created before versioning have no version field
+		query["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	var donate *donates.Donate
+	err := s.transaction(ctx, func(sc mongo.SessionContext) error {
+		var err error
+		donate, err = s.update(sc, query, update, hook)
+		if err == mongo.ErrNoDocuments {
+			err = s.donates.FindOne(sc, bson.M{"id": donateID}).Err()
+			if err != nil {
+				return err
+			}
+			return donates.ErrVersionConflict
+		}
+		return err
+	})
 	if err != nil {
-		return nil, dberror.ErrMongoHandle(err, "mongo.UpdateOne err: %s", err)
+		return nil, err
 	}
 	return donate, nil
 }
 
+// Update the donate matched by query and pass it to the hook. State before the
+// update is returned by the update itself, the updated donate is read in the
+// same transaction.
+func (s *storageImpl) update(sc mongo.SessionContext, query bson.M, update map[string]interface{}, hook Mutation) (*donates.Donate, error) {
+	before := &donates.Donate{}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	err := s.donates.FindOneAndUpdate(sc, query, s.withHistory(update), opts).Decode(before)
+	if err != nil {
+		return nil, err
+	}
+	after := &donates.Donate{}
+	err = s.donates.FindOne(sc, bson.M{"id": before.ID}).Decode(after)
+	if err != nil {
+		return nil, err
+	}
+	return after, runHook(sc, hook, before, after)
+}
+
+// Build update document stamped with update time and next version, status
+// change is appended to the donate's history. Optional "payment_ref" field is
+// saved only as reference of the change, the donate doesn't have it.
+func (s *storageImpl) withHistory(update map[string]interface{}) bson.M {
+	now := s.clock.Now()
+	set := bson.M{"updated": now}
+	for key, value := range update {
+		if key != paymentRef {
+			set[key] = value
+		}
+	}
+	result := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	status, ok := update["status"]
+	if !ok {
+		return result
+	}
+	change := bson.M{"status": status, "at": now}
+	if ref, ok := update[paymentRef].(string); ok && ref != "" {
+		change["ref"] = ref
+	}
+	result["$push"] = bson.M{"history": bson.M{
+		"$each":  bson.A{change},
+		"$slice": -donates.MaxHistory,
+	}}
+	return result
+}
+
+// Return user's privacy settings, users without settings are public
+func (s *storageImpl) GetPrivacy(ctx context.Context, user string) (*donates.Privacy, error) {
+	privacy := &donates.Privacy{}
+	err := s.privacy.FindOne(ctx, bson.M{"user": user}).Decode(privacy)
+	if err == mongo.ErrNoDocuments {
+		return &donates.Privacy{User: user, Totals: donates.Public, Donators: donates.Public}, nil
+	}
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.FindOne err: %s", err)
+	}
+	return privacy, nil
+}
+
+func (s *storageImpl) SetPrivacy(ctx context.Context, user string, update donates.PrivacyUpdate) (*donates.Privacy, error) {
+	// Fields that aren't updated get defaults only when settings are created
+	set := bson.M{}
+	defaults := bson.M{"user": user}
+	for field, value := range map[string]*donates.Visibility{"totals": update.Totals, "donators": update.Donators} {
+		if value != nil {
+			set[field] = *value
+		} else {
+			defaults[field] = donates.Public
+		}
+	}
+	change := bson.M{"$setOnInsert": defaults}
+	if len(set) != 0 {
+		change["$set"] = set
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	privacy := &donates.Privacy{}
+	err := s.privacy.FindOneAndUpdate(ctx, bson.M{"user": user}, change, opts).Decode(privacy)
+	if err != nil {
+		return nil, dberror.ErrMongoHandle(err, "mongo.FindOneAndUpdate err: %s", err)
+	}
+	return privacy, nil
+}
+
+func (s *storageImpl) ensureDonateIndexes(ctx context.Context) error {
+	// Donators of a post
+	_, err := s.donates.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "post", Value: 1}, {Key: "status", Value: 1}},
+	})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.CreateIndex err: %s", err)
+	}
+	return nil
+}
+
+func (s *storageImpl) ensurePrivacyIndexes(ctx context.Context) error {
+	_, err := s.privacy.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.CreateIndex err: %s", err)
+	}
+	return nil
+}
+
+// Check that primary of the donates database is reachable
+func (s *storageImpl) Ping(ctx context.Context) error {
+	err := s.donates.Database().Client().Ping(ctx, readpref.Primary())
+	if err != nil {
+		return dberror.ErrMongoHandle(err, "mongo.Ping err: %s", err)
+	}
+	return nil
+}
+
 func New(log *logrus.Entry, client *mongo.Client) (Storage, error) {
+	return NewWithClock(log, client, donates.SystemClock)
+}
+
+// Create storage stamping updates with time of the clock
+func NewWithClock(log *logrus.Entry, client *mongo.Client, clock donates.Clock) (Storage, error) {
 	switch {
 	case log == nil:
 		return nil, svcerror.ErrInternal("logger is empty")
 	case client == nil:
 		return nil, svcerror.ErrInternal("db client is empty")
+	case clock == nil:
+		return nil, svcerror.ErrInternal("clock is empty")
+	}
+	return newStorage(log, client.Database("tempproj"), clock)
+}
+
+func newStorage(log *logrus.Entry, db *mongo.Database, clock donates.Clock) (*storageImpl, error) {
+	s := &storageImpl{
+		log:        log,
+		donates:    db.Collection("donates"),
+		stats:      db.Collection("donation_stats"),
+		pairs:      db.Collection("donation_pairs"),
+		postStats:  db.Collection("donation_post_stats"),
+		postPairs:  db.Collection("donation_post_pairs"),
+		privacy:    db.Collection("donation_privacy"),
+		moderation: db.Collection("donate_moderation"),
+		receipts:   db.Collection("donate_receipts"),
+		counters:   db.Collection("donate_counters"),
+		exports:    db.Collection("donate_export_jobs"),
+		outbox:     db.Collection("donate_outbox"),
+		payments:   db.Collection("donate_payment_outbox"),
+		clock:      clock,
+	}
+	err := s.ensureDonateIndexes(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	err = s.ensureStatsIndexes(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	err = s.ensurePrivacyIndexes(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	err = s.ensureReceiptIndexes(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	err = s.ensureOutboxIndexes(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	err = s.ensureExportIndexes(context.TODO())
+	if err != nil {
+		return nil, err
 	}
-	return &storageImpl{
-		log:     log,
-		donates: client.Database("tempproj").Collection("donates"),
-	}, nil
+	return s, nil
 }
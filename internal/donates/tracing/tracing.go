@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "tempproj/internal/donates"
+
+// Trace context is carried in W3C format regardless of global propagator
+var propagator = propagation.TraceContext{}
+
+// Start span of donates subsystem with tracer of global provider
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, opts...)
+}
+
+// Mark span as failed, nil error is ignored
+func Fail(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// End span, failed operation marks the span as error
+func End(span trace.Span, err error) {
+	Fail(span, err)
+	span.End()
+}
+
+// Return trace context of ctx to be saved or sent with async message
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Return span context saved by Inject, invalid one if carrier is empty
+func Extract(carrier map[string]string) trace.SpanContext {
+	ctx := propagator.Extract(context.Background(), propagation.MapCarrier(carrier))
+	return trace.SpanContextFromContext(ctx)
+}
+
+// Span start option linking span to the span saved by Inject
+func LinkTo(carrier map[string]string) trace.SpanStartOption {
+	spanContext := Extract(carrier)
+	if !spanContext.IsValid() {
+		return trace.WithLinks()
+	}
+	return trace.WithLinks(trace.Link{SpanContext: spanContext})
+}
+
+func DonateID(id string) attribute.KeyValue {
+	return attribute.String("donate.id", id)
+}
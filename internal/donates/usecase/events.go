@@ -0,0 +1,142 @@
+package usecase
+
+import (
+	"context"
+	"tempproj/internal/donates"
+	"tempproj/internal/donates/lifecycle"
+	"tempproj/internal/donates/metrics"
+	"tempproj/internal/donates/storage"
+	"time"
+)
+
+const (
+	relayInterval = time.Second
+	relayBatch    = 100
+	// Claimed events aren't published by other relays for this long
+	relayLease = time.Minute
+)
+
+// Storage hook saving lifecycle events of the donate's change to the outbox in
+// the transaction of the change, relay publishes them to message queue
+func enqueueEvents(storage storage.Storage, clock donates.Clock, ids donates.IDGenerator) storage.Mutation {
+	return func(ctx context.Context, before, after *donates.Donate) error {
+		prev := lifecycle.NoStatus
+		if before != nil {
+			prev = int(before.Status)
+		}
+		for _, evt := range lifecycle.New(clock, ids, after, prev) {
+			err := storage.AddEvent(ctx, evt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Run storage hooks in order, the first failed one stops the rest
+func mutations(hooks ...storage.Mutation) storage.Mutation {
+	return func(ctx context.Context, before, after *donates.Donate) error {
+		for _, hook := range hooks {
+			err := hook(ctx, before, after)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Count the donate's transition from prev status and its amount in new status
+func observeTransition(m *metrics.Metrics, donate *donates.Donate, prev int) {
+	if prev == int(donate.Status) {
+		return
+	}
+	from := "none"
+	if prev != lifecycle.NoStatus {
+		from = donates.Status(prev).String()
+	}
+	m.Transition(from, donate.Status.String())
+	m.Amount(donate.Status.String(), donate.Amount)
+}
+
+// Publish outbox events and payment requests. Relay claims a batch of events
+// for relayLease, so relays of other instances don't publish them too. Event
+// is marked as sent after publishing, events of failed relay are claimed again
+// when the lease expires, so an event can be published twice but never lost.
+func (u *useCaseImpl) relayEvents(ctx context.Context) {
+	ticker := time.NewTicker(relayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.publishEvents(ctx)
+			u.publishPaymentRequests(ctx)
+		}
+	}
+}
+
+func (u *useCaseImpl) publishEvents(ctx context.Context) {
+	for {
+		events, err := u.storage.ClaimEvents(ctx, u.ids.NewID(), relayBatch, relayLease)
+		if err != nil {
+			u.log.WithError(err).Error("can't claim unsent donate events")
+			return
+		}
+		for i := range events {
+			data, err := lifecycle.Pack(&events[i])
+			if err != nil {
+				u.log.WithField("event_id", events[i].ID).WithError(err).Error("can't pack donate event")
+				return
+			}
+			err = u.mq.Pub(lifecycle.Topic, data)
+			if err != nil {
+				u.log.WithField("event_id", events[i].ID).WithError(err).Error("can't publish donate event")
+				return
+			}
+			err = u.storage.MarkEventSent(ctx, events[i].ID)
+			if err != nil {
+				u.log.WithField("event_id", events[i].ID).WithError(err).Error("can't mark donate event as sent")
+				return
+			}
+		}
+		if len(events) < relayBatch {
+			return
+		}
+	}
+}
+
+// Publish payment requests of approved donates. Like events, a request can be
+// published twice, payments are deduplicated by donate ID.
+func (u *useCaseImpl) publishPaymentRequests(ctx context.Context) {
+	for {
+		requests, err := u.storage.ClaimPaymentRequests(ctx, u.ids.NewID(), relayBatch, relayLease)
+		if err != nil {
+			u.log.WithError(err).Error("can't claim payment requests")
+			return
+		}
+		for _, donateID := range requests {
+			log := u.log.WithField("donate_id", donateID)
+			donate, err := u.storage.GetByID(ctx, donateID)
+			if err != nil {
+				log.WithError(err).Error("can't get donate of payment request")
+				return
+			}
+			err = publishPayment(ctx, u.mq, donate)
+			if err != nil {
+				log.WithError(err).Error("can't publish payment request")
+				return
+			}
+			err = u.storage.MarkPaymentRequested(ctx, donateID)
+			if err != nil {
+				log.WithError(err).Error("can't mark payment request as sent")
+				return
+			}
+		}
+		if len(requests) < relayBatch {
+			return
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package usecase
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"tempproj/internal/donates"
+	"tempproj/pkg/error/svcerror"
+	"tempproj/pkg/utils"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Save progress of export job every exportProgressStep donates, and at
+	// least every exportHeartbeat however slow the export is
+	exportProgressStep = 500
+	exportHeartbeat    = 30 * time.Second
+	exportPollInterval = time.Second
+	// Running export without progress for this long is considered dead
+	exportStaleAfter   = 10 * time.Minute
+	exportReapInterval = time.Minute
+)
+
+type exportWriter interface {
+	Write(donate *donates.Donate) error
+	Flush() error
+}
+
+func exportValue(donate *donates.Donate, field string) interface{} {
+	switch field {
+	case "id":
+		return donate.ID
+	case "from":
+		return donate.From
+	case "to":
+		return donate.To
+	case "post":
+		return donate.Post
+	case "amount":
+		return donate.Amount
+	case "status":
+		return donate.Status
+	case "created":
+		return donate.CreatedAt.UTC().Format(time.RFC3339)
+	case "updated":
+		return donate.UpdatedAt.UTC().Format(time.RFC3339)
+	}
+	return nil
+}
+
+type csvExport struct {
+	w      *csv.Writer
+	fields []string
+	row    []string
+}
+
+func newCSVExport(w io.Writer, fields []string) (*csvExport, error) {
+	e := &csvExport{
+		w:      csv.NewWriter(w),
+		fields: fields,
+		row:    make([]string, len(fields)),
+	}
+	err := e.w.Write(fields)
+	return e, err
+}
+
+func (e *csvExport) Write(donate *donates.Donate) error {
+	for i, field := range e.fields {
+		switch value := exportValue(donate, field).(type) {
+		case string:
+			e.row[i] = value
+		case uint64:
+			e.row[i] = strconv.FormatUint(value, 10)
+		case donates.Status:
+			e.row[i] = strconv.Itoa(int(value))
+		}
+	}
+	return e.w.Write(e.row)
+}
+
+func (e *csvExport) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonExport struct {
+	enc    *json.Encoder
+	fields []string
+}
+
+func (e *ndjsonExport) Write(donate *donates.Donate) error {
+	row := make(map[string]interface{}, len(e.fields))
+	for _, field := range e.fields {
+		row[field] = exportValue(donate, field)
+	}
+	return e.enc.Encode(row)
+}
+
+func (e *ndjsonExport) Flush() error {
+	return nil
+}
+
+// Queue asynchronous export of user's donates, progress is available with GetExportJob
+func (u *useCaseImpl) StartExport(ctx context.Context, user string, req donates.ExportRequest) (*donates.ExportJob, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case user == "":
+		return nil, donates.ErrUnauthenticated
+	case req.Format != donates.ExportCSV && req.Format != donates.ExportNDJSON:
+		return nil, svcerror.ErrInvalidParams("unknown export format: %s", req.Format)
+	}
+	if len(req.Fields) == 0 {
+		req.Fields = donates.ExportFields
+	}
+	available := utils.NewUniqMap(donates.ExportFields)
+	for _, field := range req.Fields {
+		if !available.HasValue(field) {
+			return nil, svcerror.ErrInvalidParams("unknown export field: %s", field)
+		}
+	}
+	req.Filter.User = user
+	job := &donates.ExportJob{
+		ID:        u.ids.NewID(),
+		User:      user,
+		Request:   req,
+		Status:    donates.ExportQueued,
+		CreatedAt: u.clock.Now(),
+	}
+	err := u.storage.CreateExportJob(ctx, job)
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't create export job: %s", err)
+	}
+	return job, nil
+}
+
+// Run queued exports with Config.ExportWorkers workers and fail interrupted
+// ones periodically. Jobs are queued in storage, so instances share the queue
+// and queued jobs survive restarts.
+func (u *useCaseImpl) runExports(ctx context.Context) {
+	u.spawn(u.exportReaper)
+	for i := 0; i < u.config.ExportWorkers; i++ {
+		u.spawn(u.exportWorker)
+	}
+}
+
+// Exports of crashed instances stop sending heartbeats, they are failed by
+// any instance
+func (u *useCaseImpl) exportReaper(ctx context.Context) {
+	ticker := time.NewTicker(exportReapInterval)
+	defer ticker.Stop()
+	for {
+		u.reapExports(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *useCaseImpl) reapExports(ctx context.Context) {
+	reaped, err := u.storage.ReapExportJobs(ctx, u.clock.Now().Add(-exportStaleAfter))
+	if err != nil {
+		u.log.WithError(err).Error("can't fail interrupted exports")
+	}
+	if reaped != 0 {
+		u.log.WithField("exports", reaped).Warn("interrupted exports are failed")
+	}
+}
+
+func (u *useCaseImpl) exportWorker(ctx context.Context) {
+	ticker := time.NewTicker(exportPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for ctx.Err() == nil {
+			job, err := u.storage.ClaimExportJob(ctx)
+			if err != nil {
+				u.log.WithError(err).Error("can't take queued export")
+				break
+			}
+			if job == nil {
+				break
+			}
+			u.runExport(ctx, job)
+		}
+	}
+}
+
+// Export stopped by Close is failed too, the user starts it again
+func (u *useCaseImpl) runExport(ctx context.Context, job *donates.ExportJob) {
+	err := u.export(ctx, job)
+	if err == nil {
+		return
+	}
+	log := u.log.WithFields(logrus.Fields{"export_id": job.ID, "user": job.User})
+	log.WithError(err).Error("export failed")
+	err = u.storage.UpdateExportJob(context.Background(), job.ID, map[string]interface{}{
+		"status":   donates.ExportFailed,
+		"error":    "export failed",
+		"finished": u.clock.Now(),
+	})
+	if err != nil {
+		log.WithError(err).Error("can't update export job")
+	}
+}
+
+func (u *useCaseImpl) export(ctx context.Context, job *donates.ExportJob) error {
+	total, err := u.storage.Count(ctx, job.Request.Filter)
+	if err != nil {
+		return err
+	}
+	err = u.storage.UpdateExportJob(ctx, job.ID, map[string]interface{}{
+		"total":     total,
+		"heartbeat": u.clock.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	upload, err := u.storage.OpenExportUpload(ctx, job.ID+"."+job.Request.Format)
+	if err != nil {
+		return err
+	}
+	var writer exportWriter
+	if job.Request.Format == donates.ExportCSV {
+		writer, err = newCSVExport(upload, job.Request.Fields)
+	} else {
+		writer = &ndjsonExport{enc: json.NewEncoder(upload), fields: job.Request.Fields}
+	}
+	if err != nil {
+		upload.Abort()
+		return err
+	}
+	var processed int64
+	beat := u.clock.Now()
+	err = u.storage.Iterate(ctx, job.Request.Filter, func(donate *donates.Donate) error {
+		err := writer.Write(donate)
+		if err != nil {
+			return err
+		}
+		processed++
+		now := u.clock.Now()
+		if processed%exportProgressStep != 0 && now.Sub(beat) < exportHeartbeat {
+			return nil
+		}
+		beat = now
+		return u.storage.UpdateExportJob(ctx, job.ID, map[string]interface{}{
+			"processed": processed,
+			"heartbeat": now,
+		})
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		upload.Abort()
+		return err
+	}
+	err = upload.Close()
+	if err != nil {
+		return err
+	}
+	return u.storage.UpdateExportJob(ctx, job.ID, map[string]interface{}{
+		"status":    donates.ExportDone,
+		"processed": processed,
+		"file":      upload.ID(),
+		"finished":  u.clock.Now(),
+	})
+}
+
+func (u *useCaseImpl) GetExportJob(ctx context.Context, user, id string) (*donates.ExportJob, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case user == "":
+		return nil, donates.ErrUnauthenticated
+	case id == "":
+		return nil, svcerror.ErrInvalidParams("id is empty")
+	}
+	job, err := u.storage.GetExportJob(ctx, id)
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't get export job: %s", err)
+	}
+	if job.User != user {
+		return nil, donates.ErrNotDonateOwner
+	}
+	return job, nil
+}
+
+// Open result of finished export, caller must close it
+func (u *useCaseImpl) DownloadExport(ctx context.Context, user, id string) (io.ReadCloser, error) {
+	job, err := u.GetExportJob(ctx, user, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.Status != donates.ExportDone {
+		return nil, svcerror.ErrInvalidParams("export isn't finished")
+	}
+	file, err := u.storage.OpenExportDownload(ctx, job.FileID)
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't open export file: %s", err)
+	}
+	return file, nil
+}
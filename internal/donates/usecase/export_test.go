@@ -0,0 +1,200 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"tempproj/internal/donates"
+	"tempproj/internal/donates/donatestest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Storage moving the clock forward before every exported donate and counting
+// heartbeats of export jobs
+type slowExportStorage struct {
+	*donatestest.Storage
+	clock      *donatestest.Clock
+	perDonate  time.Duration
+	heartbeats int
+}
+
+func (s *slowExportStorage) Iterate(ctx context.Context, filter donates.ListFilter, fn func(*donates.Donate) error) error {
+	return s.Storage.Iterate(ctx, filter, func(donate *donates.Donate) error {
+		s.clock.Advance(s.perDonate)
+		return fn(donate)
+	})
+}
+
+func (s *slowExportStorage) UpdateExportJob(ctx context.Context, id string, update map[string]interface{}) error {
+	if _, ok := update["heartbeat"]; ok {
+		s.heartbeats++
+	}
+	return s.Storage.UpdateExportJob(ctx, id, update)
+}
+
+func newExportUseCase(t *testing.T) (*useCaseImpl, *donatestest.Storage, *donatestest.Clock) {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	clock := donatestest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	storage := donatestest.NewStorageWithClock(clock)
+	u := &useCaseImpl{
+		log:     logrus.NewEntry(logger),
+		storage: storage,
+		clock:   clock,
+		ids:     donatestest.NewIDs("export"),
+		config:  DefaultConfig,
+	}
+	return u, storage, clock
+}
+
+func addDonates(t *testing.T, storage *donatestest.Storage, clock *donatestest.Clock, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		donate := &donates.Donate{
+			ID:        "donate-" + string(rune('a'+i%26)) + string(rune('a'+i/26)),
+			From:      "donor",
+			To:        "author",
+			Amount:    100,
+			CreatedAt: clock.Now(),
+			UpdatedAt: clock.Now(),
+		}
+		err := storage.Create(context.Background(), donate, nil)
+		if err != nil {
+			t.Fatalf("Create: %s", err)
+		}
+	}
+}
+
+func exportResult(t *testing.T, u *useCaseImpl, user, id string) string {
+	t.Helper()
+	file, err := u.DownloadExport(context.Background(), user, id)
+	if err != nil {
+		t.Fatalf("DownloadExport: %s", err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("read export: %s", err)
+	}
+	return string(data)
+}
+
+func TestExportWritesSelectedFields(t *testing.T) {
+	cases := []struct {
+		format string
+		want   string
+	}{
+		{donates.ExportCSV, "id,amount\ndonate-aa,100\n"},
+		{donates.ExportNDJSON, `{"amount":100,"id":"donate-aa"}` + "\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.format, func(t *testing.T) {
+			u, storage, clock := newExportUseCase(t)
+			ctx := context.Background()
+			addDonates(t, storage, clock, 1)
+			job, err := u.StartExport(ctx, "donor", donates.ExportRequest{
+				Format: c.format,
+				Filter: donates.ListFilter{Direction: donates.Sent},
+				Fields: []string{"id", "amount"},
+			})
+			if err != nil {
+				t.Fatalf("StartExport: %s", err)
+			}
+			err = u.export(ctx, job)
+			if err != nil {
+				t.Fatalf("export: %s", err)
+			}
+			if got := exportResult(t, u, "donor", job.ID); got != c.want {
+				t.Errorf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestStartExportRejectsUnknownField(t *testing.T) {
+	u, _, _ := newExportUseCase(t)
+	_, err := u.StartExport(context.Background(), "donor", donates.ExportRequest{
+		Format: donates.ExportCSV,
+		Fields: []string{"id", "payment_url"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "payment_url") {
+		t.Errorf("got %v, want unknown field error", err)
+	}
+}
+
+func TestExportJobBelongsToUser(t *testing.T) {
+	u, _, _ := newExportUseCase(t)
+	ctx := context.Background()
+	job, err := u.StartExport(ctx, "donor", donates.ExportRequest{Format: donates.ExportCSV})
+	if err != nil {
+		t.Fatalf("StartExport: %s", err)
+	}
+	_, err = u.GetExportJob(ctx, "author", job.ID)
+	if !errors.Is(err, donates.ErrNotDonateOwner) {
+		t.Errorf("got %v for job of another user, want ErrNotDonateOwner", err)
+	}
+	_, err = u.DownloadExport(ctx, "author", job.ID)
+	if !errors.Is(err, donates.ErrNotDonateOwner) {
+		t.Errorf("got %v for download by another user, want ErrNotDonateOwner", err)
+	}
+}
+
+func TestSlowExportSendsHeartbeats(t *testing.T) {
+	u, storage, clock := newExportUseCase(t)
+	ctx := context.Background()
+	// Far fewer donates than progress step, each written for 20 seconds
+	addDonates(t, storage, clock, 10)
+	slow := &slowExportStorage{Storage: storage, clock: clock, perDonate: 20 * time.Second}
+	u.storage = slow
+	job, err := u.StartExport(ctx, "donor", donates.ExportRequest{
+		Format: donates.ExportCSV,
+		Filter: donates.ListFilter{Direction: donates.Sent},
+	})
+	if err != nil {
+		t.Fatalf("StartExport: %s", err)
+	}
+	err = u.export(ctx, job)
+	if err != nil {
+		t.Fatalf("export: %s", err)
+	}
+	// Start of the export and then every other donate
+	if slow.heartbeats != 6 {
+		t.Errorf("sent %d heartbeats in %s, want 6", slow.heartbeats, 10*slow.perDonate)
+	}
+}
+
+func TestReapExportsFailsStaleJobs(t *testing.T) {
+	u, storage, clock := newExportUseCase(t)
+	ctx := context.Background()
+	job, err := u.StartExport(ctx, "donor", donates.ExportRequest{Format: donates.ExportCSV})
+	if err != nil {
+		t.Fatalf("StartExport: %s", err)
+	}
+	_, err = storage.ClaimExportJob(ctx)
+	if err != nil {
+		t.Fatalf("ClaimExportJob: %s", err)
+	}
+	clock.Advance(exportStaleAfter - time.Second)
+	u.reapExports(ctx)
+	running, err := u.GetExportJob(ctx, "donor", job.ID)
+	if err != nil {
+		t.Fatalf("GetExportJob: %s", err)
+	}
+	if running.Status != donates.ExportRunning {
+		t.Fatalf("job with fresh heartbeat is %s, want running", running.Status)
+	}
+	clock.Advance(time.Second + time.Millisecond)
+	u.reapExports(ctx)
+	reaped, err := u.GetExportJob(ctx, "donor", job.ID)
+	if err != nil {
+		t.Fatalf("GetExportJob: %s", err)
+	}
+	if reaped.Status != donates.ExportFailed {
+		t.Errorf("stale job is %s, want failed", reaped.Status)
+	}
+}
@@ -0,0 +1,153 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"tempproj/internal/donates"
+	"time"
+)
+
+const (
+	heartbeatInterval = 5 * time.Second
+	// Delay before resubscribing doubles after every failure up to max
+	resubscribeDelay    = time.Second
+	maxResubscribeDelay = 30 * time.Second
+	// Handler is considered dead after missing this many heartbeats
+	missedHeartbeats = 3
+	// Payment updates waiting longer mean workers don't keep up
+	maxPaymentAge = time.Minute
+	pingTimeout   = 2 * time.Second
+)
+
+// probe is updated by handler goroutines and read by health checks
+type probe struct {
+	heartbeat  int64 // unix nano
+	subscribed int32
+
+	mu sync.Mutex
+	// Receive times of payment updates queued to every worker, in order
+	// they are handled
+	backlog map[int][]time.Time
+}
+
+func (p *probe) beat() {
+	atomic.StoreInt64(&p.heartbeat, time.Now().UnixNano())
+}
+
+func (p *probe) setSubscribed(subscribed bool) {
+	var value int32
+	if subscribed {
+		value = 1
+	}
+	atomic.StoreInt32(&p.subscribed, value)
+}
+
+func (p *probe) lastBeat() time.Time {
+	nano := atomic.LoadInt64(&p.heartbeat)
+	if nano == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nano)
+}
+
+func (p *probe) isSubscribed() bool {
+	return atomic.LoadInt32(&p.subscribed) == 1
+}
+
+// Payment update is queued to the worker
+func (p *probe) queued(worker int, received time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.backlog == nil {
+		p.backlog = map[int][]time.Time{}
+	}
+	p.backlog[worker] = append(p.backlog[worker], received)
+}
+
+// The worker handled its oldest payment update
+func (p *probe) handled(worker int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.backlog[worker]) != 0 {
+		p.backlog[worker] = p.backlog[worker][1:]
+	}
+}
+
+// Payment update queued last to the worker didn't reach it
+func (p *probe) dropped(worker int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if queue := p.backlog[worker]; len(queue) != 0 {
+		p.backlog[worker] = queue[:len(queue)-1]
+	}
+}
+
+// Receive time of the oldest payment update that isn't handled yet, zero
+// time if there is none
+func (p *probe) oldestPayment() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var oldest time.Time
+	for _, queue := range p.backlog {
+		if len(queue) != 0 && (oldest.IsZero() || queue[0].Before(oldest)) {
+			oldest = queue[0]
+		}
+	}
+	return oldest
+}
+
+// Wait for the delay beating on every heartbeat tick, so waiting handler
+// isn't considered dead. Returns false if ctx is done before the delay.
+func (p *probe) wait(ctx context.Context, delay time.Duration, heartbeat <-chan time.Time) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-heartbeat:
+			p.beat()
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func nextResubscribeDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > maxResubscribeDelay {
+		return maxResubscribeDelay
+	}
+	return delay
+}
+
+func (u *useCaseImpl) Health(ctx context.Context) *donates.Health {
+	health := &donates.Health{
+		Subscribed: u.probe.isSubscribed(),
+		Heartbeat:  u.probe.lastBeat(),
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	err := u.storage.Ping(pingCtx)
+	health.Storage = err == nil
+	if err != nil {
+		health.Problems = append(health.Problems, fmt.Sprintf("storage: %s", err))
+	}
+	if !health.Subscribed {
+		health.Problems = append(health.Problems, "payment updates aren't subscribed")
+	}
+	if time.Since(health.Heartbeat) > missedHeartbeats*heartbeatInterval {
+		health.Problems = append(health.Problems, "payment updates handler doesn't respond")
+	}
+	oldest := u.probe.oldestPayment()
+	if !oldest.IsZero() {
+		health.OldestPaymentAge = time.Since(oldest)
+		if health.OldestPaymentAge > maxPaymentAge {
+			health.Problems = append(health.Problems, fmt.Sprintf("payment updates aren't handled for %s", health.OldestPaymentAge))
+		}
+	}
+	health.Healthy = len(health.Problems) == 0
+	return health
+}
@@ -0,0 +1,50 @@
+package usecase
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newDispatchUseCase() *useCaseImpl {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return &useCaseImpl{log: logrus.NewEntry(logger)}
+}
+
+func TestDispatchToFullQueueStopsWithCtx(t *testing.T) {
+	u := newDispatchUseCase()
+	// Worker that never reads its queue
+	workers := []chan paymentEvent{make(chan paymentEvent)}
+	ctx, cancel := context.WithCancel(context.Background())
+	heartbeat := make(chan time.Time)
+	done := make(chan bool)
+	go func() {
+		done <- u.dispatch(ctx, workers, paymentEvent{received: time.Now()}, heartbeat)
+	}()
+
+	// Stalled handler still beats, the stall is seen as backlog
+	heartbeat <- time.Now()
+	if u.probe.lastBeat().IsZero() {
+		t.Error("handler doesn't beat while worker's queue is full")
+	}
+	if u.probe.oldestPayment().IsZero() {
+		t.Error("waiting payment update isn't in backlog")
+	}
+
+	cancel()
+	select {
+	case queued := <-done:
+		if queued {
+			t.Error("dispatch reports update queued to stalled worker")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dispatch blocks after ctx is done")
+	}
+	if oldest := u.probe.oldestPayment(); !oldest.IsZero() {
+		t.Errorf("dropped payment update is left in backlog since %s", oldest)
+	}
+}
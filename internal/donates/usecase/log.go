@@ -0,0 +1,27 @@
+package usecase
+
+import (
+	"context"
+	"tempproj/internal/donates"
+	"tempproj/internal/donates/audit"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Keep correlation ID in ctx, so logs and audit entries of one request share
+// it. Request without one gets new ID of ids.
+func withCorrelation(ctx context.Context, ids donates.IDGenerator) context.Context {
+	if audit.CorrelationID(ctx) != "" {
+		return ctx
+	}
+	return audit.WithCorrelationID(ctx, ids.NewID())
+}
+
+// Logger with correlation ID of ctx and fields of the donate if it's known
+func donateLog(ctx context.Context, log *logrus.Entry, donate *donates.Donate) *logrus.Entry {
+	entry := log.WithField("correlation_id", audit.CorrelationID(ctx))
+	if donate != nil {
+		entry = entry.WithFields(donate.LogFields())
+	}
+	return entry
+}
@@ -0,0 +1,113 @@
+package usecase
+
+import (
+	"context"
+	"tempproj/internal/donates"
+	"tempproj/pkg/error/svcerror"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// IDs of a lookup are requested from storage by chunks in parallel
+const lookupChunk = 100
+
+// Return short donates in order of ids, unknown ids are skipped. Donates of
+// every status are returned, callers showing them to users check visibility
+// themselves or use LookupDonates
+func (u *useCaseImpl) GetDonatesByIDs(ctx context.Context, ids []string) ([]donates.Short, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case ids == nil:
+		return nil, svcerror.ErrInvalidParams("ids is empty")
+	case len(ids) == 0:
+		return []donates.Short{}, nil
+	case len(ids) > donates.MaxLookupIDs:
+		return nil, svcerror.ErrInvalidParams("too many ids, max %d", donates.MaxLookupIDs)
+	}
+	found, err := u.lookup(ctx, ids, donates.ProjectShort)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]donates.Short, 0, len(found))
+	for _, id := range ids {
+		if donate, ok := found[id]; ok {
+			result = append(result, *donate.Short())
+		}
+	}
+	return result, nil
+}
+
+// Return result for every id in the same order. Full projection is available
+// to donors and recipients only, other projections show confirmed donates only.
+// Other donates are reported as not found.
+func (u *useCaseImpl) LookupDonates(ctx context.Context, user string, ids []string, projection donates.Projection) ([]donates.LookupResult, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case !projection.Valid():
+		return nil, svcerror.ErrInvalidParams("unknown projection: %s", projection)
+	case projection == donates.ProjectFull && user == "":
+		return nil, donates.ErrUnauthenticated
+	case len(ids) > donates.MaxLookupIDs:
+		return nil, svcerror.ErrInvalidParams("too many ids, max %d", donates.MaxLookupIDs)
+	}
+	result := make([]donates.LookupResult, 0, len(ids))
+	if len(ids) == 0 {
+		return result, nil
+	}
+	found, err := u.lookup(ctx, ids, projection)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		item := donates.LookupResult{ID: id}
+		donate, ok := found[id]
+		switch {
+		case !ok:
+		case projection == donates.ProjectFull && (donate.From == user || donate.To == user),
+			projection != donates.ProjectFull && donate.Status == donates.Confirmed:
+			item.Donate = donate
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+// Get donates by uniq ids split into chunks
+func (u *useCaseImpl) lookup(ctx context.Context, ids []string, projection donates.Projection) (map[string]*donates.Donate, error) {
+	uniq := make([]string, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			uniq = append(uniq, id)
+		}
+	}
+	chunks := make([][]donates.Donate, (len(uniq)+lookupChunk-1)/lookupChunk)
+	group, groupCtx := errgroup.WithContext(ctx)
+	for i := range chunks {
+		i := i
+		end := (i + 1) * lookupChunk
+		if end > len(uniq) {
+			end = len(uniq)
+		}
+		chunk := uniq[i*lookupChunk : end]
+		group.Go(func() error {
+			list, err := u.storage.GetByIDs(groupCtx, chunk, projection)
+			chunks[i] = list
+			return err
+		})
+	}
+	err := group.Wait()
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't get donates by ids: %s", err)
+	}
+	result := make(map[string]*donates.Donate, len(uniq))
+	for _, list := range chunks {
+		for i := range list {
+			result[list[i].ID] = &list[i]
+		}
+	}
+	return result, nil
+}
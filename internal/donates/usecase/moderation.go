@@ -0,0 +1,315 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"tempproj/internal/donates"
+	"tempproj/internal/donates/audit"
+	"tempproj/internal/donates/cache"
+	"tempproj/internal/donates/metrics"
+	"tempproj/internal/donates/storage"
+	"tempproj/internal/types"
+	"tempproj/pkg/error/svcerror"
+	"tempproj/pkg/event"
+
+	"github.com/sirupsen/logrus"
+)
+
+const maxReviewPage = 100
+
+// Notification type of moderation outcome, payload has id, status and reason
+// of rejection
+const ModerationNotification event.Type = "donate_moderation"
+
+// Admins is a part of users.UseCase that knows who can moderate donates
+type Admins interface {
+	IsAdmin(ctx context.Context, user string) (bool, error)
+}
+
+type moderationImpl struct {
+	log           *logrus.Entry
+	storage       storage.Storage
+	notifications Notifications
+	admins        Admins
+	audit         audit.Log
+	metrics       *metrics.Metrics
+	cache         cache.Cache
+	clock         donates.Clock
+	ids           donates.IDGenerator
+}
+
+func (m *moderationImpl) ListForReview(ctx context.Context, filter donates.ReviewFilter, page types.PageOpt) ([]donates.Donate, error) {
+	if ctx == nil {
+		return nil, svcerror.ErrInternal("ctx is empty")
+	}
+	if page.Limit <= 0 || page.Limit > maxReviewPage {
+		page.Limit = maxReviewPage
+	}
+	result, err := m.storage.GetByStatus(ctx, donates.Review, filter, page)
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't get donates under review: %s", err)
+	}
+	return result, nil
+}
+
+// Approve held donate. Payment request is saved with the approval and sent by
+// outbox relay.
+func (m *moderationImpl) ApproveDonate(ctx context.Context, donateID, moderator string) (*donates.Donate, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case donateID == "":
+		return nil, svcerror.ErrInvalidParams("donate is empty")
+	case moderator == "":
+		return nil, svcerror.ErrInvalidParams("moderator is empty")
+	}
+	donate, err := m.decide(ctx, donateID, moderator, true, "")
+	if err != nil {
+		return nil, err
+	}
+	m.notify(ctx, donate, "approved", "")
+	return donate, nil
+}
+
+func (m *moderationImpl) RejectDonate(ctx context.Context, donateID, moderator, reason string) (*donates.Donate, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case donateID == "":
+		return nil, svcerror.ErrInvalidParams("donate is empty")
+	case moderator == "":
+		return nil, svcerror.ErrInvalidParams("moderator is empty")
+	case reason == "":
+		return nil, svcerror.ErrInvalidParams("reason is empty")
+	}
+	donate, err := m.decide(ctx, donateID, moderator, false, reason)
+	if err != nil {
+		return nil, err
+	}
+	m.notify(ctx, donate, "rejected", reason)
+	return donate, nil
+}
+
+func (m *moderationImpl) GetDecisions(ctx context.Context, donateID string) ([]donates.ModerationDecision, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case donateID == "":
+		return nil, svcerror.ErrInvalidParams("donate is empty")
+	}
+	decisions, err := m.storage.GetDecisions(ctx, donateID)
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't get moderation decisions: %s", err)
+	}
+	return decisions, nil
+}
+
+func (m *moderationImpl) GetAuditLog(ctx context.Context, donateID string) ([]audit.Entry, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case donateID == "":
+		return nil, svcerror.ErrInvalidParams("donate is empty")
+	}
+	entries, err := m.audit.GetByDonate(ctx, donateID)
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't get audit log: %s", err)
+	}
+	return entries, nil
+}
+
+func (m *moderationImpl) FindAuditLog(ctx context.Context, filter audit.Filter, page types.PageOpt) ([]audit.Entry, error) {
+	if ctx == nil {
+		return nil, svcerror.ErrInternal("ctx is empty")
+	}
+	if page.Limit <= 0 || page.Limit > maxReviewPage {
+		page.Limit = maxReviewPage
+	}
+	entries, err := m.audit.Find(ctx, filter, page)
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't find audit entries: %s", err)
+	}
+	return entries, nil
+}
+
+func (m *moderationImpl) VerifyAuditLog(ctx context.Context, donateID string) error {
+	switch {
+	case ctx == nil:
+		return svcerror.ErrInternal("ctx is empty")
+	case donateID == "":
+		return svcerror.ErrInvalidParams("donate is empty")
+	}
+	entries, err := m.audit.GetByDonate(ctx, donateID)
+	if err != nil {
+		return svcerror.HandleError(err, "can't get audit log: %s", err)
+	}
+	if len(entries) == 0 {
+		// Versioned donates are created with audit entry, empty chain of
+		// such donate is removed with its head
+		donate, err := m.storage.GetByID(ctx, donateID)
+		if err != nil {
+			return svcerror.HandleError(err, "can't get donate: %s", err)
+		}
+		if donate.Version >= 1 {
+			m.log.WithField("donate_id", donateID).Error("audit log of donate is missing")
+			return audit.ErrTampered
+		}
+	}
+	return m.audit.Verify(ctx, donateID)
+}
+
+func (m *moderationImpl) RebuildStats(ctx context.Context, moderator string) error {
+	switch {
+	case ctx == nil:
+		return svcerror.ErrInternal("ctx is empty")
+	case moderator == "":
+		return svcerror.ErrInvalidParams("moderator is empty")
+	}
+	err := m.checkModerator(ctx, moderator)
+	if err != nil {
+		return err
+	}
+	m.log.WithField("moderator", moderator).Info("rebuild donation stats")
+	err = m.storage.RebuildStats(ctx)
+	if errors.Is(err, donates.ErrStatsRebuilding) {
+		return err
+	}
+	if err != nil {
+		return svcerror.HandleError(err, "can't rebuild donation stats: %s", err)
+	}
+	// Cached counters of every user may be stale now
+	err = m.cache.Flush(ctx)
+	if err != nil {
+		m.log.WithError(err).Warn("can't flush cached donation data")
+	}
+	return nil
+}
+
+// Move donate out of review. Decision, lifecycle events, payment request of
+// approved donate and audit entry are saved in the same transaction.
+func (m *moderationImpl) decide(ctx context.Context, donateID, moderator string, approved bool, reason string) (*donates.Donate, error) {
+	err := m.checkModerator(ctx, moderator)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withCorrelation(ctx, m.ids)
+	status := donates.Denied
+	if approved {
+		status = donates.New
+	}
+	changes := map[string]interface{}{"status": status}
+	if reason != "" {
+		changes["reason"] = reason
+	}
+	hooks := []storage.Mutation{
+		enqueueEvents(m.storage, m.clock, m.ids),
+		func(ctx context.Context, before, after *donates.Donate) error {
+			return m.storage.AddDecision(ctx, &donates.ModerationDecision{
+				DonateID:   after.ID,
+				Moderator:  moderator,
+				Approved:   approved,
+				Reason:     reason,
+				RiskReason: after.RiskReason,
+				CreatedAt:  m.clock.Now(),
+			})
+		},
+	}
+	if approved {
+		hooks = append(hooks, func(ctx context.Context, before, after *donates.Donate) error {
+			return m.storage.AddPaymentRequest(ctx, after.ID)
+		})
+	}
+	hooks = append(hooks, recordAudit(m.audit, audit.Entry{
+		Action:  audit.Update,
+		Actor:   moderator,
+		Source:  audit.Admin,
+		Changes: audit.Changes(changes),
+	}))
+	donate, err := m.storage.UpdateIfStatus(ctx, donateID, donates.Review, map[string]interface{}{
+		"status": status,
+	}, mutations(hooks...))
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't update donate: %s", err)
+	}
+	if donate == nil {
+		return nil, donates.ErrNotInReview
+	}
+	observeTransition(m.metrics, donate, int(donates.Review))
+	return donate, nil
+}
+
+// Return error if the user isn't allowed to moderate donates
+func (m *moderationImpl) checkModerator(ctx context.Context, moderator string) error {
+	isAdmin, err := m.admins.IsAdmin(ctx, moderator)
+	if err != nil {
+		return svcerror.ErrInternal("can't check user's permissions: %s", err)
+	}
+	if !isAdmin {
+		return donates.ErrNotModerator
+	}
+	return nil
+}
+
+func (m *moderationImpl) notify(ctx context.Context, donate *donates.Donate, status, reason string) {
+	payload := map[string]interface{}{
+		"id":     donate.ID,
+		"status": status,
+	}
+	if reason != "" {
+		payload["reason"] = reason
+	}
+	err := m.notifications.Notify(ctx, ModerationNotification, payload, donate.From)
+	if err != nil {
+		donateLog(ctx, m.log, donate).WithError(err).Warn("can't send notification to user")
+	}
+}
+
+// Create moderation service. Cache of WithCache is flushed after stats rebuild,
+// so it must be the one of donates service.
+func NewModeration(
+	log *logrus.Entry,
+	storage storage.Storage,
+	notifications Notifications,
+	admins Admins,
+	auditLog audit.Log,
+	metrics *metrics.Metrics,
+	opts ...Option,
+) (
+	donates.Moderation,
+	error,
+) {
+	switch {
+	case log == nil:
+		return nil, svcerror.ErrInternal("logger is empty")
+	case storage == nil:
+		return nil, svcerror.ErrInternal("storage is empty")
+	case notifications == nil:
+		return nil, svcerror.ErrInternal("notifications is empty")
+	case admins == nil:
+		return nil, svcerror.ErrInternal("admins service is empty")
+	case auditLog == nil:
+		return nil, svcerror.ErrInternal("audit log is empty")
+	case metrics == nil:
+		return nil, svcerror.ErrInternal("metrics is empty")
+	}
+	o := newOptions(opts)
+	switch {
+	case o.clock == nil:
+		return nil, svcerror.ErrInternal("clock is empty")
+	case o.ids == nil:
+		return nil, svcerror.ErrInternal("id generator is empty")
+	case o.cache == nil:
+		return nil, svcerror.ErrInternal("cache is empty")
+	}
+	return &moderationImpl{
+		log:           log,
+		storage:       storage,
+		notifications: notifications,
+		admins:        admins,
+		audit:         auditLog,
+		metrics:       metrics,
+		cache:         o.cache,
+		clock:         o.clock,
+		ids:           o.ids,
+	}, nil
+}
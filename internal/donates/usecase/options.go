@@ -0,0 +1,127 @@
+package usecase
+
+import (
+	"tempproj/internal/donates"
+	"tempproj/internal/donates/audit"
+	"tempproj/internal/donates/cache"
+	"tempproj/internal/donates/risk"
+	"tempproj/pkg/messagequeue"
+)
+
+// Config of donates service, zero fields are replaced with DefaultConfig values
+type Config struct {
+	MinAmount  uint64 // minimal donate amount in hundredths
+	BufferSize int    // buffer of message queue created by the service
+	Workers    int    // goroutines handling payment updates
+	// Exports run at once by the instance, the rest wait in queue
+	ExportWorkers int
+	// Decision for donates whose risk rule failed, Allow fails open
+	RiskOnError risk.Decision
+	// Platform fee in basis points of donate amount, shown in receipts. Zero
+	// is a valid fee, so it isn't replaced with default.
+	FeeBasisPoints uint64
+}
+
+var DefaultConfig = Config{
+	MinAmount:     minDonateValue,
+	BufferSize:    1024,
+	Workers:       1,
+	ExportWorkers: 2,
+}
+
+func (c Config) withDefaults() Config {
+	if c.MinAmount == 0 {
+		c.MinAmount = DefaultConfig.MinAmount
+	}
+	if c.BufferSize <= 0 {
+		c.BufferSize = DefaultConfig.BufferSize
+	}
+	if c.Workers <= 0 {
+		c.Workers = DefaultConfig.Workers
+	}
+	if c.ExportWorkers <= 0 {
+		c.ExportWorkers = DefaultConfig.ExportWorkers
+	}
+	return c
+}
+
+type options struct {
+	mq     messagequeue.MessageQueue
+	clock  donates.Clock
+	ids    donates.IDGenerator
+	config Config
+	// Empty rules are valid, so they are told from unset ones by rulesSet
+	rules    []risk.Rule
+	rulesSet bool
+	cache    cache.Cache
+	// Services New doesn't take as arguments
+	users    Users
+	posts    Posts
+	auditLog audit.Log
+}
+
+type Option func(*options)
+
+// Use the message queue instead of creating redis one, redis isn't required then
+func WithMessageQueue(mq messagequeue.MessageQueue) Option {
+	return func(o *options) {
+		o.mq = mq
+	}
+}
+
+func WithClock(clock donates.Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+func WithIDGenerator(ids donates.IDGenerator) Option {
+	return func(o *options) {
+		o.ids = ids
+	}
+}
+
+// Score new donates with the rules instead of risk.DefaultRules, no rules turn
+// risk checks off
+func WithRiskRules(rules ...risk.Rule) Option {
+	return func(o *options) {
+		o.rules = rules
+		o.rulesSet = true
+	}
+}
+
+// Share the cache between services, so moderation can drop counters of the
+// donates service. Services create their own redis cache if it isn't set.
+func WithCache(c cache.Cache) Option {
+	return func(o *options) {
+		o.cache = c
+	}
+}
+
+// Pass services to deprecated New, NewWithDeps takes them as arguments and
+// ignores the option
+func WithServices(users Users, posts Posts, auditLog audit.Log) Option {
+	return func(o *options) {
+		o.users = users
+		o.posts = posts
+		o.auditLog = auditLog
+	}
+}
+
+func WithConfig(config Config) Option {
+	return func(o *options) {
+		o.config = config
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		clock: donates.SystemClock,
+		ids:   donates.XIDs,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.config = o.config.withDefaults()
+	return o
+}
@@ -0,0 +1,54 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"tempproj/internal/donates"
+	"time"
+)
+
+const (
+	conflictAttempts = 5
+	conflictBackoff  = 10 * time.Millisecond
+)
+
+// Failed read of read-modify-write, it's retried like a conflict
+type readError struct {
+	err error
+}
+
+func (e *readError) Error() string {
+	return e.err.Error()
+}
+
+func (e *readError) Unwrap() error {
+	return e.err
+}
+
+func retriable(err error) bool {
+	var read *readError
+	return errors.Is(err, donates.ErrVersionConflict) || errors.As(err, &read)
+}
+
+// Run read-modify-write fn again while it fails with version conflict or
+// readError. fn must read the donate again on every call to get its current
+// version. Waiting between attempts stops when ctx is done.
+func retryOnConflict(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < conflictAttempts; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(time.Duration(attempt) * conflictBackoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			case <-timer.C:
+			}
+		}
+		err = fn()
+		if !retriable(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"tempproj/internal/donates"
+	"testing"
+)
+
+func TestRetryOnConflictRetriesConflictsAndReads(t *testing.T) {
+	failures := []error{donates.ErrVersionConflict, &readError{errors.New("mongo is down")}}
+	calls := 0
+	err := retryOnConflict(context.Background(), func() error {
+		calls++
+		if calls <= len(failures) {
+			return failures[calls-1]
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("retryOnConflict: %s", err)
+	}
+	if calls != len(failures)+1 {
+		t.Errorf("fn is called %d times, want %d", calls, len(failures)+1)
+	}
+}
+
+func TestRetryOnConflictStopsOnOtherErrors(t *testing.T) {
+	calls := 0
+	err := retryOnConflict(context.Background(), func() error {
+		calls++
+		return donates.ErrBadTransition
+	})
+	if !errors.Is(err, donates.ErrBadTransition) || calls != 1 {
+		t.Errorf("got %v after %d calls, want bad transition after 1", err, calls)
+	}
+}
+
+func TestRetryOnConflictGivesUp(t *testing.T) {
+	calls := 0
+	err := retryOnConflict(context.Background(), func() error {
+		calls++
+		return donates.ErrVersionConflict
+	})
+	if !errors.Is(err, donates.ErrVersionConflict) || calls != conflictAttempts {
+		t.Errorf("got %v after %d calls, want conflict after %d", err, calls, conflictAttempts)
+	}
+}
+
+func TestRetryOnConflictStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := retryOnConflict(ctx, func() error {
+		calls++
+		cancel()
+		return donates.ErrVersionConflict
+	})
+	if !errors.Is(err, donates.ErrVersionConflict) || calls != 1 {
+		t.Errorf("got %v after %d calls, want conflict after 1", err, calls)
+	}
+}
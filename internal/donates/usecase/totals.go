@@ -0,0 +1,96 @@
+package usecase
+
+import (
+	"context"
+	"tempproj/internal/donates"
+	"tempproj/pkg/error/svcerror"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Authors of posts without donates are requested from posts service in
+// parallel, at most this many at once
+const authorLookups = 10
+
+// Return sum, number and unique donors of confirmed donates to the post
+func (u *useCaseImpl) GetPostTotals(ctx context.Context, post string) (*donates.PostTotals, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case post == "":
+		return nil, svcerror.ErrInvalidParams("post is empty")
+	}
+	totals, err := u.GetPostsTotals(ctx, []string{post})
+	if err != nil {
+		return nil, err
+	}
+	if totals[0].Author == "" {
+		return nil, donates.ErrPostNotFound
+	}
+	return &totals[0], nil
+}
+
+// Return totals for every post in the same order, posts without confirmed
+// donates get zero totals. Author is resolved for every post, it stays empty
+// only for posts that don't exist.
+func (u *useCaseImpl) GetPostsTotals(ctx context.Context, posts []string) ([]donates.PostTotals, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case posts == nil:
+		return nil, svcerror.ErrInvalidParams("posts is empty")
+	case len(posts) > donates.MaxPostsTotals:
+		return nil, svcerror.ErrInvalidParams("too many posts, max %d", donates.MaxPostsTotals)
+	}
+	result := make([]donates.PostTotals, 0, len(posts))
+	if len(posts) == 0 {
+		return result, nil
+	}
+	uniq := make([]string, 0, len(posts))
+	seen := make(map[string]bool, len(posts))
+	for _, post := range posts {
+		if post == "" {
+			return nil, svcerror.ErrInvalidParams("post is empty")
+		}
+		if !seen[post] {
+			seen[post] = true
+			uniq = append(uniq, post)
+		}
+	}
+	found, err := u.storage.GetPostTotals(ctx, uniq)
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't get post totals: %s", err)
+	}
+	byPost := make(map[string]donates.PostTotals, len(found))
+	for _, totals := range found {
+		byPost[totals.Post] = totals
+	}
+	missing := make([]string, 0, len(uniq))
+	for _, post := range uniq {
+		if _, ok := byPost[post]; !ok {
+			missing = append(missing, post)
+		}
+	}
+	authors := make([]string, len(missing))
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.SetLimit(authorLookups)
+	for i, post := range missing {
+		i, post := i, post
+		group.Go(func() error {
+			author, err := u.posts.GetAuthor(groupCtx, post)
+			authors[i] = author
+			return err
+		})
+	}
+	err = group.Wait()
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't get post author: %s", err)
+	}
+	for i, post := range missing {
+		byPost[post] = donates.PostTotals{Post: post, Author: authors[i]}
+	}
+	for _, post := range posts {
+		result = append(result, byPost[post])
+	}
+	return result, nil
+}
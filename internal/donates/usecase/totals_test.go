@@ -0,0 +1,54 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"tempproj/internal/donates/donatestest"
+	"testing"
+	"time"
+)
+
+// Posts counting lookups running at once
+type slowPosts struct {
+	*donatestest.Posts
+	mu        sync.Mutex
+	running   int
+	maxAtOnce int
+}
+
+func (p *slowPosts) GetAuthor(ctx context.Context, post string) (string, error) {
+	p.mu.Lock()
+	p.running++
+	if p.running > p.maxAtOnce {
+		p.maxAtOnce = p.running
+	}
+	p.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	p.mu.Lock()
+	p.running--
+	p.mu.Unlock()
+	return p.Posts.GetAuthor(ctx, post)
+}
+
+func TestPostsTotalsLookUpAuthorsInParallel(t *testing.T) {
+	posts := &slowPosts{Posts: donatestest.NewPosts()}
+	ids := make([]string, 3*authorLookups)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("post-%d", i)
+		posts.Add(ids[i], fmt.Sprintf("author-%d", i))
+	}
+	u := &useCaseImpl{log: discardLog(), storage: donatestest.NewStorage(), posts: posts}
+	totals, err := u.GetPostsTotals(context.Background(), ids)
+	if err != nil {
+		t.Fatalf("GetPostsTotals: %s", err)
+	}
+	for i, post := range totals {
+		if post.Post != ids[i] || post.Author != fmt.Sprintf("author-%d", i) {
+			t.Errorf("got %+v at %d, want %s of author-%d", post, i, ids[i], i)
+		}
+	}
+	if posts.maxAtOnce < 2 || posts.maxAtOnce > authorLookups {
+		t.Errorf("%d authors are looked up at once, want 2 to %d", posts.maxAtOnce, authorLookups)
+	}
+}
@@ -0,0 +1,146 @@
+package usecase
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"tempproj/internal/donates"
+	"tempproj/internal/donates/donatestest"
+	"tempproj/pkg/messagequeue"
+	"tempproj/pkg/payment"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Message queue keeping published messages
+type publishedMQ struct {
+	messagequeue.MessageQueue
+	messages [][]byte
+}
+
+func (mq *publishedMQ) Pub(topic string, data []byte) error {
+	mq.messages = append(mq.messages, data)
+	return nil
+}
+
+// Record spans of global tracer provider until the test ends
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prev)
+		_ = provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+func findSpan(t *testing.T, exporter *tracetest.InMemoryExporter, name string) tracetest.SpanStub {
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no %q span", name)
+	return tracetest.SpanStub{}
+}
+
+func TestPaymentUpdateLinkedToPaymentRequest(t *testing.T) {
+	exporter := recordSpans(t)
+	mq := &publishedMQ{}
+	donate := &donates.Donate{ID: "donate-1", From: "donor", To: "author", Amount: 5000}
+	err := publishPayment(context.Background(), mq, donate)
+	if err != nil {
+		t.Fatalf("publishPayment: %s", err)
+	}
+	if len(mq.messages) != 1 {
+		t.Fatalf("published %d messages, want 1", len(mq.messages))
+	}
+	publish := findSpan(t, exporter, "mq.Pub PAYMENT_TO")
+	if publish.SpanKind != trace.SpanKindProducer {
+		t.Errorf("publish span kind is %s", publish.SpanKind)
+	}
+
+	// Payment service echoes trace context of the request in its updates
+	request := map[string]interface{}{}
+	err = json.Unmarshal(mq.messages[0], &request)
+	if err != nil {
+		t.Fatalf("request isn't json: %s", err)
+	}
+	if request["order_id"] != donate.ID {
+		t.Errorf("request is for %v, want %s", request["order_id"], donate.ID)
+	}
+	meta := unpackPaymentMeta(mq.messages[0])
+	if len(meta.Trace) == 0 {
+		t.Fatal("request has no trace context")
+	}
+	// Payment service relies on W3C keys of the contract
+	if _, ok := meta.Trace["traceparent"]; !ok {
+		t.Errorf("request trace context %v has no traceparent", meta.Trace)
+	}
+
+	_, span := startPaymentSpan(context.Background(), donate.ID, meta.Trace)
+	span.End()
+	handle := findSpan(t, exporter, "donates.handlePaymentEvent")
+	if len(handle.Links) != 1 {
+		t.Fatalf("payment span has %d links, want 1", len(handle.Links))
+	}
+	link := handle.Links[0].SpanContext
+	if link.TraceID() != publish.SpanContext.TraceID() || link.SpanID() != publish.SpanContext.SpanID() {
+		t.Errorf("payment span is linked to %s/%s, want publish span %s/%s",
+			link.TraceID(), link.SpanID(), publish.SpanContext.TraceID(), publish.SpanContext.SpanID())
+	}
+}
+
+func TestPaymentUpdateWithoutTrace(t *testing.T) {
+	exporter := recordSpans(t)
+	data := []byte(`{"id":"payment-1","order_id":"donate-1","status":2}`)
+	meta := unpackPaymentMeta(data)
+	_, span := startPaymentSpan(context.Background(), "donate-1", meta.Trace)
+	span.End()
+	handle := findSpan(t, exporter, "donates.handlePaymentEvent")
+	if len(handle.Links) != 0 {
+		t.Errorf("payment span has %d links, want none", len(handle.Links))
+	}
+}
+
+func TestPackPaymentRequestWithoutTrace(t *testing.T) {
+	data, err := packPaymentRequest(payment.NewPayment("donate-1", "donor", 5000), nil)
+	if err != nil {
+		t.Fatalf("packPaymentRequest: %s", err)
+	}
+	fields := map[string]interface{}{}
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		t.Fatalf("request isn't json: %s", err)
+	}
+	if _, ok := fields["trace"]; ok {
+		t.Errorf("request without trace context has trace field: %s", data)
+	}
+}
+
+// Correlation and spans need ctx, missing one is rejected before them
+func TestNilCtxIsRejectedBeforeSpan(t *testing.T) {
+	exporter := recordSpans(t)
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	u := &useCaseImpl{log: logrus.NewEntry(logger), ids: donatestest.NewIDs("donate")}
+	var ctx context.Context
+	err := u.MakeDonate(ctx, &donates.Donate{From: "donor", To: "author", Amount: 5000})
+	if err == nil {
+		t.Error("donate is made without ctx")
+	}
+	data := []byte(`{"id":"payment-1","order_id":"donate-1","status":2}`)
+	if result := u.handlePaymentEvent(ctx, paymentEvent{data: data}); result != "error" {
+		t.Errorf("payment update without ctx is handled with result %s", result)
+	}
+	if spans := exporter.GetSpans(); len(spans) != 0 {
+		t.Errorf("started %d spans without ctx", len(spans))
+	}
+}
@@ -2,75 +2,314 @@ package usecase
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"strings"
+	"sync"
 	"tempproj/internal/donates"
+	"tempproj/internal/donates/audit"
+	"tempproj/internal/donates/cache"
+	"tempproj/internal/donates/lifecycle"
+	"tempproj/internal/donates/metrics"
+	"tempproj/internal/donates/risk"
 	"tempproj/internal/donates/storage"
+	"tempproj/internal/donates/tracing"
 	"tempproj/internal/events"
+	"tempproj/internal/types"
 	"tempproj/pkg/error/svcerror"
 	"tempproj/pkg/event"
 	"tempproj/pkg/messagequeue"
 	redismq "tempproj/pkg/messagequeue/redis"
 	"tempproj/pkg/notification"
 	"tempproj/pkg/payment"
+	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const minDonateValue = 50 * 100
+const (
+	minDonateValue = 50 * 100
+	maxListPage    = 100
+	cacheTTL       = 5 * time.Minute
+	// Stats backfill after deploy scans all confirmed donates
+	statsBackfillTimeout = time.Hour
+)
+
+// Users is a part of users.UseCase needed to check donate eligibility
+type Users interface {
+	Exists(ctx context.Context, user string) (bool, error)
+	DonationsEnabled(ctx context.Context, user string) (bool, error)
+	IsBanned(ctx context.Context, user string) (bool, error)
+	// Return true if user is blocked by another user
+	IsBlocked(ctx context.Context, user, by string) (bool, error)
+	CreatedAt(ctx context.Context, user string) (time.Time, error)
+}
+
+// Posts is a part of posts.UseCase needed to validate donated post
+type Posts interface {
+	// Return author of the post, empty string if post doesn't exist
+	GetAuthor(ctx context.Context, post string) (string, error)
+}
+
+// Events is a part of events.UseCase confirmed donates are sent to
+type Events interface {
+	DonateUser(ctx context.Context, from, to string, donate interface{}) error
+}
+
+// Notifications is a part of notification.UseCase users are notified with
+type Notifications interface {
+	Notify(ctx context.Context, t event.Type, payload map[string]interface{}, user string) error
+}
 
 type useCaseImpl struct {
 	log           *logrus.Entry
 	storage       storage.Storage
-	payments      payment.Payments
-	events        events.UseCase
-	notifications notification.UseCase
+	events        Events
+	notifications Notifications
 	mq            messagequeue.MessageQueue
+	cache         cache.Cache
+	users         Users
+	posts         Posts
+	risk          *risk.Pipeline
+	audit         audit.Log
+	metrics       *metrics.Metrics
+	probe         probe
+	clock         donates.Clock
+	ids           donates.IDGenerator
+	config        Config
+	// Background goroutines run until Close cancels ctx
+	ctx   context.Context
+	stop  context.CancelFunc
+	tasks sync.WaitGroup
 }
 
 func (u *useCaseImpl) MakeDonate(ctx context.Context, donate *donates.Donate) error {
-	switch {
-	case ctx == nil:
+	// Correlation and span need ctx, so it's checked before the rest of params
+	if ctx == nil {
 		return svcerror.ErrInternal("ctx is empty")
+	}
+	start := time.Now()
+	ctx = withCorrelation(ctx, u.ids)
+	ctx, span := tracing.Start(ctx, "donates.MakeDonate")
+	err := u.makeDonate(ctx, donate)
+	if donate != nil {
+		span.SetAttributes(tracing.DonateID(donate.ID))
+	}
+	tracing.End(span, err)
+	u.metrics.MakeDonate(start, donates.ErrorCode(err))
+	if err != nil {
+		donateLog(ctx, u.log, donate).WithError(err).Log(donates.LogLevel(err), "donate isn't made")
+	}
+	return err
+}
+
+func (u *useCaseImpl) makeDonate(ctx context.Context, donate *donates.Donate) error {
+	switch {
 	case donate == nil:
 		return svcerror.ErrInvalidParams("donate is empty")
+	case donate.From == "":
+		return donates.ErrUnauthenticated
 	case donate.To == "":
 		return svcerror.ErrInvalidParams("author is empty")
-	case donate.Amount < minDonateValue:
+	case donate.From == donate.To:
+		return donates.ErrSelfDonate
+	case donate.Amount < u.config.MinAmount:
 		return svcerror.ErrInvalidParams("amount is less than minimum available value")
 	}
-	// Create new donate with "new" status
-	err := u.storage.Create(ctx, donate)
+	// ID, status and timestamps are the service's, whatever caller has set
+	*donate = *donates.NewDonateWith(u.clock, u.ids, donate.From, donate.To, donate.Post, donate.Amount)
+	err := u.checkRecipient(ctx, donate)
+	if err != nil {
+		return err
+	}
+	err = u.checkEligibility(ctx, donate)
+	if err != nil {
+		return err
+	}
+	verdict := u.risk.Evaluate(ctx, donate)
+	switch verdict.Decision {
+	case risk.Deny:
+		donate.Status = donates.Denied
+	case risk.Review:
+		donate.Status = donates.Review
+	}
+	if verdict.Decision != risk.Allow {
+		donate.RiskReason = verdict.Rule + ": " + verdict.Reason
+		donateLog(ctx, u.log, donate).WithField("risk_reason", donate.RiskReason).Warn("donate is held by risk checks")
+	}
+	// Create new donate with "new" status, or keep held donate for review
+	err = u.storage.Create(ctx, donate, mutations(
+		enqueueEvents(u.storage, u.clock, u.ids),
+		recordAudit(u.audit, audit.Entry{
+			Action: audit.Create,
+			Changes: audit.Changes(map[string]interface{}{
+				"from":        donate.From,
+				"to":          donate.To,
+				"post":        donate.Post,
+				"amount":      donate.Amount,
+				"risk_reason": donate.RiskReason,
+			}),
+		}),
+	))
 	if err != nil {
 		return svcerror.HandleError(err, "can't create new donate: %s", err)
 	}
-	// Create new payment
+	observeTransition(u.metrics, donate, lifecycle.NoStatus)
+	switch verdict.Decision {
+	case risk.Deny:
+		return donates.ErrDonateDenied
+	case risk.Review:
+		return nil
+	}
+	return publishPayment(ctx, u.mq, donate)
+}
+
+// Create new payment for the donate. Request carries trace context of the
+// publish span, payment service echoes it in the payment's updates as
+// paymentMeta describes.
+func publishPayment(ctx context.Context, mq messagequeue.MessageQueue, donate *donates.Donate) (err error) {
+	ctx, span := tracing.Start(ctx, "mq.Pub PAYMENT_TO",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(tracing.DonateID(donate.ID)),
+	)
+	defer func() { tracing.End(span, err) }()
 	newPayment := payment.NewPayment(donate.ID, donate.From, donate.Amount)
-	paymentEvent, err := payment.PackPaymentEvent(newPayment)
+	paymentEvent, err := packPaymentRequest(newPayment, tracing.Inject(ctx))
 	if err != nil {
 		return svcerror.ErrInternal("can't pack donate event: %s", err)
 	}
-	err = u.mq.Pub(messagequeue.PAYMENT_TO, paymentEvent)
+	err = mq.Pub(messagequeue.PAYMENT_TO, paymentEvent)
 	if err != nil {
 		return svcerror.ErrInternal("can't send donate event to mq: %s", err)
 	}
 	return nil
 }
 
-// Update donate status from payment status (payment.OrderID == donate.ID)
-func (u *useCaseImpl) UpdateDonate(ctx context.Context, donateID string, update map[string]interface{}) (*donates.Donate, error) {
+// Check that recipient accepts donations and donated post belongs to the recipient
+func (u *useCaseImpl) checkRecipient(ctx context.Context, donate *donates.Donate) error {
+	exists, err := u.users.Exists(ctx, donate.To)
+	if err != nil {
+		return svcerror.HandleError(err, "can't check recipient: %s", err)
+	}
+	if !exists {
+		return donates.ErrRecipientNotFound
+	}
+	enabled, err := u.users.DonationsEnabled(ctx, donate.To)
+	if err != nil {
+		return svcerror.HandleError(err, "can't check recipient's donation settings: %s", err)
+	}
+	if !enabled {
+		return donates.ErrDonationsDisabled
+	}
+	if donate.Post == "" {
+		return nil
+	}
+	author, err := u.posts.GetAuthor(ctx, donate.Post)
+	if err != nil {
+		return svcerror.HandleError(err, "can't get post author: %s", err)
+	}
+	switch author {
+	case "":
+		return donates.ErrPostNotFound
+	case donate.To:
+		return nil
+	}
+	return donates.ErrPostAuthor
+}
+
+// Check that both sides are allowed to take part in the donate
+func (u *useCaseImpl) checkEligibility(ctx context.Context, donate *donates.Donate) error {
+	banned, err := u.users.IsBanned(ctx, donate.From)
+	if err != nil {
+		return svcerror.HandleError(err, "can't check donor account: %s", err)
+	}
+	if banned {
+		return donates.ErrDonorBanned
+	}
+	banned, err = u.users.IsBanned(ctx, donate.To)
+	if err != nil {
+		return svcerror.HandleError(err, "can't check recipient account: %s", err)
+	}
+	if banned {
+		return donates.ErrRecipientBanned
+	}
+	blocked, err := u.users.IsBlocked(ctx, donate.From, donate.To)
+	if err != nil {
+		return svcerror.HandleError(err, "can't check user blocks: %s", err)
+	}
+	if blocked {
+		return donates.ErrDonorBlocked
+	}
+	return nil
+}
+
+// Mutate returns update of the donate in its current state. It's called again
+// with fresh state after conflicting update, so its checks see the latest one.
+type Mutate func(current *donates.Donate) (map[string]interface{}, error)
+
+// Update donate status from payment status (payment.OrderID == donate.ID).
+// Donate is read and updated with version check until update isn't raced.
+func (u *useCaseImpl) UpdateDonate(ctx context.Context, donateID string, mutate Mutate) (*donates.Donate, error) {
 	switch {
 	case ctx == nil:
 		return nil, svcerror.ErrInternal("ctx is empty")
-	case update == nil:
-		return nil, svcerror.ErrInternal("update is empty")
+	case mutate == nil:
+		return nil, svcerror.ErrInternal("mutate is empty")
+	}
+	var before int
+	var donate *donates.Donate
+	err := retryOnConflict(ctx, func() error {
+		current, err := u.storage.GetByID(ctx, donateID)
+		if err != nil {
+			return &readError{err}
+		}
+		update, err := mutate(current)
+		if err != nil {
+			return err
+		}
+		record := mutations(
+			enqueueEvents(u.storage, u.clock, u.ids),
+			recordAudit(u.audit, audit.Entry{
+				Action:  audit.Update,
+				Changes: audit.Changes(update),
+			}),
+		)
+		hook := func(ctx context.Context, prev, next *donates.Donate) error {
+			before = int(prev.Status)
+			return record(ctx, prev, next)
+		}
+		donate, err = u.storage.Update(ctx, donateID, current.Version, update, hook)
+		return err
+	})
+	var rejection *donates.Error
+	if errors.As(err, &rejection) {
+		return nil, err
 	}
-	donate, err := u.storage.Update(ctx, donateID, update)
 	if err != nil {
 		return nil, svcerror.HandleError(err, "can't update donate info: %s", err)
 	}
+	observeTransition(u.metrics, donate, before)
 	return donate, nil
 }
 
+// Storage hook appending the entry to audit log in the transaction of the
+// donate's change, so the change isn't saved if it can't be audited
+func recordAudit(auditLog audit.Log, entry audit.Entry) storage.Mutation {
+	return func(ctx context.Context, before, after *donates.Donate) error {
+		entry := entry
+		entry.DonateID = after.ID
+		entry.Before = audit.NoStatus
+		if before != nil {
+			entry.Before = int(before.Status)
+		}
+		entry.After = int(after.Status)
+		return auditLog.Record(ctx, &entry)
+	}
+}
+
 func (u *useCaseImpl) GetDonatesNumber(ctx context.Context, userID string) (int64, error) {
 	switch {
 	case ctx == nil:
@@ -78,7 +317,13 @@ func (u *useCaseImpl) GetDonatesNumber(ctx context.Context, userID string) (int6
 	case userID == "":
 		return 0, svcerror.ErrInvalidParams("userID is empty")
 	}
-	num, err := u.storage.GetNumber(ctx, userID)
+	num, err := u.cache.GetInt(ctx, cache.NumberKey(userID), func(ctx context.Context) (int64, error) {
+		stats, err := u.storage.GetStats(ctx, userID)
+		if err != nil {
+			return 0, err
+		}
+		return stats.ReceivedCount, nil
+	})
 	if err != nil {
 		return 0, svcerror.HandleError(err, "can't get number of donates: %s", err)
 	}
@@ -93,7 +338,9 @@ func (u *useCaseImpl) GetUserDonators(ctx context.Context, user string) ([]strin
 	case user == "":
 		return nil, svcerror.ErrInvalidParams("user is empty")
 	}
-	users, err := u.storage.GetDonators(ctx, "from", map[string]interface{}{"to": user})
+	users, err := u.cache.GetList(ctx, cache.UserDonatorsKey(user), func(ctx context.Context) ([]string, error) {
+		return u.storage.GetDonators(ctx, "from", map[string]interface{}{"to": user})
+	})
 	if err != nil {
 		return nil, svcerror.HandleError(err, "can't get donators: %s", err)
 	}
@@ -108,7 +355,9 @@ func (u *useCaseImpl) GetPostDonators(ctx context.Context, post string) ([]strin
 	case post == "":
 		return nil, svcerror.ErrInvalidParams("post is empty")
 	}
-	users, err := u.storage.GetDonators(ctx, "from", map[string]interface{}{"post": post})
+	users, err := u.cache.GetList(ctx, cache.PostDonatorsKey(post), func(ctx context.Context) ([]string, error) {
+		return u.storage.GetDonators(ctx, "from", map[string]interface{}{"post": post})
+	})
 	if err != nil {
 		return nil, svcerror.HandleError(err, "can't get donators: %s", err)
 	}
@@ -123,7 +372,9 @@ func (u *useCaseImpl) GetUsersReceivedDonations(ctx context.Context, user string
 	case user == "":
 		return nil, svcerror.ErrInvalidParams("user is empty")
 	}
-	users, err := u.storage.GetDonators(ctx, "to", map[string]interface{}{"from": user})
+	users, err := u.cache.GetList(ctx, cache.ReceivedDonatesKey(user), func(ctx context.Context) ([]string, error) {
+		return u.storage.GetDonators(ctx, "to", map[string]interface{}{"from": user})
+	})
 	if err != nil {
 		return nil, svcerror.HandleError(err, "can't get donators: %s", err)
 	}
@@ -137,90 +388,486 @@ func (u *useCaseImpl) GetAmountOfDonations(ctx context.Context, user string) (in
 	case user == "":
 		return 0, svcerror.ErrInvalidParams("user is emtpy")
 	}
-	sumDonates, err := u.storage.GetDonatesSum(ctx, user)
+	sumDonates, err := u.cache.GetInt(ctx, cache.SumKey(user), func(ctx context.Context) (int64, error) {
+		stats, err := u.storage.GetStats(ctx, user)
+		if err != nil {
+			return 0, err
+		}
+		return stats.ReceivedSum, nil
+	})
 	if err != nil {
 		return 0, svcerror.HandleError(err, "can't get sum of donates: %s", err)
 	}
 	return sumDonates, nil
 }
 
-func (u *useCaseImpl) GetDonatesByIDs(ctx context.Context, ids []string) ([]donates.Short, error) {
+func (u *useCaseImpl) GetStats(ctx context.Context, user string) (*donates.Stats, error) {
 	switch {
 	case ctx == nil:
 		return nil, svcerror.ErrInternal("ctx is empty")
-	case ids == nil:
-		return nil, svcerror.ErrInvalidParams("ids is empty")
-	case len(ids) == 0:
-		return []donates.Short{}, nil
+	case user == "":
+		return nil, svcerror.ErrInvalidParams("user is empty")
+	}
+	stats, err := u.storage.GetStats(ctx, user)
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't get donation stats: %s", err)
+	}
+	return stats, nil
+}
+
+// Build stats once after deploy and apply donates skipped by an interrupted
+// rebuild. Instances race for the rebuild lease, losers leave it to the winner.
+func (u *useCaseImpl) backfillStats(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, statsBackfillTimeout)
+	defer cancel()
+	built, err := u.storage.StatsBuilt(ctx)
+	if err != nil {
+		u.log.WithError(err).Error("can't check donation stats")
+		return
+	}
+	if !built {
+		err = u.storage.RebuildStats(ctx)
+		switch {
+		case errors.Is(err, donates.ErrStatsRebuilding):
+			u.log.Info("donation stats are rebuilt by another instance")
+		case err != nil:
+			u.log.WithError(err).Error("can't build donation stats")
+		default:
+			u.log.Info("donation stats are built")
+			u.flushCache(ctx)
+		}
+		return
+	}
+	applied, err := u.storage.ApplyPendingStats(ctx)
+	if err != nil {
+		u.log.WithError(err).Error("can't apply pending donates to stats")
+		return
+	}
+	if applied != 0 {
+		u.log.WithField("donates", applied).Info("pending donates are applied to stats")
+		u.flushCache(ctx)
+	}
+}
+
+// Drop all cached counters after stats of unknown users have changed
+func (u *useCaseImpl) flushCache(ctx context.Context) {
+	err := u.cache.Flush(ctx)
+	if err != nil {
+		u.log.WithError(err).Warn("can't flush cached donation data")
+	}
+}
+
+func (u *useCaseImpl) GetPrivacy(ctx context.Context, user string) (*donates.Privacy, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case user == "":
+		return nil, svcerror.ErrInvalidParams("user is empty")
 	}
-	allDonates, err := u.storage.GetByIDs(ctx, ids)
+	privacy, err := u.storage.GetPrivacy(ctx, user)
 	if err != nil {
-		return nil, svcerror.HandleError(err, "can't get donates by ids: %s", err)
+		return nil, svcerror.HandleError(err, "can't get donation privacy: %s", err)
+	}
+	return privacy, nil
+}
+
+func (u *useCaseImpl) SetPrivacy(ctx context.Context, user string, update donates.PrivacyUpdate) (*donates.Privacy, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case user == "":
+		return nil, svcerror.ErrInvalidParams("user is empty")
+	case update.Totals != nil && !update.Totals.Valid(),
+		update.Donators != nil && !update.Donators.Valid():
+		return nil, svcerror.ErrInvalidParams("unknown visibility")
+	}
+	privacy, err := u.storage.SetPrivacy(ctx, user, update)
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't save donation privacy: %s", err)
+	}
+	return privacy, nil
+}
+
+func (u *useCaseImpl) GetPostAuthor(ctx context.Context, post string) (string, error) {
+	switch {
+	case ctx == nil:
+		return "", svcerror.ErrInternal("ctx is empty")
+	case post == "":
+		return "", svcerror.ErrInvalidParams("post is empty")
+	}
+	author, err := u.posts.GetAuthor(ctx, post)
+	if err != nil {
+		return "", svcerror.HandleError(err, "can't get post author: %s", err)
+	}
+	return author, nil
+}
+
+// Return donate if user is its donor or recipient
+func (u *useCaseImpl) GetDonate(ctx context.Context, user, id string) (*donates.Donate, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case user == "":
+		return nil, donates.ErrUnauthenticated
+	case id == "":
+		return nil, svcerror.ErrInvalidParams("id is empty")
+	}
+	donate, err := u.storage.GetByID(ctx, id)
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't get donate: %s", err)
+	}
+	if donate.From != user && donate.To != user {
+		return nil, donates.ErrNotDonateOwner
 	}
-	result := make([]donates.Short, 0, len(allDonates))
-	for _, donate := range allDonates {
-		result = append(result, *donate.Short())
+	return donate, nil
+}
+
+func (u *useCaseImpl) ListMyDonates(ctx context.Context, user string, filter donates.ListFilter, page types.PageOpt) ([]donates.Donate, error) {
+	switch {
+	case ctx == nil:
+		return nil, svcerror.ErrInternal("ctx is empty")
+	case user == "":
+		return nil, donates.ErrUnauthenticated
+	}
+	if page.Limit <= 0 || page.Limit > maxListPage {
+		page.Limit = maxListPage
+	}
+	filter.User = user
+	result, err := u.storage.List(ctx, filter, page)
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't list donates: %s", err)
 	}
 	return result, nil
 }
 
-func (u *useCaseImpl) handler() {
-	ctx := context.TODO()
-	events, err := u.mq.Sub(ctx, messagequeue.PAYMENT_FROM)
+// Request payment of pending donate again, e.g. when its payment form
+// expired. Payment service deduplicates payments by donate ID and answers with
+// payment update carrying the form URL, the donor gets it with payment_update
+// notification. URL received earlier is returned meanwhile, empty if there is
+// none yet.
+func (u *useCaseImpl) RequestPaymentURL(ctx context.Context, user, id string) (string, error) {
+	donate, err := u.GetDonate(ctx, user, id)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case donate.From != user:
+		return "", donates.ErrNotDonateOwner
+	case donate.Status != donates.Pending:
+		return "", donates.ErrNotPending
+	}
+	err = publishPayment(ctx, u.mq, donate)
+	if err != nil {
+		donateLog(ctx, u.log, donate).WithError(err).Error("can't request payment again")
+		return "", err
+	}
+	return donate.PaymentURL, nil
+}
+
+// Issue receipt for confirmed donate, repeated calls return the same receipt
+func (u *useCaseImpl) issueReceipt(ctx context.Context, donate *donates.Donate) (*donates.Receipt, error) {
+	fee := donate.Amount * u.config.FeeBasisPoints / 10000
+	receipt, err := u.storage.CreateReceipt(ctx, &donates.Receipt{
+		DonateID: donate.ID,
+		From:     donate.From,
+		To:       donate.To,
+		Post:     donate.Post,
+		Amount:   donate.Amount,
+		Fee:      fee,
+		Net:      donate.Amount - fee,
+		IssuedAt: u.clock.Now(),
+	})
+	if err != nil {
+		return nil, svcerror.HandleError(err, "can't create receipt: %s", err)
+	}
+	return receipt, nil
+}
+
+// Return receipt of the donate to its donor or recipient
+func (u *useCaseImpl) GetReceipt(ctx context.Context, user, donateID string) (*donates.Receipt, error) {
+	donate, err := u.GetDonate(ctx, user, donateID)
+	if err != nil {
+		return nil, err
+	}
+	if donate.Status != donates.Confirmed {
+		return nil, donates.ErrNotConfirmed
+	}
+	receipt, err := u.storage.GetReceipt(ctx, donateID)
+	if err == nil {
+		return receipt, nil
+	}
+	// Receipt wasn't issued by handler, issue it now
+	return u.issueReceipt(ctx, donate)
+}
+
+// Drop cached counters and donator lists the confirmed donate changed,
+// they are loaded from the storage on next read
+func (u *useCaseImpl) refreshCache(ctx context.Context, log *logrus.Entry, donate *donates.Donate) {
+	keys := []string{
+		cache.NumberKey(donate.To),
+		cache.SumKey(donate.To),
+		cache.UserDonatorsKey(donate.To),
+		cache.ReceivedDonatesKey(donate.From),
+	}
+	if donate.Post != "" {
+		keys = append(keys, cache.PostDonatorsKey(donate.Post))
+	}
+	err := u.cache.Invalidate(ctx, keys...)
+	if err != nil {
+		log.WithError(err).Warn("can't invalidate cached donation data")
+	}
+}
+
+// Payment update received from message queue
+type paymentEvent struct {
+	data     []byte
+	received time.Time
+}
+
+// Fields of payment messages next to the payment's ones. Contract with payment
+// service: payment request has "trace" object with W3C traceparent and
+// tracestate keys, the service copies it unchanged into every update of the
+// payment. Updates without it are handled as usual, but their spans aren't
+// linked to the request.
+type paymentMeta struct {
+	// Trace context of the payment request the update belongs to
+	Trace map[string]string `json:"trace"`
+}
+
+// Pack payment request with trace context next to the payment's fields, see
+// paymentMeta for the contract
+func packPaymentRequest(newPayment *payment.Payment, carrier map[string]string) ([]byte, error) {
+	data, err := payment.PackPaymentEvent(newPayment)
+	if err != nil || len(carrier) == 0 {
+		return data, err
+	}
+	fields := map[string]json.RawMessage{}
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, err
+	}
+	fields["trace"], err = json.Marshal(carrier)
 	if err != nil {
-		u.log.Fatalf("can't subscribe on payment events mq: %s", err)
+		return nil, err
 	}
+	return json.Marshal(fields)
+}
+
+func unpackPaymentMeta(data []byte) *paymentMeta {
+	meta := &paymentMeta{}
+	// Malformed meta is left empty, payment itself is unpacked by payment package
+	_ = json.Unmarshal(data, meta)
+	return meta
+}
+
+// Handle payment updates, lost subscription is renewed. Handler beats while
+// it's alive, health checks watch the heartbeat.
+func (u *useCaseImpl) handler(ctx context.Context) {
+	workers := make([]chan paymentEvent, u.config.Workers)
+	for i := range workers {
+		workers[i] = make(chan paymentEvent, u.config.BufferSize)
+		worker, events := i, workers[i]
+		u.spawn(func(ctx context.Context) { u.worker(ctx, worker, events) })
+	}
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	delay := resubscribeDelay
 	for {
-		select {
-		case evt := <-events:
-			paymentUpdate, err := payment.UnpackPaymentEvent(evt)
-			if err != nil {
-				u.log.Printf("can't unpack payment update: %s", err)
-				continue
+		u.probe.beat()
+		events, err := u.mq.Sub(ctx, messagequeue.PAYMENT_FROM)
+		if err != nil {
+			u.log.WithError(err).WithField("retry_in", delay).Error("can't subscribe on payment events mq")
+			if !u.probe.wait(ctx, delay, heartbeat.C) {
+				return
 			}
-			donate, err := u.UpdateDonate(
-				ctx,
-				paymentUpdate.OrderID,
-				map[string]interface{}{
-					"status": paymentUpdate.Status,
-				})
-			if err != nil {
-				u.log.Printf("can't update donate: %s", err)
-				continue
-			}
-			payload := map[string]interface{}{
-				"id": donate.ID,
-			}
-			switch paymentUpdate.Status {
-			case payment.Processing:
-				// send url with payment form
-				u.log.Printf("send url to user: %s", donate.From)
-				payload["status"] = "processing"
-				payload["url"] = paymentUpdate.Url
-
-			case payment.Confirmed:
-				// send donate to events service
-				err := u.events.DonateUser(ctx, donate.From, donate.To, donate.Short())
-				if err != nil {
-					u.log.Printf("can't save confirmed donate event: %s", err)
+			delay = nextResubscribeDelay(delay)
+			continue
+		}
+		u.probe.setSubscribed(true)
+	consume:
+		for {
+			select {
+			case evt, ok := <-events:
+				if !ok {
+					break consume
 				}
-				payload["status"] = "confirmed"
-
-			case payment.Failed:
-				// send failed status to user
-				payload["status"] = "failed"
-			default:
-				u.log.Printf("Unhandled payment status: %d", paymentUpdate.Status)
-				continue
-			}
-			err = u.notifications.Notify(ctx, event.PaymentUpdate, payload, donate.From)
-			if err != nil {
-				u.log.Printf("can't send notification to user: %s", err)
+				// Subscription works, next failure is retried quickly again
+				delay = resubscribeDelay
+				if !u.dispatch(ctx, workers, paymentEvent{data: evt, received: time.Now()}, heartbeat.C) {
+					u.probe.setSubscribed(false)
+					return
+				}
+				u.probe.beat()
+			case <-heartbeat.C:
+				u.probe.beat()
+			case <-ctx.Done():
+				u.probe.setSubscribed(false)
+				return
 			}
 		}
+		u.probe.setSubscribed(false)
+		u.log.WithField("retry_in", delay).Warn("payment events subscription is closed, resubscribing")
+		if !u.probe.wait(ctx, delay, heartbeat.C) {
+			return
+		}
+		delay = nextResubscribeDelay(delay)
 	}
 }
 
+// Updates of one donate go to the same worker, so they are applied in order.
+// Handler keeps beating while the worker's queue is full, stalled workers are
+// seen by age of the oldest payment update. Returns false if ctx is done before
+// the update is queued.
+func (u *useCaseImpl) dispatch(ctx context.Context, workers []chan paymentEvent, evt paymentEvent, heartbeat <-chan time.Time) bool {
+	shard := 0
+	if len(workers) > 1 {
+		paymentUpdate, err := payment.UnpackPaymentEvent(evt.data)
+		if err == nil {
+			hash := fnv.New32a()
+			hash.Write([]byte(paymentUpdate.OrderID))
+			shard = int(hash.Sum32() % uint32(len(workers)))
+		}
+	}
+	u.probe.queued(shard, evt.received)
+	for {
+		select {
+		case workers[shard] <- evt:
+			return true
+		case <-heartbeat:
+			u.probe.beat()
+		case <-ctx.Done():
+			u.probe.dropped(shard)
+			u.log.Warn("payment update isn't handled, service is closed")
+			return false
+		}
+	}
+}
+
+// Worker stops with ctx, update in progress is applied with its own context
+// so Close doesn't interrupt it halfway
+func (u *useCaseImpl) worker(ctx context.Context, id int, events <-chan paymentEvent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case evt := <-events:
+			start := time.Now()
+			u.metrics.QueueWait(start.Sub(evt.received))
+			result := u.handlePaymentEvent(context.Background(), evt)
+			u.probe.handled(id)
+			u.metrics.Handled(start, result)
+		}
+	}
+}
+
+// Apply payment update to the donate, return result of handling for metrics
+func (u *useCaseImpl) handlePaymentEvent(ctx context.Context, evt paymentEvent) string {
+	if ctx == nil {
+		u.log.Error("can't handle payment update: ctx is empty")
+		return "error"
+	}
+	paymentUpdate, err := payment.UnpackPaymentEvent(evt.data)
+	if err != nil {
+		u.log.WithError(err).Error("can't unpack payment update")
+		return "malformed"
+	}
+	meta := unpackPaymentMeta(evt.data)
+	ctx = withCorrelation(ctx, u.ids)
+	ctx, span := startPaymentSpan(ctx, paymentUpdate.OrderID, meta.Trace)
+	defer span.End()
+	log := donateLog(ctx, u.log, nil).WithFields(logrus.Fields{
+		"donate_id":      paymentUpdate.OrderID,
+		"payment_status": paymentUpdate.Status,
+	})
+	evtCtx := audit.WithActor(ctx, "payment", audit.Payment)
+	donate, err := u.UpdateDonate(evtCtx, paymentUpdate.OrderID, func(current *donates.Donate) (map[string]interface{}, error) {
+		// Late update, e.g. failure after confirmation, doesn't change the donate
+		if !donates.CanTransition(current.Status, donates.Status(paymentUpdate.Status)) {
+			return nil, donates.ErrBadTransition
+		}
+		update := map[string]interface{}{
+			"status":      paymentUpdate.Status,
+			"payment_ref": paymentUpdate.ID,
+		}
+		if paymentUpdate.Url != "" {
+			// keep url with payment form for RequestPaymentURL
+			update["payment_url"] = paymentUpdate.Url
+		}
+		return update, nil
+	})
+	if errors.Is(err, donates.ErrBadTransition) {
+		log.WithError(err).Info("stale payment update is ignored")
+		return "stale"
+	}
+	if err != nil {
+		log.WithError(err).Log(donates.LogLevel(err), "can't update donate")
+		tracing.Fail(span, err)
+		return "error"
+	}
+	log = donateLog(ctx, u.log, donate).WithField("payment_status", paymentUpdate.Status)
+	payload := map[string]interface{}{
+		"id": donate.ID,
+	}
+	switch paymentUpdate.Status {
+	case payment.Processing:
+		// send url with payment form
+		log.WithField("payment_url", donates.RedactURL(paymentUpdate.Url)).Info("send url to user")
+		payload["status"] = "processing"
+		payload["url"] = paymentUpdate.Url
+
+	case payment.Confirmed:
+		_, err := u.storage.ApplyToStats(ctx, donate)
+		if err != nil {
+			log.WithError(err).Error("can't update donation stats")
+		}
+		// Donator lists change even if stats are being rebuilt and the donate
+		// isn't applied yet
+		u.refreshCache(ctx, log, donate)
+		receipt, err := u.issueReceipt(ctx, donate)
+		if err != nil {
+			log.WithError(err).Error("can't issue receipt")
+		} else {
+			payload["receipt"] = receipt.Number
+		}
+		// send donate to events service
+		err = u.events.DonateUser(ctx, donate.From, donate.To, donate.Short())
+		if err != nil {
+			log.WithError(err).Error("can't save confirmed donate event")
+		}
+		payload["status"] = "confirmed"
+
+	case payment.Failed:
+		u.risk.RecordFailure(ctx, donate)
+		// send failed status to user
+		payload["status"] = "failed"
+	default:
+		log.Warn("unhandled payment status")
+		return "unhandled"
+	}
+	err = u.notifications.Notify(ctx, event.PaymentUpdate, payload, donate.From)
+	if err != nil {
+		log.WithError(err).Warn("can't send notification to user")
+	}
+	return "ok"
+}
+
+// Span of payment update is linked to the payment request by trace context
+// echoed by payment service per paymentMeta contract, updates without it have
+// no link
+func startPaymentSpan(ctx context.Context, donateID string, carrier map[string]string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "donates.handlePaymentEvent",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(tracing.DonateID(donateID)),
+		tracing.LinkTo(carrier),
+	)
+}
+
+// Create donates service with the constructor preceding NewWithDeps. Users,
+// posts and audit log must be passed with WithServices, the service isn't
+// created without them. Metrics are registered in own registry nobody serves.
+// Payments aren't used, payments are requested through message queue.
+//
+// Deprecated: use NewWithDeps.
 func New(
 	log *logrus.Entry,
 	storage storage.Storage,
@@ -228,36 +875,134 @@ func New(
 	payments payment.Payments,
 	events events.UseCase,
 	notifications notification.UseCase,
+	opts ...Option,
+) (
+	donates.UseCase,
+	error,
+) {
+	o := newOptions(opts)
+	missing := make([]string, 0)
+	if o.users == nil {
+		missing = append(missing, "users")
+	}
+	if o.posts == nil {
+		missing = append(missing, "posts")
+	}
+	if o.auditLog == nil {
+		missing = append(missing, "audit log")
+	}
+	if len(missing) != 0 {
+		return nil, svcerror.ErrInternal("%s are empty, pass them with WithServices", strings.Join(missing, ", "))
+	}
+	return NewWithDeps(log, storage, redis, events, notifications, o.users, o.posts, o.auditLog, metrics.New(), opts...)
+}
+
+// Create donates service. It uses redis message queue, system clock, xid IDs
+// and DefaultConfig unless options replace them. Redis may be nil if message
+// queue is injected, then cache and risk rules must be set by WithCache and
+// WithRiskRules.
+func NewWithDeps(
+	log *logrus.Entry,
+	storage storage.Storage,
+	redis *redis.Client,
+	events Events,
+	notifications Notifications,
+	users Users,
+	posts Posts,
+	auditLog audit.Log,
+	m *metrics.Metrics,
+	opts ...Option,
 ) (
 	donates.UseCase,
 	error,
 ) {
+	o := newOptions(opts)
 	switch {
 	case log == nil:
 		return nil, svcerror.ErrInternal("logger is empty")
 	case storage == nil:
 		return nil, svcerror.ErrInternal("storage is empty")
-	case redis == nil:
+	case redis == nil && o.mq == nil:
 		return nil, svcerror.ErrInternal("redis is empty")
-	case payments == nil:
-		return nil, svcerror.ErrInternal("payments is empty")
+	case redis == nil && o.cache == nil:
+		return nil, svcerror.ErrInternal("cache is empty, it must be set without redis")
+	case redis == nil && !o.rulesSet:
+		return nil, svcerror.ErrInternal("risk rules are empty, they must be set without redis")
 	case events == nil:
 		return nil, svcerror.ErrInternal("events is empty")
 	case notifications == nil:
 		return nil, svcerror.ErrInternal("notifications is empty")
+	case users == nil:
+		return nil, svcerror.ErrInternal("users is empty")
+	case posts == nil:
+		return nil, svcerror.ErrInternal("posts is empty")
+	case auditLog == nil:
+		return nil, svcerror.ErrInternal("audit log is empty")
+	case m == nil:
+		return nil, svcerror.ErrInternal("metrics is empty")
 	}
-	mq, err := redismq.New(redis, 1024)
-	if err != nil {
-		return nil, svcerror.ErrInternal("can't create message queue: %s", err)
+	switch {
+	case o.clock == nil:
+		return nil, svcerror.ErrInternal("clock is empty")
+	case o.ids == nil:
+		return nil, svcerror.ErrInternal("id generator is empty")
+	case o.config.FeeBasisPoints > 10000:
+		return nil, svcerror.ErrInternal("fee is over 100%%")
+	}
+	mq := o.mq
+	if mq == nil {
+		var err error
+		mq, err = redismq.New(redis, o.config.BufferSize)
+		if err != nil {
+			return nil, svcerror.ErrInternal("can't create message queue: %s", err)
+		}
+	}
+	donatesCache := o.cache
+	if donatesCache == nil {
+		var err error
+		donatesCache, err = cache.New(log, redis, cacheTTL)
+		if err != nil {
+			return nil, svcerror.ErrInternal("can't create donates cache: %s", err)
+		}
+	}
+	rules := o.rules
+	if !o.rulesSet {
+		rules = risk.DefaultRules(redis, users, o.clock, o.config.MinAmount)
 	}
 	s := &useCaseImpl{
 		log:           log,
 		storage:       storage,
-		payments:      payments,
 		events:        events,
 		notifications: notifications,
 		mq:            mq,
+		cache:         donatesCache,
+		users:         users,
+		posts:         posts,
+		risk:          risk.NewPipeline(log, o.config.RiskOnError, rules...),
+		audit:         auditLog,
+		metrics:       m,
+		clock:         o.clock,
+		ids:           o.ids,
+		config:        o.config,
 	}
-	go s.handler()
+	s.ctx, s.stop = context.WithCancel(context.Background())
+	s.spawn(s.handler)
+	s.spawn(s.relayEvents)
+	s.spawn(s.backfillStats)
+	s.spawn(s.runExports)
 	return s, nil
 }
+
+// Run background task until Close
+func (u *useCaseImpl) spawn(task func(ctx context.Context)) {
+	u.tasks.Add(1)
+	go func() {
+		defer u.tasks.Done()
+		task(u.ctx)
+	}()
+}
+
+func (u *useCaseImpl) Close() {
+	u.stop()
+	u.tasks.Wait()
+}
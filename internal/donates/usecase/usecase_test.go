@@ -0,0 +1,71 @@
+package usecase
+
+import (
+	"io"
+	"strings"
+	"tempproj/internal/donates/cache"
+	"tempproj/internal/donates/donatestest"
+	"tempproj/internal/donates/metrics"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func discardLog() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logrus.NewEntry(logger)
+}
+
+func TestNewWithoutRedisNeedsCacheAndRiskRules(t *testing.T) {
+	cases := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"no cache", []Option{WithRiskRules()}, "cache is empty"},
+		{"no risk rules", []Option{WithCache(cache.Nop())}, "risk rules are empty"},
+		{"both set", []Option{WithCache(cache.Nop()), WithRiskRules()}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := append([]Option{WithMessageQueue(donatestest.NewMQ())}, c.opts...)
+			service, err := NewWithDeps(discardLog(), donatestest.NewStorage(), nil,
+				donatestest.NewEvents(), donatestest.NewNotifications(), donatestest.NewUsers(),
+				donatestest.NewPosts(), donatestest.NewAuditLog(), metrics.New(), opts...)
+			if c.want == "" {
+				if err != nil {
+					t.Fatalf("NewWithDeps: %s", err)
+				}
+				service.Close()
+				return
+			}
+			if err == nil {
+				service.Close()
+				t.Fatalf("service is created without redis, want %q", c.want)
+			}
+			if !strings.Contains(err.Error(), c.want) {
+				t.Errorf("got %q, want %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestNewNeedsServices(t *testing.T) {
+	_, err := New(discardLog(), donatestest.NewStorage(), nil, nil, nil, nil)
+	if err == nil {
+		t.Fatal("service is created without users, posts and audit log")
+	}
+	for _, service := range []string{"users", "posts", "audit log"} {
+		if !strings.Contains(err.Error(), service) {
+			t.Errorf("error %q doesn't report missing %s", err, service)
+		}
+	}
+	// Services of the option reach NewWithDeps, which checks the rest
+	_, err = New(discardLog(), donatestest.NewStorage(), nil, nil, nil, nil,
+		WithServices(donatestest.NewUsers(), donatestest.NewPosts(), donatestest.NewAuditLog()),
+		WithMessageQueue(donatestest.NewMQ()), WithCache(cache.Nop()), WithRiskRules())
+	if err == nil || !strings.Contains(err.Error(), "events is empty") {
+		t.Errorf("got %v, want missing events", err)
+	}
+}
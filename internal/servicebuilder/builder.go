@@ -1,7 +1,11 @@
 package servicebuilder
 
 import (
+	"fmt"
+	"os"
 	"tempproj/internal/donates"
+	donateDelivery "tempproj/internal/donates/delivery"
+	donateMetrics "tempproj/internal/donates/metrics"
 	plconf "tempproj/internal/plapi/config"
 	api "tempproj/pkg/apigateway"
 
@@ -12,18 +16,47 @@ import (
 
 type ServiceBuilder struct {
 	// ...
-	donateService donates.UseCase
+	donateService        donates.UseCase
+	donateAPI            donateDelivery.Delivery
+	donateModeration     donates.Moderation
+	donateModerationAPI  donateDelivery.ModerationDelivery
+	donateServiceMetrics *donateMetrics.Metrics
 	// ...
 }
 
 func New(log *logrus.Entry, mongo *mongo.Client, redis *redis.Client, config *plconf.Config, api api.APIGateway) (*ServiceBuilder, error) {
 	// ...
-	donateService := buildDonateService(log, mongo, redis, paymentService, eventService, notificationService)
+	donateServices, err := BuildDonateServices(DonateDeps{
+		Log:           log,
+		Mongo:         mongo,
+		Redis:         redis,
+		Events:        eventService,
+		Notifications: notificationService,
+		Users:         userService,
+		Admins:        userService,
+		Posts:         postService,
+		AuditKey:      []byte(os.Getenv("DONATES_AUDIT_KEY")),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't build donate services: %w", err)
+	}
+	donateAPI, err := BuildDonateDelivery(log, donateServices.Service, userService, followerService, redis)
+	if err != nil {
+		return nil, err
+	}
+	donateModerationAPI, err := BuildDonateModerationDelivery(log, donateServices.Moderation, userService)
+	if err != nil {
+		return nil, err
+	}
 	// ....
 
 	return &ServiceBuilder{
 		//....
-		donateService: donateService,
+		donateService:        donateServices.Service,
+		donateAPI:            donateAPI,
+		donateModeration:     donateServices.Moderation,
+		donateModerationAPI:  donateModerationAPI,
+		donateServiceMetrics: donateServices.Metrics,
 		// ....
 	}, nil
 }
@@ -0,0 +1,75 @@
+package buildertest
+
+import (
+	"io/ioutil"
+	"tempproj/internal/donates/cache"
+	"tempproj/internal/donates/donatestest"
+	"tempproj/internal/donates/risk"
+	"tempproj/internal/servicebuilder"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Harness is donate service graph built from fakes, it needs no Mongo or
+// Redis. Donates aren't cached and aren't risk-checked.
+type Harness struct {
+	Storage       *donatestest.Storage
+	AuditLog      *donatestest.AuditLog
+	MQ            *donatestest.MQ
+	Events        *donatestest.Events
+	Notifications *donatestest.Notifications
+	Users         *donatestest.Users
+	Posts         *donatestest.Posts
+	Clock         *donatestest.Clock
+	IDs           *donatestest.IDs
+	Donates       *servicebuilder.DonateServices
+}
+
+// Build donate services the way ServiceBuilder does, with in-memory storage,
+// audit log, message queue and users. Log is discarded if it's empty. Close
+// the harness to stop background handlers of the services.
+func NewHarness(log *logrus.Entry) (*Harness, error) {
+	if log == nil {
+		logger := logrus.New()
+		logger.SetOutput(ioutil.Discard)
+		log = logrus.NewEntry(logger)
+	}
+	clock := donatestest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	ids := donatestest.NewIDs("donate")
+	h := &Harness{
+		Clock:         clock,
+		IDs:           ids,
+		Storage:       donatestest.NewStorageWithClock(clock),
+		AuditLog:      donatestest.NewAuditLogWith(clock, ids),
+		MQ:            donatestest.NewMQ(),
+		Events:        donatestest.NewEvents(),
+		Notifications: donatestest.NewNotifications(),
+		Users:         donatestest.NewUsers(),
+		Posts:         donatestest.NewPosts(),
+	}
+	services, err := servicebuilder.BuildDonateServices(servicebuilder.DonateDeps{
+		Log:           log,
+		MQ:            h.MQ,
+		Events:        h.Events,
+		Notifications: h.Notifications,
+		Users:         h.Users,
+		Admins:        h.Users,
+		Posts:         h.Posts,
+		Storage:       h.Storage,
+		AuditLog:      h.AuditLog,
+		Clock:         h.Clock,
+		IDs:           h.IDs,
+		Cache:         cache.Nop(),
+		RiskRules:     []risk.Rule{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.Donates = services
+	return h, nil
+}
+
+func (h *Harness) Close() {
+	h.Donates.Close()
+}
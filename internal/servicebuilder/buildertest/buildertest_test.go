@@ -0,0 +1,409 @@
+package buildertest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"tempproj/internal/donates"
+	"tempproj/internal/donates/lifecycle"
+	"tempproj/internal/donates/usecase"
+	"tempproj/internal/servicebuilder"
+	"tempproj/pkg/messagequeue"
+	"tempproj/pkg/payment"
+	"testing"
+	"time"
+)
+
+// Wait for background handlers of the harness
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func sendPaymentUpdate(t *testing.T, h *Harness, update *payment.Payment) {
+	t.Helper()
+	data, err := payment.PackPaymentEvent(update)
+	if err != nil {
+		t.Fatalf("can't pack payment update: %s", err)
+	}
+	err = h.MQ.Pub(messagequeue.PAYMENT_FROM, data)
+	if err != nil {
+		t.Fatalf("can't send payment update: %s", err)
+	}
+}
+
+func TestHarnessConfirmsDonate(t *testing.T) {
+	h, err := NewHarness(nil)
+	if err != nil {
+		t.Fatalf("NewHarness: %s", err)
+	}
+	defer h.Close()
+	ctx := context.Background()
+	h.Users.Add(h.Clock.Now().Add(-30*24*time.Hour), "donor", "author")
+
+	donate := donates.NewDonate("donor", "author", "", 10000)
+	err = h.Donates.Service.MakeDonate(ctx, donate)
+	if err != nil {
+		t.Fatalf("MakeDonate: %s", err)
+	}
+	requests := h.MQ.Published(messagequeue.PAYMENT_TO)
+	if len(requests) != 1 {
+		t.Fatalf("published %d payment requests, want 1", len(requests))
+	}
+
+	waitFor(t, "payment updates subscription", func() bool {
+		return h.MQ.Subscribers(messagequeue.PAYMENT_FROM) == 1
+	})
+	sendPaymentUpdate(t, h, &payment.Payment{ID: "payment-1", OrderID: donate.ID, Status: payment.Processing, Url: "https://pay/1"})
+	sendPaymentUpdate(t, h, &payment.Payment{ID: "payment-1", OrderID: donate.ID, Status: payment.Confirmed})
+	waitFor(t, "confirmed donate", func() bool {
+		return len(h.Events.Donated()) == 1
+	})
+	stored, err := h.Storage.GetByID(ctx, donate.ID)
+	if err != nil {
+		t.Fatalf("GetByID: %s", err)
+	}
+	if stored.Status != donates.Confirmed {
+		t.Errorf("donate status is %s, want confirmed", stored.Status)
+	}
+	donated := h.Events.Donated()[0]
+	if donated.From != "donor" || donated.To != "author" {
+		t.Errorf("events got donate %+v", donated)
+	}
+	waitFor(t, "notifications", func() bool {
+		return len(h.Notifications.Sent()) == 2
+	})
+	for _, notification := range h.Notifications.Sent() {
+		if notification.User != "donor" {
+			t.Errorf("notification is sent to %s, want donor", notification.User)
+		}
+	}
+	if status := h.Notifications.Sent()[1].Payload["status"]; status != "confirmed" {
+		t.Errorf("last notification status is %v, want confirmed", status)
+	}
+}
+
+func TestLateFailureDoesNotOverwriteConfirmation(t *testing.T) {
+	h, err := NewHarness(nil)
+	if err != nil {
+		t.Fatalf("NewHarness: %s", err)
+	}
+	defer h.Close()
+	ctx := context.Background()
+	h.Users.Add(h.Clock.Now().Add(-30*24*time.Hour), "donor", "author")
+	donate := &donates.Donate{From: "donor", To: "author", Amount: 10000}
+	err = h.Donates.Service.MakeDonate(ctx, donate)
+	if err != nil {
+		t.Fatalf("MakeDonate: %s", err)
+	}
+	next := &donates.Donate{From: "donor", To: "author", Amount: 10000}
+	err = h.Donates.Service.MakeDonate(ctx, next)
+	if err != nil {
+		t.Fatalf("MakeDonate: %s", err)
+	}
+	waitFor(t, "payment updates subscription", func() bool {
+		return h.MQ.Subscribers(messagequeue.PAYMENT_FROM) == 1
+	})
+	sendPaymentUpdate(t, h, &payment.Payment{ID: "payment-1", OrderID: donate.ID, Status: payment.Confirmed})
+	sendPaymentUpdate(t, h, &payment.Payment{ID: "payment-1", OrderID: donate.ID, Status: payment.Failed})
+	// The only worker handles updates in order, so the late failure is
+	// handled when update of the next donate is
+	sendPaymentUpdate(t, h, &payment.Payment{ID: "payment-2", OrderID: next.ID, Status: payment.Processing})
+	waitFor(t, "update of the next donate", func() bool {
+		stored, err := h.Storage.GetByID(ctx, next.ID)
+		return err == nil && stored.Status == donates.Pending
+	})
+	stored, err := h.Storage.GetByID(ctx, donate.ID)
+	if err != nil {
+		t.Fatalf("GetByID: %s", err)
+	}
+	if stored.Status != donates.Confirmed {
+		t.Errorf("donate status is %s, want confirmed", stored.Status)
+	}
+	for _, notification := range h.Notifications.Sent() {
+		if notification.Payload["id"] == donate.ID && notification.Payload["status"] != "confirmed" {
+			t.Errorf("late %v update is sent to user", notification.Payload["status"])
+		}
+	}
+}
+
+func TestLookupShowsConfirmedDonatesToOthers(t *testing.T) {
+	h, err := NewHarness(nil)
+	if err != nil {
+		t.Fatalf("NewHarness: %s", err)
+	}
+	defer h.Close()
+	ctx := context.Background()
+	h.Users.Add(h.Clock.Now().Add(-30*24*time.Hour), "donor", "author")
+	confirmed := &donates.Donate{From: "donor", To: "author", Amount: 10000}
+	pending := &donates.Donate{From: "donor", To: "author", Amount: 20000}
+	for _, donate := range []*donates.Donate{confirmed, pending} {
+		err = h.Donates.Service.MakeDonate(ctx, donate)
+		if err != nil {
+			t.Fatalf("MakeDonate: %s", err)
+		}
+	}
+	waitFor(t, "payment updates subscription", func() bool {
+		return h.MQ.Subscribers(messagequeue.PAYMENT_FROM) == 1
+	})
+	sendPaymentUpdate(t, h, &payment.Payment{ID: "payment-1", OrderID: confirmed.ID, Status: payment.Confirmed})
+	waitFor(t, "confirmed donate", func() bool {
+		return len(h.Events.Donated()) == 1
+	})
+
+	ids := []string{pending.ID, "unknown", confirmed.ID}
+	tests := []struct {
+		user       string
+		projection donates.Projection
+		found      []bool
+	}{
+		{"reader", donates.ProjectShort, []bool{false, false, true}},
+		{"reader", donates.ProjectPublic, []bool{false, false, true}},
+		{"reader", donates.ProjectFull, []bool{false, false, false}},
+		{"donor", donates.ProjectFull, []bool{true, false, true}},
+	}
+	for _, tt := range tests {
+		results, err := h.Donates.Service.LookupDonates(ctx, tt.user, ids, tt.projection)
+		if err != nil {
+			t.Fatalf("LookupDonates: %s", err)
+		}
+		if len(results) != len(ids) {
+			t.Fatalf("got %d results, want %d", len(results), len(ids))
+		}
+		for i, result := range results {
+			if result.ID != ids[i] || (result.Donate != nil) != tt.found[i] {
+				t.Errorf("%s %s lookup: result %d is %+v, want found %t", tt.user, tt.projection, i, result, tt.found[i])
+			}
+		}
+	}
+}
+
+func TestPostTotalsResolveAuthors(t *testing.T) {
+	h, err := NewHarness(nil)
+	if err != nil {
+		t.Fatalf("NewHarness: %s", err)
+	}
+	defer h.Close()
+	ctx := context.Background()
+	h.Users.Add(h.Clock.Now().Add(-30*24*time.Hour), "donor", "author")
+	h.Posts.Add("post-1", "author")
+	h.Posts.Add("post-2", "author")
+	donate := &donates.Donate{From: "donor", To: "author", Post: "post-1", Amount: 10000}
+	err = h.Donates.Service.MakeDonate(ctx, donate)
+	if err != nil {
+		t.Fatalf("MakeDonate: %s", err)
+	}
+	waitFor(t, "payment updates subscription", func() bool {
+		return h.MQ.Subscribers(messagequeue.PAYMENT_FROM) == 1
+	})
+	sendPaymentUpdate(t, h, &payment.Payment{ID: "payment-1", OrderID: donate.ID, Status: payment.Confirmed})
+	waitFor(t, "post totals", func() bool {
+		totals, err := h.Donates.Service.GetPostTotals(ctx, "post-1")
+		return err == nil && totals.Count == 1
+	})
+
+	totals, err := h.Donates.Service.GetPostsTotals(ctx, []string{"post-1", "post-2", "unknown"})
+	if err != nil {
+		t.Fatalf("GetPostsTotals: %s", err)
+	}
+	want := []donates.PostTotals{
+		{Post: "post-1", Author: "author", Sum: 10000, Count: 1, Donors: 1},
+		{Post: "post-2", Author: "author"},
+		{Post: "unknown"},
+	}
+	if !reflect.DeepEqual(totals, want) {
+		t.Errorf("got %+v, want %+v", totals, want)
+	}
+	_, err = h.Donates.Service.GetPostTotals(ctx, "unknown")
+	if err != donates.ErrPostNotFound {
+		t.Errorf("totals of unknown post err is %v, want %v", err, donates.ErrPostNotFound)
+	}
+}
+
+func TestDonatesUseInjectedClockAndIDs(t *testing.T) {
+	h, err := NewHarness(nil)
+	if err != nil {
+		t.Fatalf("NewHarness: %s", err)
+	}
+	defer h.Close()
+	ctx := context.Background()
+	created := h.Clock.Now()
+	h.Users.Add(created.Add(-30*24*time.Hour), "donor", "author")
+
+	donate := &donates.Donate{ID: "forged", From: "donor", To: "author", Amount: 10000, CreatedAt: time.Unix(0, 0)}
+	err = h.Donates.Service.MakeDonate(ctx, donate)
+	if err != nil {
+		t.Fatalf("MakeDonate: %s", err)
+	}
+	if !strings.HasPrefix(donate.ID, "donate-") {
+		t.Errorf("donate ID is %s, want one of injected generator", donate.ID)
+	}
+	if !donate.CreatedAt.Equal(created) || !donate.UpdatedAt.Equal(created) {
+		t.Errorf("donate is created at %s and updated at %s, want %s", donate.CreatedAt, donate.UpdatedAt, created)
+	}
+	entries, err := h.AuditLog.GetByDonate(ctx, donate.ID)
+	if err != nil {
+		t.Fatalf("GetByDonate: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d audit entries, want 1", len(entries))
+	}
+	if !entries[0].CreatedAt.Equal(created) || !strings.HasPrefix(entries[0].CorrelationID, "donate-") {
+		t.Errorf("audit entry %+v isn't stamped by injected clock and IDs", entries[0])
+	}
+
+	// Payment update is applied at later time
+	h.Clock.Advance(time.Hour)
+	waitFor(t, "payment updates subscription", func() bool {
+		return h.MQ.Subscribers(messagequeue.PAYMENT_FROM) == 1
+	})
+	sendPaymentUpdate(t, h, &payment.Payment{ID: "payment-1", OrderID: donate.ID, Status: payment.Processing, Url: "https://pay/1"})
+	waitFor(t, "pending donate", func() bool {
+		stored, err := h.Storage.GetByID(ctx, donate.ID)
+		return err == nil && stored.Status == donates.Pending
+	})
+	stored, err := h.Storage.GetByID(ctx, donate.ID)
+	if err != nil {
+		t.Fatalf("GetByID: %s", err)
+	}
+	if !stored.UpdatedAt.Equal(h.Clock.Now()) {
+		t.Errorf("donate is updated at %s, want %s", stored.UpdatedAt, h.Clock.Now())
+	}
+
+	waitFor(t, "lifecycle events", func() bool {
+		return len(h.MQ.Published(lifecycle.Topic)) == 2
+	})
+	for _, data := range h.MQ.Published(lifecycle.Topic) {
+		evt, err := lifecycle.Unpack(data)
+		if err != nil {
+			t.Fatalf("Unpack: %s", err)
+		}
+		if !strings.HasPrefix(evt.ID, "donate-") {
+			t.Errorf("event ID is %s, want one of injected generator", evt.ID)
+		}
+		occurred := created
+		if evt.Type == lifecycle.Pending {
+			occurred = h.Clock.Now()
+		}
+		if !evt.OccurredAt.Equal(occurred) {
+			t.Errorf("%s event occurred at %s, want %s", evt.Type, evt.OccurredAt, occurred)
+		}
+	}
+}
+
+func TestHarnessCloseStopsHandlers(t *testing.T) {
+	h, err := NewHarness(nil)
+	if err != nil {
+		t.Fatalf("NewHarness: %s", err)
+	}
+	waitFor(t, "payment updates subscription", func() bool {
+		return h.MQ.Subscribers(messagequeue.PAYMENT_FROM) == 1
+	})
+	closed := make(chan struct{})
+	go func() {
+		h.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close doesn't return")
+	}
+	waitFor(t, "unsubscribing", func() bool {
+		return h.MQ.Subscribers(messagequeue.PAYMENT_FROM) == 0
+	})
+}
+
+func TestRequestPaymentURLRequestsPaymentAgain(t *testing.T) {
+	h, err := NewHarness(nil)
+	if err != nil {
+		t.Fatalf("NewHarness: %s", err)
+	}
+	defer h.Close()
+	ctx := context.Background()
+	h.Users.Add(h.Clock.Now().Add(-30*24*time.Hour), "donor", "author")
+	donate := &donates.Donate{From: "donor", To: "author", Amount: 10000}
+	err = h.Donates.Service.MakeDonate(ctx, donate)
+	if err != nil {
+		t.Fatalf("MakeDonate: %s", err)
+	}
+	_, err = h.Donates.Service.RequestPaymentURL(ctx, "donor", donate.ID)
+	if !errors.Is(err, donates.ErrNotPending) {
+		t.Fatalf("got %v for new donate, want ErrNotPending", err)
+	}
+	waitFor(t, "payment updates subscription", func() bool {
+		return h.MQ.Subscribers(messagequeue.PAYMENT_FROM) == 1
+	})
+	sendPaymentUpdate(t, h, &payment.Payment{ID: "payment-1", OrderID: donate.ID, Status: payment.Processing, Url: "https://pay/1"})
+	waitFor(t, "pending donate", func() bool {
+		stored, err := h.Storage.GetByID(ctx, donate.ID)
+		return err == nil && stored.Status == donates.Pending
+	})
+	_, err = h.Donates.Service.RequestPaymentURL(ctx, "author", donate.ID)
+	if !errors.Is(err, donates.ErrNotDonateOwner) {
+		t.Errorf("got %v for recipient, want ErrNotDonateOwner", err)
+	}
+	url, err := h.Donates.Service.RequestPaymentURL(ctx, "donor", donate.ID)
+	if err != nil {
+		t.Fatalf("RequestPaymentURL: %s", err)
+	}
+	if url != "https://pay/1" {
+		t.Errorf("got url %q, want received one", url)
+	}
+	if requests := h.MQ.Published(messagequeue.PAYMENT_TO); len(requests) != 2 {
+		t.Errorf("published %d payment requests, want 2", len(requests))
+	}
+}
+
+func TestOnlyAdminsModerateDonates(t *testing.T) {
+	h, err := NewHarness(nil)
+	if err != nil {
+		t.Fatalf("NewHarness: %s", err)
+	}
+	defer h.Close()
+	ctx := context.Background()
+	h.Users.AddAdmins("admin")
+	held := &donates.Donate{ID: "held", From: "donor", To: "author", Amount: 10000, Status: donates.Review, CreatedAt: h.Clock.Now()}
+	err = h.Storage.Create(ctx, held, nil)
+	if err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	_, err = h.Donates.Moderation.ApproveDonate(ctx, held.ID, "donor")
+	if !errors.Is(err, donates.ErrNotModerator) {
+		t.Fatalf("got %v for approval by donor, want ErrNotModerator", err)
+	}
+	err = h.Donates.Moderation.RebuildStats(ctx, "donor")
+	if !errors.Is(err, donates.ErrNotModerator) {
+		t.Errorf("got %v for rebuild by donor, want ErrNotModerator", err)
+	}
+	approved, err := h.Donates.Moderation.ApproveDonate(ctx, held.ID, "admin")
+	if err != nil {
+		t.Fatalf("ApproveDonate: %s", err)
+	}
+	if approved.Status != donates.New {
+		t.Errorf("approved donate status is %s, want new", approved.Status)
+	}
+	sent := h.Notifications.Sent()
+	if len(sent) != 1 || sent[0].Type != usecase.ModerationNotification || sent[0].Payload["status"] != "approved" {
+		t.Errorf("got notifications %+v, want one approval", sent)
+	}
+}
+
+func TestValidateReportsMissingDeps(t *testing.T) {
+	_, err := servicebuilder.BuildDonateServices(servicebuilder.DonateDeps{})
+	if err == nil {
+		t.Fatal("services are built without dependencies")
+	}
+	for _, dep := range []string{"logger", "mongo", "redis", "events", "audit key", "notifications", "users", "admins", "posts", "cache", "risk rules"} {
+		if !strings.Contains(err.Error(), dep) {
+			t.Errorf("error %q doesn't report missing %s", err, dep)
+		}
+	}
+}
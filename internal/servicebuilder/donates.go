@@ -1,12 +1,19 @@
 package servicebuilder
 
 import (
+	"fmt"
+	"strings"
 	"tempproj/internal/donates"
+	donateAudit "tempproj/internal/donates/audit"
+	donateCache "tempproj/internal/donates/cache"
+	donateDelivery "tempproj/internal/donates/delivery"
+	donateMetrics "tempproj/internal/donates/metrics"
+	donateRisk "tempproj/internal/donates/risk"
 	donateStorage "tempproj/internal/donates/storage"
 	donateUseCase "tempproj/internal/donates/usecase"
-	"tempproj/internal/events"
-	"tempproj/pkg/notification"
-	"tempproj/pkg/payment"
+	"tempproj/internal/followers"
+	"tempproj/internal/users"
+	"tempproj/pkg/messagequeue"
 
 	// ...
 
@@ -15,25 +22,177 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-func buildDonateService(
-	log *logrus.Entry,
-	mongo *mongo.Client,
-	client *redis.Client,
-	payments payment.Payments,
-	events events.UseCase,
-	notifications notification.UseCase,
-) donates.UseCase {
-	storage, err := donateStorage.New(log, mongo)
+// DonateDeps are dependencies of donate services. Users, Admins and Posts are
+// the parts of users and posts services donates use. Storage and AuditLog are
+// built on Mongo if they are empty, AuditKey keys hash chain of the built audit
+// log and must be kept out of Mongo, MQ is built on Redis if it's empty, system
+// clock and xid IDs are used if Clock and IDs are empty. Cache and RiskRules
+// are built on Redis if they are nil, so without Redis they must be set, empty
+// RiskRules turn risk checks off. Zero fields of Config are replaced with
+// donateUseCase.DefaultConfig values.
+type DonateDeps struct {
+	Log           *logrus.Entry
+	Mongo         *mongo.Client
+	Redis         *redis.Client
+	MQ            messagequeue.MessageQueue
+	Events        donateUseCase.Events
+	Notifications donateUseCase.Notifications
+	Users         donateUseCase.Users
+	Admins        donateUseCase.Admins
+	Posts         donateUseCase.Posts
+	Storage       donateStorage.Storage
+	AuditLog      donateAudit.Log
+	AuditKey      []byte
+	Clock         donates.Clock
+	IDs           donates.IDGenerator
+	Config        donateUseCase.Config
+	Cache         donateCache.Cache
+	RiskRules     []donateRisk.Rule
+}
+
+// Validate reports all missing dependencies at once
+func (d *DonateDeps) Validate() error {
+	missing := make([]string, 0)
+	check := func(name string, empty bool) {
+		if empty {
+			missing = append(missing, name)
+		}
+	}
+	check("logger", d.Log == nil)
+	check("mongo", d.Mongo == nil && (d.Storage == nil || d.AuditLog == nil))
+	check("audit key", d.AuditLog == nil && len(d.AuditKey) == 0)
+	check("redis", d.Redis == nil && d.MQ == nil)
+	check("cache", d.Redis == nil && d.Cache == nil)
+	check("risk rules", d.Redis == nil && d.RiskRules == nil)
+	check("events", d.Events == nil)
+	check("notifications", d.Notifications == nil)
+	check("users", d.Users == nil)
+	check("admins", d.Admins == nil)
+	check("posts", d.Posts == nil)
+	if len(missing) != 0 {
+		return fmt.Errorf("missing donates dependencies: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// DonateServices are services built from DonateDeps
+type DonateServices struct {
+	Service    donates.UseCase
+	Moderation donates.Moderation
+	Metrics    *donateMetrics.Metrics
+}
+
+// Stop background handlers of donate services
+func (s *DonateServices) Close() {
+	s.Service.Close()
+}
+
+func BuildDonateServices(deps DonateDeps) (*DonateServices, error) {
+	err := deps.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if deps.Clock == nil {
+		deps.Clock = donates.SystemClock
+	}
+	if deps.IDs == nil {
+		deps.IDs = donates.XIDs
+	}
+	metrics := donateMetrics.New()
+	storage := deps.Storage
+	if storage == nil {
+		storage, err = donateStorage.NewWithClock(deps.Log, deps.Mongo, deps.Clock)
+		if err != nil {
+			return nil, fmt.Errorf("can't create donates storage: %w", err)
+		}
+	}
+	storage = donateStorage.Instrument(storage, metrics)
+	auditLog := deps.AuditLog
+	if auditLog == nil {
+		auditLog, err = donateAudit.New(deps.Log, deps.Mongo, deps.AuditKey, deps.Clock, deps.IDs)
+		if err != nil {
+			return nil, fmt.Errorf("can't create donates audit log: %w", err)
+		}
+	}
+	opts := []donateUseCase.Option{
+		donateUseCase.WithClock(deps.Clock),
+		donateUseCase.WithIDGenerator(deps.IDs),
+		donateUseCase.WithConfig(deps.Config),
+	}
+	if deps.MQ != nil {
+		opts = append(opts, donateUseCase.WithMessageQueue(deps.MQ))
+	}
+	cache := deps.Cache
+	if cache == nil {
+		// Moderation drops counters cached by the service after stats
+		// rebuild. Zero TTL is the cache's default one.
+		cache, err = donateCache.New(deps.Log, deps.Redis, 0)
+		if err != nil {
+			return nil, fmt.Errorf("can't create donates cache: %w", err)
+		}
+	}
+	opts = append(opts, donateUseCase.WithCache(cache))
+	if deps.RiskRules != nil {
+		opts = append(opts, donateUseCase.WithRiskRules(deps.RiskRules...))
+	}
+	service, err := donateUseCase.NewWithDeps(deps.Log, storage, deps.Redis, deps.Events, deps.Notifications, deps.Users, deps.Posts, auditLog, metrics, opts...)
 	if err != nil {
-		log.Fatalf("failed while creating donates storage: %s", err)
+		return nil, fmt.Errorf("can't create donates service: %w", err)
 	}
-	donates, err := donateUseCase.New(log, storage, client, payments, events, notifications)
+	moderation, err := donateUseCase.NewModeration(deps.Log, storage, deps.Notifications, deps.Admins, auditLog, metrics, opts...)
 	if err != nil {
-		log.Fatalf("failed while creating donates service: %s", err)
+		return nil, fmt.Errorf("can't create donates moderation service: %w", err)
 	}
-	return donates
+	return &DonateServices{
+		Service:    service,
+		Moderation: moderation,
+		Metrics:    metrics,
+	}, nil
+}
+
+// Build websocket API of donates: traced, then limited by DefaultLimits
+func BuildDonateDelivery(log *logrus.Entry, service donates.UseCase, users users.UseCase, followers followers.UseCase, redis *redis.Client) (donateDelivery.Delivery, error) {
+	delivery, err := donateDelivery.New(log, service, users, followers)
+	if err != nil {
+		return nil, fmt.Errorf("can't create donates delivery: %w", err)
+	}
+	delivery, err = donateDelivery.WithRateLimit(log, delivery, redis, donateDelivery.DefaultLimits)
+	if err != nil {
+		return nil, fmt.Errorf("can't limit donates delivery: %w", err)
+	}
+	delivery, err = donateDelivery.WithTracing(delivery)
+	if err != nil {
+		return nil, fmt.Errorf("can't trace donates delivery: %w", err)
+	}
+	return delivery, nil
+}
+
+// Build admin websocket API of donates held by risk checks
+func BuildDonateModerationDelivery(log *logrus.Entry, moderation donates.Moderation, admins donateDelivery.Admins) (donateDelivery.ModerationDelivery, error) {
+	delivery, err := donateDelivery.NewModeration(log, moderation, admins)
+	if err != nil {
+		return nil, fmt.Errorf("can't create donates moderation delivery: %w", err)
+	}
+	return delivery, nil
 }
 
 func (b *ServiceBuilder) GetDonateService() donates.UseCase {
 	return b.donateService
 }
+
+func (b *ServiceBuilder) GetDonateDelivery() donateDelivery.Delivery {
+	return b.donateAPI
+}
+
+func (b *ServiceBuilder) GetDonateModeration() donates.Moderation {
+	return b.donateModeration
+}
+
+func (b *ServiceBuilder) GetDonateModerationDelivery() donateDelivery.ModerationDelivery {
+	return b.donateModerationAPI
+}
+
+// Metrics of donates service, mount GetDonateMetrics().Handler() to expose them
+func (b *ServiceBuilder) GetDonateMetrics() *donateMetrics.Metrics {
+	return b.donateServiceMetrics
+}
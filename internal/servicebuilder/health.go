@@ -0,0 +1,26 @@
+package servicebuilder
+
+import "context"
+
+// Health of services built by ServiceBuilder, the builder is ready when every
+// service is healthy
+type Health struct {
+	Healthy  bool                   `json:"healthy"`
+	Services map[string]interface{} `json:"services"`
+}
+
+func (b *ServiceBuilder) Health(ctx context.Context) *Health {
+	result := &Health{
+		Healthy:  true,
+		Services: map[string]interface{}{},
+	}
+	donates := b.donateService.Health(ctx)
+	result.Services["donates"] = donates
+	result.Healthy = result.Healthy && donates.Healthy
+	return result
+}
+
+// Ready reports whether the builder's services can serve requests
+func (b *ServiceBuilder) Ready(ctx context.Context) bool {
+	return b.Health(ctx).Healthy
+}